@@ -0,0 +1,427 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"maps"
+	"net"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/afero"
+)
+
+const (
+	cleanseExportLog     = "cleanse: export: %v"
+	cleanseExportMissing = "cleanse: No export file set; use -export"
+	cleanseOutDirLog     = "cleanse: outdir: %v"
+	cleanseOutDirMissing = "cleanse: No outdir set; use -outdir"
+	cleanseOutDirExport  = "cleanse: outdir %v holds export %v, which cleansing would overwrite; use another -outdir"
+	cleanseTotalLog      = "cleanse: %v files in %v"
+	cleanseDroppedLog    = "cleanse: dropped %v files %v to %v"
+	cleanseWrittenLog    = "cleanse: %v files written to %v, largest first"
+	cleanseErrLog        = "cleanse: %v"
+
+	// exportFields is the number of | separated fields in a FileGet.jar
+	// export line: name|create time|fan ip|fan uri|file size|backup file|
+	// file id|file hash|backupkv status
+	exportFields = 9
+
+	exportNull        = "null"
+	exportExtracted   = "backupkv Extracted"
+	regexBackupGUID   = "^[a-fA-F0-9]{8}(-[a-fA-F0-9]{8}){5}$"
+	regexFanURIPrefix = `^ftp://([^@/]*@)?((?:[0-9]{1,3}\.){3}[0-9]{1,3}):2121/?`
+)
+
+// exportLine is one line of a FileGet.jar export
+type exportLine struct {
+	name       string
+	createTime string
+	fanIP      string
+	fanURI     string
+	size       string
+	backupFile string
+	id         string
+	hash       string
+	backupKV   string
+
+	raw         string
+	fields      int
+	stagingPath string
+	sizeBytes   int64
+}
+
+// cleanseReject is a reason to drop an export line & the file the dropped
+// lines are written to, as named by process_async_processed.sh
+type cleanseReject struct {
+	file   string
+	reason string
+	drop   func(l *exportLine) bool
+}
+
+var (
+	backupGUID   = regexp.MustCompile(regexBackupGUID)
+	fanURIPrefix = regexp.MustCompile(regexFanURIPrefix)
+
+	// fanStagingRoots maps the fan volume at the start of a fan uri to the
+	// staging path it is mounted at on the node
+	fanStagingRoots = map[string]string{
+		"fan":    "mb/FAN",
+		"fan_c0": "data1/staging",
+		"fan_c1": "data2/staging",
+		"fan_c2": "data3/staging",
+	}
+
+	// cleanseRejects are checked in order, so a line is dropped for the first
+	// reason it matches
+	cleanseRejects = []cleanseReject{
+		{
+			file:   "dumped_malformed_lines.out",
+			reason: "without 9 fields",
+			drop:   func(l *exportLine) bool { return l.fields != exportFields },
+		},
+		{
+			file:   "dumped_non_backup_guids.out",
+			reason: "without a backup GUID name",
+			drop:   func(l *exportLine) bool { return !backupGUID.MatchString(l.name) },
+		},
+		{
+			file:   "dumped_files_with_hash.out",
+			reason: "with a hash (in gbfs)",
+			drop:   func(l *exportLine) bool { return l.hash != "" },
+		},
+		{
+			file:   "dumped_files_with_no_fanip.out",
+			reason: "with no fan ip",
+			drop:   func(l *exportLine) bool { return l.fanIP == exportNull },
+		},
+		{
+			file:   "dumped_files_with_no_fanuri.out",
+			reason: "with no fan uri",
+			drop:   func(l *exportLine) bool { return l.fanURI == exportNull },
+		},
+		{
+			file:   "dumped_files_with_extracted.out",
+			reason: "with backupkv Extracted",
+			drop:   func(l *exportLine) bool { return strings.Contains(l.raw, exportExtracted) },
+		},
+		{
+			file:   "dumped_files_with_unknown_fanuri.out",
+			reason: "with a fan uri on an unknown fan volume",
+			drop:   func(l *exportLine) bool { return !l.setStagingPath() },
+		},
+		{
+			file:   "dumped_files_with_bad_size.out",
+			reason: "with a size that is not a number",
+			drop:   func(l *exportLine) bool { return !l.setSize() },
+		},
+	}
+)
+
+// runCleanse reads the raw FileGet.jar -export, drops the lines that cannot be
+// processed into per reason files in -outdir & writes the rest to -outdir in
+// the sourcefile format, largest first
+func runCleanse(e *env, _ AsyncProcessor) int {
+	e.logger.Info(fmt.Sprintf(commandLog, cleanseCmd))
+
+	err := e.setExport(exportFile)
+	if err == nil {
+		err = e.setOutDir(outDir)
+	}
+
+	if err == nil {
+		err = e.cleanse()
+	}
+
+	if err != nil {
+		e.logger.Error(fmt.Sprintf(cleanseErrLog, err))
+		return classify(err).exitCode()
+	}
+
+	return exitOK
+}
+
+func (e *env) setExport(pth string) error {
+	logger := e.logger
+
+	if pth == "" {
+		return fmt.Errorf(errWrapMsg, ErrSourceFile, cleanseExportMissing)
+	}
+
+	e.exportFile = pth
+
+	logger.Info(fmt.Sprintf(cleanseExportLog, pth))
+
+	return nil
+}
+
+func (e *env) setOutDir(dir string) error {
+	logger := e.logger
+
+	if dir == "" {
+		return fmt.Errorf(errWrapMsg, ErrOutDir, cleanseOutDirMissing)
+	}
+
+	e.outDir = dir
+
+	logger.Info(fmt.Sprintf(cleanseOutDirLog, dir))
+
+	return nil
+}
+
+// cleanse cleanses e.exportFile into e.outDir. The cleansed list takes the
+// export's name, so e.outDir must not be the export's directory
+func (e *env) cleanse() error {
+	logger := e.logger
+
+	if sameDir(e.outDir, path.Dir(e.exportFile)) {
+		return fmt.Errorf(errWrapMsg, ErrOutDir, fmt.Sprintf(cleanseOutDirExport, e.outDir, e.exportFile))
+	}
+
+	data, err := afero.ReadFile(e.afs, e.exportFile)
+	if err != nil {
+		return fmt.Errorf(errWrap, ErrSourceFile, err)
+	}
+
+	kept, dropped := cleanseExport(data)
+
+	logger.Info(fmt.Sprintf(cleanseTotalLog, len(kept)+countDropped(dropped), e.exportFile))
+
+	err = e.afs.MkdirAll(e.outDir, 0755)
+	if err != nil {
+		return fmt.Errorf(errWrap, ErrOutDir, err)
+	}
+
+	for i, reject := range cleanseRejects {
+		pth := path.Join(e.outDir, reject.file)
+
+		err = e.writeLines(pth, dropped[i])
+		if err != nil {
+			return err
+		}
+
+		logger.Info(fmt.Sprintf(cleanseDroppedLog, len(dropped[i]), reject.reason, pth))
+	}
+
+	var cleansed []string
+
+	for _, l := range kept {
+		cleansed = append(cleansed, l.sourceLine())
+	}
+
+	pth := path.Join(e.outDir, path.Base(e.exportFile))
+
+	err = e.writeLines(pth, cleansed)
+	if err != nil {
+		return err
+	}
+
+	logger.Info(fmt.Sprintf(cleanseWrittenLog, len(cleansed), pth))
+
+	return nil
+}
+
+// cleanseExport splits the lines of a FileGet.jar export, after its header,
+// into those kept, largest first, & those dropped by each of cleanseRejects
+func cleanseExport(data []byte) ([]exportLine, [][]string) {
+	var kept []exportLine
+
+	dropped := make([][]string, len(cleanseRejects))
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+
+	// Drop the header
+	scanner.Scan()
+
+lines:
+	for scanner.Scan() {
+		raw := scanner.Text()
+		if raw == "" {
+			continue
+		}
+
+		l := parseExportLine(raw)
+
+		for i, reject := range cleanseRejects {
+			if reject.drop(&l) {
+				dropped[i] = append(dropped[i], raw)
+				continue lines
+			}
+		}
+
+		kept = append(kept, l)
+	}
+
+	sort.SliceStable(kept, func(i, j int) bool {
+		return kept[i].sizeBytes > kept[j].sizeBytes
+	})
+
+	return kept, dropped
+}
+
+// parseExportLine returns the fields of raw, or an exportLine with only raw &
+// fields set if raw does not have exportFields fields
+func parseExportLine(raw string) exportLine {
+	fields := strings.Split(raw, "|")
+	if len(fields) != exportFields {
+		return exportLine{raw: raw, fields: len(fields)}
+	}
+
+	return exportLine{
+		name:       fields[0],
+		createTime: fields[1],
+		fanIP:      fields[2],
+		fanURI:     fields[3],
+		size:       fields[4],
+		backupFile: fields[5],
+		id:         fields[6],
+		hash:       fields[7],
+		backupKV:   fields[8],
+		raw:        raw,
+		fields:     len(fields),
+	}
+}
+
+// setStagingPath sets l.stagingPath to where l.fanURI is on the node
+func (l *exportLine) setStagingPath() bool {
+	pth, ok := fanStagingPath(l.fanURI)
+	if !ok {
+		return false
+	}
+
+	l.stagingPath = pth
+
+	return true
+}
+
+// fanStagingPath returns where the file at a fan uri is on its node, e.g.
+// ftp://user@10.41.28.112:2121/fan_c0:/download/x is data1/staging/download/x.
+// As in process_async_processed.sh, a uri without a fan volume, e.g.
+// ftp://user@10.41.28.112:2121/download/x, is left as download/x
+func fanStagingPath(uri string) (string, bool) {
+	volume, pth := splitFanURI(uri)
+	if volume == "" {
+		if pth == "" {
+			return "", false
+		}
+
+		return path.Clean(pth), true
+	}
+
+	root, ok := fanStagingRoots[volume]
+	if !ok {
+		return "", false
+	}
+
+	return path.Join(root, pth), true
+}
+
+// fanStagingPaths returns the staging paths the file at a fan uri may be at
+// on its node. A uri with a fan volume gives one, while one without, as gbr
+// gives it, may be under any of fanStagingRoots
+func fanStagingPaths(uri string) []string {
+	volume, pth := splitFanURI(uri)
+	if volume != "" {
+		if staging, ok := fanStagingPath(uri); ok {
+			return []string{staging}
+		}
+
+		return nil
+	}
+
+	if pth == "" {
+		return nil
+	}
+
+	var pths []string
+
+	for _, volume := range slices.Sorted(maps.Keys(fanStagingRoots)) {
+		pths = append(pths, path.Join(fanStagingRoots[volume], pth))
+	}
+
+	return pths
+}
+
+// splitFanURI splits a fan uri into its fan volume, which is "" if it has
+// none, & the path after it
+func splitFanURI(uri string) (string, string) {
+	uri = strings.TrimPrefix(fanURIPrefix.ReplaceAllString(uri, ""), "/")
+
+	first, _, _ := strings.Cut(uri, "/")
+	if !strings.Contains(first, ":") {
+		return "", uri
+	}
+
+	volume, pth, _ := strings.Cut(uri, ":")
+
+	return volume, pth
+}
+
+// fanHost returns the IP of the node a fan uri is on, or nil if it has none
+func fanHost(uri string) net.IP {
+	m := fanURIPrefix.FindStringSubmatch(uri)
+	if m == nil {
+		return nil
+	}
+
+	return net.ParseIP(m[2])
+}
+
+func (l *exportLine) setSize() bool {
+	size, err := strconv.ParseInt(l.size, 10, 64)
+	if err != nil {
+		return false
+	}
+
+	l.sizeBytes = size
+
+	return true
+}
+
+// sourceLine returns l in the sourcefile format read by parseLine
+func (l *exportLine) sourceLine() string {
+	return strings.Join([]string{l.name, l.stagingPath, l.createTime, l.size, l.id, l.fanIP, ""}, "|")
+}
+
+// writeLines writes lines to pth, one to a line
+func (e *env) writeLines(pth string, lines []string) error {
+	var buf bytes.Buffer
+
+	for _, line := range lines {
+		buf.WriteString(line)
+		buf.WriteByte('\n')
+	}
+
+	err := afero.WriteFile(e.afs, pth, buf.Bytes(), 0644)
+	if err != nil {
+		return fmt.Errorf(errWrap, ErrOutDir, err)
+	}
+
+	return nil
+}
+
+// sameDir reports whether a & b are the same directory once made absolute
+func sameDir(a string, b string) bool {
+	absA, errA := filepath.Abs(a)
+	absB, errB := filepath.Abs(b)
+
+	if errA != nil || errB != nil {
+		return path.Clean(a) == path.Clean(b)
+	}
+
+	return absA == absB
+}
+
+func countDropped(dropped [][]string) (n int) {
+	for _, lines := range dropped {
+		n += len(lines)
+	}
+
+	return n
+}
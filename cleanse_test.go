@@ -0,0 +1,229 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+// testdataDir is absolute as TestRootFSMap changes the working directory
+var testdataDir, _ = filepath.Abs("testdata")
+
+const (
+	testExportFile    = "export.out"
+	testCleanseGolden = "async_processed_files.golden"
+	testOutDir        = "out"
+)
+
+func TestCleanse(t *testing.T) {
+	setup := func(t *testing.T) (*env, afero.Fs) {
+		data, err := os.ReadFile(path.Join(testdataDir, "cleanse", testExportFile))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		afs := afero.NewMemMapFs()
+
+		err = afero.WriteFile(afs, testExportFile, data, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		e := new(env)
+		e.logger, hook = setupLogs()
+		e.afs = afs
+		e.exportFile = testExportFile
+		e.outDir = testOutDir
+
+		return e, afs
+	}
+
+	t.Run("should write the cleansed list largest first", func(t *testing.T) {
+		e, afs := setup(t)
+		assert.NoError(t, e.cleanse())
+
+		got, err := afero.ReadFile(afs, path.Join(testOutDir, testExportFile))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want, err := os.ReadFile(path.Join(testdataDir, "cleanse", testCleanseGolden))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assertCorrectString(t, string(got), string(want))
+
+		gotLogMsg := hook.LastEntry().Message
+		wantLogMsg := fmt.Sprintf(cleanseWrittenLog, 3, path.Join(testOutDir, testExportFile))
+		assertCorrectString(t, gotLogMsg, wantLogMsg)
+	})
+
+	t.Run("cleansed lines should parse", func(t *testing.T) {
+		e, afs := setup(t)
+		assert.NoError(t, e.cleanse())
+
+		data, err := afero.ReadFile(afs, path.Join(testOutDir, testExportFile))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, line := range strings.Split(strings.TrimSuffix(string(data), "\n"), "\n") {
+			f, err := parseLine(line, e)
+			assert.NoError(t, err)
+			assert.NotEmpty(t, f.fanIP)
+			assert.NotZero(t, f.size)
+		}
+	})
+
+	// Each reject file gets the whole export line, keyed here by its name
+	rejectTests := []struct {
+		file string
+		want []string
+	}{
+		{"dumped_malformed_lines.out", []string{"truncated|line"}},
+		{"dumped_non_backup_guids.out", []string{"not-a-backup-file.txt"}},
+		{"dumped_files_with_hash.out", []string{"deadbeef-00000006"}},
+		{"dumped_files_with_no_fanip.out", []string{"cafebabe-00000006"}},
+		{"dumped_files_with_no_fanuri.out", []string{"feedface-00000006"}},
+		{"dumped_files_with_extracted.out", []string{"0badf00d-00000006"}},
+		{"dumped_files_with_unknown_fanuri.out", []string{"abad1dea-00000006"}},
+		{"dumped_files_with_bad_size.out", []string{"bada55e5-00000006"}},
+	}
+
+	for _, tt := range rejectTests {
+		t.Run("should drop lines to "+tt.file, func(t *testing.T) {
+			e, afs := setup(t)
+			assert.NoError(t, e.cleanse())
+
+			data, err := afero.ReadFile(afs, path.Join(testOutDir, tt.file))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+			assert.Len(t, lines, len(tt.want))
+
+			for i, want := range tt.want {
+				assert.True(t, strings.HasPrefix(lines[i], want), lines[i])
+			}
+		})
+	}
+
+	t.Run("should error on an export that cannot be read", func(t *testing.T) {
+		e, _ := setup(t)
+		e.exportFile = testName
+
+		assert.ErrorIs(t, e.cleanse(), ErrSourceFile)
+	})
+
+	for _, dir := range []string{".", "./", "out/.."} {
+		t.Run(fmt.Sprintf("should error rather than overwrite the export in outdir %q", dir), func(t *testing.T) {
+			e, afs := setup(t)
+			e.outDir = dir
+
+			err := e.cleanse()
+			assert.ErrorIs(t, err, ErrOutDir)
+			assert.ErrorContains(t, err, fmt.Sprintf(cleanseOutDirExport, dir, testExportFile))
+
+			got, err := afero.ReadFile(afs, testExportFile)
+			assert.NoError(t, err)
+			assert.Contains(t, string(got), "truncated|line")
+		})
+	}
+}
+
+func TestSetStagingPath(t *testing.T) {
+	tests := []struct {
+		uri  string
+		want string
+		ok   bool
+	}{
+		{"ftp://user@10.41.28.112:2121/fan:/download/a", "mb/FAN/download/a", true},
+		{"ftp://user@10.41.28.112:2121/fan_c0:/download/a", "data1/staging/download/a", true},
+		{"ftp://10.41.28.112:2121fan_c1:/download/a", "data2/staging/download/a", true},
+		{"ftp://user@10.41.28.112:2121/fan_c2:download/a", "data3/staging/download/a", true},
+		{"ftp://user@10.41.28.112:2121/fan_c3:/download/a", "", false},
+		{"ftp://user@10.41.28.112:2121/download/a", "download/a", true},
+		{"ftp://user@10.41.28.112:2121/", "", false},
+		{"ftp://user@nas01:2121/fan_c0:/download/a", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.uri, func(t *testing.T) {
+			l := exportLine{fanURI: tt.uri}
+
+			assert.Equal(t, tt.ok, l.setStagingPath())
+			assertCorrectString(t, l.stagingPath, tt.want)
+		})
+	}
+}
+
+func TestFanHost(t *testing.T) {
+	assert.Equal(t, net.ParseIP("10.41.28.112"), fanHost("ftp://user@10.41.28.112:2121/fan_c0:/download/a"))
+	assert.Equal(t, net.ParseIP("10.41.28.112"), fanHost("ftp://10.41.28.112:2121fan_c1:/download/a"))
+	assert.Nil(t, fanHost("ftp://user@nas01:2121/fan_c0:/download/a"))
+}
+
+func TestSetExport(t *testing.T) {
+	t.Run("should set export & outdir", func(t *testing.T) {
+		e := new(env)
+		e.logger, hook = setupLogs()
+
+		assert.NoError(t, e.setExport(testExportFile))
+		assertCorrectString(t, e.exportFile, testExportFile)
+
+		assert.NoError(t, e.setOutDir(testOutDir))
+		assertCorrectString(t, e.outDir, testOutDir)
+
+		gotLogMsg := hook.LastEntry().Message
+		wantLogMsg := fmt.Sprintf(cleanseOutDirLog, testOutDir)
+		assertCorrectString(t, gotLogMsg, wantLogMsg)
+	})
+
+	errorTests := []struct {
+		name    string
+		set     func(e *env) error
+		wantErr error
+		wantMsg string
+	}{
+		{"export", func(e *env) error { return e.setExport("") }, ErrSourceFile, cleanseExportMissing},
+		{"outdir", func(e *env) error { return e.setOutDir("") }, ErrOutDir, cleanseOutDirMissing},
+	}
+
+	for _, tt := range errorTests {
+		t.Run("should error without "+tt.name, func(t *testing.T) {
+			e := new(env)
+			e.logger, _ = setupLogs()
+
+			err := tt.set(e)
+			assert.ErrorIs(t, err, tt.wantErr)
+			assert.ErrorContains(t, err, tt.wantMsg)
+		})
+	}
+}
+
+func TestRunCleanse(t *testing.T) {
+	t.Run("should exit aborted without an export", func(t *testing.T) {
+		saved := exportFile
+		exportFile = ""
+
+		defer func() { exportFile = saved }()
+
+		e := new(env)
+		e.logger, hook = setupLogs()
+
+		assert.Equal(t, exitAborted, runCleanse(e, nil))
+
+		assert.Equal(t, logrus.ErrorLevel, hook.LastEntry().Level)
+		assert.Contains(t, hook.LastEntry().Message, cleanseExportMissing)
+	})
+}
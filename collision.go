@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+)
+
+const (
+	fCollisionSkipLog       = "%v (file.id:%v) newPath:%v already exists; skipping file"
+	fCollisionFailLog       = "%v (file.id:%v) newPath:%v already exists; failing file"
+	fCollisionStatErrLog    = "%v (file.id:%v) newPath:%v could not be checked: %v; failing file"
+	fCollisionIdenticalLog  = "%v (file.id:%v) newPath:%v already exists with identical hash:%x; overwriting"
+	fCollisionHashDiffLog   = "%v (file.id:%v) newPath:%v already exists with hash:%x not matching f.oldHash:%x; failing file"
+	fCollisionRenameLog     = "%v (file.id:%v) newPath:%v already exists; moving to:%v"
+	fCollisionNoSuffixLog   = "%v (file.id:%v) newPath:%v & its first %v suffixes already exist; failing file"
+	fCollisionPlannedLog    = "%v (file.id:%v) planned newPath:%v has been created since planning; failing file"
+	collisionSuffixFmt      = "%v.%d"
+	errCollision            = "%w: newPath:%v: %v"
+	collisionSuffixAttempts = 1000
+
+	collisionSkip      = "skip"
+	collisionFail      = "fail"
+	collisionOverwrite = "overwrite-if-identical-hash"
+	collisionRename    = "rename-with-suffix"
+
+	reasonCollision             = "newPath already exists"
+	reasonCollisionHashMismatch = "newPath already exists with a different hash"
+	reasonCollisionStatErr      = "newPath could not be checked"
+	reasonCollisionPlanned      = "planned newPath has been created since planning"
+)
+
+// collisionPolicies are the -collision policies
+var collisionPolicies = []string{collisionSkip, collisionFail, collisionOverwrite, collisionRename}
+
+// collisionResult records what file.move did about an existing newPath
+type collisionResult int
+
+const (
+	// collisionNone means nothing was at newPath
+	collisionNone collisionResult = iota
+	// collisionSkipped means newPath existed so the file was left in place
+	collisionSkipped
+	// collisionFailed means newPath existed so the file failed
+	collisionFailed
+	// collisionOverwritten means newPath held an identical file & was replaced
+	collisionOverwritten
+	// collisionRenamed means the file was moved to newPath with a suffix
+	collisionRenamed
+)
+
+func (c collisionResult) String() string {
+	switch c {
+	case collisionSkipped:
+		return "skipped"
+	case collisionFailed:
+		return "failed"
+	case collisionOverwritten:
+		return "overwritten"
+	case collisionRenamed:
+		return "renamed"
+	default:
+		return "none"
+	}
+}
+
+// collisionPolicy returns the collision policy set in e, defaulting to fail
+func (e *env) collisionPolicy() string {
+	if e.collision == "" {
+		return collisionFail
+	}
+
+	return e.collision
+}
+
+// collisionErr returns an error wrapping ErrCollision if resolveCollision
+// failed f, so that f is reported as failed rather than skipped
+func (f *file) collisionErr(dst string) error {
+	if f.collision != collisionFailed {
+		return nil
+	}
+
+	return fmt.Errorf(errCollision, ErrCollision, dst, f.reason)
+}
+
+// resolveCollision applies e's collision policy if dst already exists. It
+// returns the path to move to, or false if the file must not be moved, in
+// which case f.reason says why. See collisionErr for whether that is a
+// failure. A planned file is only ever moved to its planned dst, see
+// resolvePlannedCollision
+func (f *file) resolveCollision(dst string, e *env) (string, bool) {
+	logger := e.logger
+
+	_, err := e.afs.Stat(dst)
+	if errors.Is(err, fs.ErrNotExist) {
+		f.collision = collisionNone
+		return dst, true
+	}
+
+	if err != nil {
+		logger.Error(fmt.Sprintf(fCollisionStatErrLog, f.smbName, f.id, dst, err))
+		f.collision = collisionFailed
+		f.reason = reasonCollisionStatErr
+
+		return "", false
+	}
+
+	if f.planned != nil {
+		return f.resolvePlannedCollision(dst, e)
+	}
+
+	switch e.collisionPolicy() {
+	case collisionSkip:
+		logger.Warn(fmt.Sprintf(fCollisionSkipLog, f.smbName, f.id, dst))
+		f.collision = collisionSkipped
+		f.reason = reasonCollision
+
+		return "", false
+	case collisionOverwrite:
+		return f.overwriteIfIdentical(dst, e)
+	case collisionRename:
+		for n := 1; n <= collisionSuffixAttempts; n++ {
+			candidate := fmt.Sprintf(collisionSuffixFmt, dst, n)
+
+			_, err := e.afs.Stat(candidate)
+			if errors.Is(err, fs.ErrNotExist) {
+				logger.Warn(fmt.Sprintf(fCollisionRenameLog, f.smbName, f.id, dst, candidate))
+				f.collision = collisionRenamed
+
+				return candidate, true
+			}
+		}
+
+		logger.Error(fmt.Sprintf(fCollisionNoSuffixLog, f.smbName, f.id, dst, collisionSuffixAttempts))
+		f.collision = collisionFailed
+		f.reason = reasonCollision
+
+		return "", false
+	default:
+		logger.Error(fmt.Sprintf(fCollisionFailLog, f.smbName, f.id, dst))
+		f.collision = collisionFailed
+		f.reason = reasonCollision
+
+		return "", false
+	}
+}
+
+// resolvePlannedCollision fails a planned f whose dst exists, whatever e's
+// collision policy, as apply moves a file exactly as planned or not at all.
+// The exception is a dst the plan chose to overwrite, which is overwritten
+// only if it is still identical
+func (f *file) resolvePlannedCollision(dst string, e *env) (string, bool) {
+	if f.planned.Collision == collisionOverwritten.String() {
+		return f.overwriteIfIdentical(dst, e)
+	}
+
+	e.logger.Error(fmt.Sprintf(fCollisionPlannedLog, f.smbName, f.id, dst))
+	f.collision = collisionFailed
+	f.reason = reasonCollisionPlanned
+
+	return "", false
+}
+
+// overwriteIfIdentical returns dst if its hash matches f.oldHash, so
+// overwriting it loses nothing
+func (f *file) overwriteIfIdentical(dst string, e *env) (string, bool) {
+	sum, err := hashFile(dst, e)
+	if err == nil && len(f.oldHash) > 0 && bytes.Equal(sum, f.oldHash) {
+		e.logger.Warn(fmt.Sprintf(fCollisionIdenticalLog, f.smbName, f.id, dst, sum))
+		f.collision = collisionOverwritten
+
+		return dst, true
+	}
+
+	e.logger.Error(fmt.Sprintf(fCollisionHashDiffLog, f.smbName, f.id, dst, sum, f.oldHash))
+	f.collision = collisionFailed
+	f.reason = reasonCollisionHashMismatch
+
+	return "", false
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+const testCollisionContent = "already here"
+
+func TestResolveCollision(t *testing.T) {
+	setup := func(t *testing.T, policy string, existing string) (*env, *file, string) {
+		e := new(env)
+		e.afs = afero.NewMemMapFs()
+		e.logger, hook = setupLogs()
+		e.collision = policy
+
+		f := &file{smbName: testName, id: testFileID, stagingPath: testPath}
+
+		err := afero.WriteFile(e.afs, f.stagingPath, []byte(testContent), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = f.hasher(e)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		f.oldHash = f.hash
+		f.oldStagingPath = f.stagingPath
+		dst := mustNewPath(t, *f)
+
+		if existing != "" {
+			err = afero.WriteFile(e.afs, dst, []byte(existing), 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		return e, f, dst
+	}
+
+	assertContent := func(t *testing.T, e *env, pth string, want string) {
+		t.Helper()
+
+		got, err := afero.ReadFile(e.afs, pth)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assertCorrectString(t, string(got), want)
+	}
+
+	t.Run("should move if nothing is at newPath", func(t *testing.T) {
+		e, f, dst := setup(t, collisionFail, "")
+
+		moved, err := f.move(e)
+		assert.NoError(t, err)
+		assert.True(t, moved)
+		assert.Equal(t, collisionNone, f.collision)
+		assertCorrectString(t, f.stagingPath, dst)
+	})
+
+	t.Run("skip should leave both files alone", func(t *testing.T) {
+		e, f, dst := setup(t, collisionSkip, testCollisionContent)
+
+		moved, err := f.move(e)
+		assert.NoError(t, err)
+		assert.False(t, moved)
+		assert.Equal(t, collisionSkipped, f.collision)
+		assertCorrectString(t, f.reason, reasonCollision)
+		assertCorrectString(t, f.stagingPath, testPath)
+		assertContent(t, e, testPath, testContent)
+		assertContent(t, e, dst, testCollisionContent)
+
+		gotLogMsg := hook.LastEntry().Message
+		wantLogMsg := fmt.Sprintf(fCollisionSkipLog, f.smbName, f.id, dst)
+		assertCorrectString(t, gotLogMsg, wantLogMsg)
+	})
+
+	t.Run("fail should leave both files alone", func(t *testing.T) {
+		e, f, dst := setup(t, collisionFail, testCollisionContent)
+
+		moved, err := f.move(e)
+		assert.ErrorIs(t, err, ErrCollision)
+		assert.False(t, moved)
+		assert.Equal(t, collisionFailed, f.collision)
+		assertCorrectString(t, f.reason, reasonCollision)
+		assertContent(t, e, testPath, testContent)
+		assertContent(t, e, dst, testCollisionContent)
+
+		gotLogMsg := hook.LastEntry().Message
+		wantLogMsg := fmt.Sprintf(fCollisionFailLog, f.smbName, f.id, dst)
+		assertCorrectString(t, gotLogMsg, wantLogMsg)
+	})
+
+	t.Run("fail should be the default", func(t *testing.T) {
+		e, f, _ := setup(t, "", testCollisionContent)
+
+		moved, err := f.move(e)
+		assert.ErrorIs(t, err, ErrCollision)
+		assert.False(t, moved)
+		assert.Equal(t, collisionFailed, f.collision)
+	})
+
+	t.Run("overwrite-if-identical-hash should overwrite an identical file", func(t *testing.T) {
+		e, f, dst := setup(t, collisionOverwrite, testContent)
+
+		moved, err := f.move(e)
+		assert.NoError(t, err)
+		assert.True(t, moved)
+		assert.Equal(t, collisionOverwritten, f.collision)
+		assertCorrectString(t, f.stagingPath, dst)
+		assertContent(t, e, dst, testContent)
+
+		_, err = e.afs.Stat(testPath)
+		assert.NotNil(t, err)
+	})
+
+	t.Run("overwrite-if-identical-hash should fail on a different file", func(t *testing.T) {
+		e, f, dst := setup(t, collisionOverwrite, testCollisionContent)
+
+		moved, err := f.move(e)
+		assert.ErrorIs(t, err, ErrCollision)
+		assert.False(t, moved)
+		assert.Equal(t, collisionFailed, f.collision)
+		assertCorrectString(t, f.reason, reasonCollisionHashMismatch)
+		assertContent(t, e, testPath, testContent)
+		assertContent(t, e, dst, testCollisionContent)
+	})
+
+	t.Run("rename-with-suffix should move beside the existing file", func(t *testing.T) {
+		e, f, dst := setup(t, collisionRename, testCollisionContent)
+
+		err := afero.WriteFile(e.afs, fmt.Sprintf(collisionSuffixFmt, dst, 1), []byte(testCollisionContent), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want := fmt.Sprintf(collisionSuffixFmt, dst, 2)
+
+		moved, err := f.move(e)
+		assert.NoError(t, err)
+		assert.True(t, moved)
+		assert.Equal(t, collisionRenamed, f.collision)
+		assertCorrectString(t, f.stagingPath, want)
+		assertContent(t, e, want, testContent)
+		assertContent(t, e, dst, testCollisionContent)
+
+		entries, err := afero.ReadDir(e.afs, path.Dir(dst))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assert.Len(t, entries, 3)
+	})
+}
+
+func TestCollisionResultString(t *testing.T) {
+	results := map[collisionResult]string{
+		collisionNone:        "none",
+		collisionSkipped:     "skipped",
+		collisionFailed:      "failed",
+		collisionOverwritten: "overwritten",
+		collisionRenamed:     "renamed",
+	}
+
+	for result, want := range results {
+		assertCorrectString(t, result.String(), want)
+	}
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	datasetResolverLog        = "datasetresolver: %v"
+	datasetResolverGbrLog     = "datasetresolver: gbr takes the first ID in pool ls -d, which may be the pool's; prefer cqlsh"
+	datasetResolverCqlshLog   = "datasetresolver: cqlsh %v querying %v in turn on port %v with a timeout of %v"
+	datasetResolverInvalidLog = "datasetresolver: %v is not a supported resolver; use one of %v"
+	datasetNameLog            = "datasetname: %v"
+	datasetNameNoneLog        = "datasetname: No dataset name set; looking for the async processed dataset"
+	datasetNameResolvedLog    = "datasetname: %v resolved to datasetID: %v"
+	cqlshDatasetLog           = "cqlsh found dataset %v as %v"
+	cqlshHostErrLog           = "cqlsh could not query %v: %v"
+
+	errDatasetByName     = "%v cannot look up a dataset by name; use -dataset-resolver %v"
+	errCqlshDataset      = "cqlsh could not find a dataset matching %q: %v"
+	errCqlshNoDataset    = "no rows match"
+	errCqlshManyDatasets = "%v rows match: %v"
+	errCqlshRow          = "cqlsh row %q does not have a name & id"
+
+	resolverGbr   = "gbr"
+	resolverCqlsh = "cqlsh"
+
+	defaultCqlshPath = "/usr/lib64/GB/DCF/JServices/MbService/bin/cqlsh"
+	defaultCqlshPort = 21205
+	// cqlshDatasetsQuery lists every dataset by name, as
+	// process_node_async_processed_list.sh did
+	cqlshDatasetsQuery = "select * from storage.datasets_by_name"
+	// asyncProcessedPrefix starts the name of the async processed dataset
+	asyncProcessedPrefix = "ASYNCH PROCESSED FILES FOR"
+)
+
+var (
+	datasetResolvers = []string{resolverGbr, resolverCqlsh}
+
+	// cqlshSeparator matches the line between cqlsh's header & its rows
+	cqlshSeparator = regexp.MustCompile(`^-+(\+-+)*$`)
+)
+
+// DatasetResolver looks up the id of a dataset
+type DatasetResolver interface {
+	// DatasetID returns the id of the dataset named name or, if name is "",
+	// of the async processed dataset
+	DatasetID(name string) (string, error)
+}
+
+// gbrDatasetResolver takes the async processed dataset from gbr pool ls -d,
+// so cannot look a dataset up by name. The first ID there may be the pool's,
+// so cqlsh is the default
+type gbrDatasetResolver struct {
+	e *env
+}
+
+func (r gbrDatasetResolver) DatasetID(name string) (string, error) {
+	if name != "" {
+		return "", fmt.Errorf(errWrapMsg, ErrDataset, fmt.Sprintf(errDatasetByName, resolverGbr, resolverCqlsh))
+	}
+
+	return getAsyncProcessedDSID(r.e)
+}
+
+// cqlshDatasetResolver queries the metadata service's datasets_by_name table
+// with cqlsh, trying each host in turn until one answers. Each name is only
+// looked up once a run
+type cqlshDatasetResolver struct {
+	path    string
+	hosts   []string
+	port    int
+	timeout time.Duration
+	logger  *logrus.Logger
+
+	mu  sync.Mutex
+	ids map[string]string
+}
+
+func newCqlshDatasetResolver(
+	pth string,
+	hosts []string,
+	port int,
+	timeout time.Duration,
+	logger *logrus.Logger) *cqlshDatasetResolver {
+	return &cqlshDatasetResolver{
+		path:    pth,
+		hosts:   hosts,
+		port:    port,
+		timeout: timeout,
+		logger:  logger,
+		ids:     map[string]string{},
+	}
+}
+
+func (r *cqlshDatasetResolver) DatasetID(name string) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if id, ok := r.ids[name]; ok {
+		return id, nil
+	}
+
+	out, err := r.query()
+	if err != nil {
+		return "", fmt.Errorf(errWrapMsg, ErrDataset, err)
+	}
+
+	id, err := parseCqlshDatasetID(out, name)
+	if err != nil {
+		return "", err
+	}
+
+	r.logger.Info(fmt.Sprintf(cqlshDatasetLog, name, id))
+	r.ids[name] = id
+
+	return id, nil
+}
+
+// query runs cqlshDatasetsQuery against each host in turn & returns the
+// output of the first that answers or, if none does, the last error
+func (r *cqlshDatasetResolver) query() (string, error) {
+	var err error
+
+	for _, host := range r.hosts {
+		var out string
+
+		out, err = runTimeout(r.path, r.timeout, host, strconv.Itoa(r.port), "-e", cqlshDatasetsQuery)
+		if err == nil {
+			return out, nil
+		}
+
+		r.logger.Warn(fmt.Sprintf(cqlshHostErrLog, host, err))
+	}
+
+	if err == nil {
+		err = fmt.Errorf(errWrapMsg, ErrLookupIP, noIPLog)
+	}
+
+	return "", err
+}
+
+// parseCqlshDatasetID returns the id of the one row of cqlsh's datasets_by_name
+// output whose name is name or, if name is "", starts with
+// asyncProcessedPrefix. As in process_node_async_processed_list.sh, the name
+// is the first column & the id the second. The id is upper cased without
+// dashes, as gbr gives it
+func parseCqlshDatasetID(out string, name string) (string, error) {
+	var matches []string
+
+	want := name
+	if want == "" {
+		want = asyncProcessedPrefix
+	}
+
+	lines := strings.Split(out, "\n")
+
+	// Rows follow the separator under the header
+	start := slices.IndexFunc(lines, func(line string) bool {
+		return cqlshSeparator.MatchString(strings.TrimSpace(line))
+	})
+
+	for _, line := range lines[start+1:] {
+		if !strings.Contains(line, "|") {
+			continue
+		}
+
+		cols := strings.Split(line, "|")
+		rowName := strings.TrimSpace(cols[0])
+		id := strings.ToUpper(strings.ReplaceAll(strings.TrimSpace(cols[1]), "-", ""))
+
+		if rowName == "" || id == "" {
+			return "", fmt.Errorf(errWrapMsg, ErrDataset, fmt.Sprintf(errCqlshRow, strings.TrimSpace(line)))
+		}
+
+		if rowName == name || (name == "" && strings.HasPrefix(rowName, asyncProcessedPrefix)) {
+			matches = append(matches, id)
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		return "", fmt.Errorf(errWrapMsg, ErrDataset, fmt.Sprintf(errCqlshDataset, want, errCqlshNoDataset))
+	case 1:
+		return matches[0], nil
+	default:
+		return "", fmt.Errorf(errWrapMsg, ErrDataset,
+			fmt.Sprintf(errCqlshDataset, want, fmt.Sprintf(errCqlshManyDatasets, len(matches), matches)))
+	}
+}
+
+// setDatasetResolver sets how the dataset is looked up. cqlsh queries host or,
+// if host is "", each of e.sysIPs in turn, so -fan-ip also picks the host.
+// setSysIPs must have run first
+func (e *env) setDatasetResolver(kind string, cqlshPath string, host string, port int, timeout time.Duration) error {
+	logger := e.logger
+
+	switch kind {
+	case resolverGbr:
+		e.datasets = gbrDatasetResolver{e: e}
+
+		logger.Info(fmt.Sprintf(datasetResolverLog, kind))
+		logger.Warn(datasetResolverGbrLog)
+	case resolverCqlsh:
+		if cqlshPath == "" {
+			cqlshPath = defaultCqlshPath
+		}
+
+		hosts := []string{host}
+
+		if host == "" {
+			if len(e.sysIPs) == 0 {
+				return fmt.Errorf(errWrapMsg, ErrLookupIP, noIPLog)
+			}
+
+			hosts = make([]string, 0, len(e.sysIPs))
+
+			for _, ip := range e.sysIPs {
+				hosts = append(hosts, ip.String())
+			}
+		}
+
+		e.datasets = newCqlshDatasetResolver(cqlshPath, hosts, port, timeout, logger)
+
+		logger.Info(fmt.Sprintf(datasetResolverCqlshLog, cqlshPath, hosts, port, timeout))
+	default:
+		logger.Fatal(fmt.Sprintf(datasetResolverInvalidLog, kind, datasetResolvers))
+	}
+
+	return nil
+}
+
+// asyncProcessedDSID returns the id of the dataset named e.datasetName or, if
+// it is "", of the async processed dataset. Without a resolver set it uses
+// gbr pool ls -d
+func (e *env) asyncProcessedDSID() (string, error) {
+	if e.datasets == nil {
+		return getAsyncProcessedDSID(e)
+	}
+
+	return e.datasets.DatasetID(e.datasetName)
+}
+
+// setDataset sets e.datasetName to name & then e.datasetID to id or, if id
+// is "", to the id name resolves to
+func (e *env) setDataset(id string, name string) error {
+	logger := e.logger
+
+	e.datasetName = name
+
+	if name == "" {
+		logger.Info(datasetNameNoneLog)
+	} else {
+		logger.Info(fmt.Sprintf(datasetNameLog, name))
+	}
+
+	if id == "" && name != "" {
+		resolved, err := e.asyncProcessedDSID()
+		if err != nil {
+			return err
+		}
+
+		logger.Info(fmt.Sprintf(datasetNameResolvedLog, name, resolved))
+
+		id = resolved
+	}
+
+	return e.setDatasetID(id)
+}
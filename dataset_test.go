@@ -0,0 +1,289 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"testing"
+	"time"
+
+	"bou.ke/monkey"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	testDatasetName = "nmr"
+	testOtherIP     = "10.0.0.5"
+	// testCqlshOut is select * from storage.datasets_by_name as cqlsh prints it,
+	// with the ids dashed & lower cased
+	testCqlshOut = `
+ name                              | id                                   | pool
+-----------------------------------+--------------------------------------+------
+ ASYNCH PROCESSED FILES FOR node01 | 41545ab0-788a-11ec-bd07-00155d014e0d | p1
+                               nmr | 396862b0-7911-11ec-a624-00155d014e11 | p1
+
+(2 rows)
+`
+)
+
+// writeCqlshScript writes an executable cqlsh stand in that records its
+// arguments to args & prints out, returning its path
+func writeCqlshScript(t *testing.T, out string) (string, string) {
+	t.Helper()
+
+	dir := t.TempDir()
+	pth := path.Join(dir, "cqlsh")
+	args := path.Join(dir, "args")
+
+	err := os.WriteFile(path.Join(dir, "out"), []byte(out), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	script := fmt.Sprintf("#!/bin/sh\necho \"$@\" >> %q\ncat %q\n", args, path.Join(dir, "out"))
+
+	err = os.WriteFile(pth, []byte(script), 0755) //#nosec - test script must be executable
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return pth, args
+}
+
+func TestParseCqlshDatasetID(t *testing.T) {
+	t.Run("should find the async processed dataset", func(t *testing.T) {
+		got, err := parseCqlshDatasetID(testCqlshOut, "")
+		assert.NoError(t, err)
+		assertCorrectString(t, got, testDatasetID)
+	})
+
+	t.Run("should find a dataset by name", func(t *testing.T) {
+		got, err := parseCqlshDatasetID(testCqlshOut, testDatasetName)
+		assert.NoError(t, err)
+		assertCorrectString(t, got, testWrongDataset)
+	})
+
+	errorTests := []struct {
+		name    string
+		out     string
+		dataset string
+		want    string
+	}{
+		{"no matching dataset", testCqlshOut, "missing",
+			fmt.Sprintf(errCqlshDataset, "missing", errCqlshNoDataset)},
+		{"no rows", "\n(0 rows)\n", "",
+			fmt.Sprintf(errCqlshDataset, asyncProcessedPrefix, errCqlshNoDataset)},
+		{"many matching datasets", testCqlshOut + " ASYNCH PROCESSED FILES FOR node02 | " + testWrongDataset + "\n", "",
+			fmt.Sprintf(errCqlshDataset, asyncProcessedPrefix,
+				fmt.Sprintf(errCqlshManyDatasets, 2, []string{testDatasetID, testWrongDataset}))},
+		{"a row without an id", testCqlshOut + " other |\n", "", fmt.Sprintf(errCqlshRow, "other |")},
+	}
+
+	for _, tt := range errorTests {
+		t.Run("should error on "+tt.name, func(t *testing.T) {
+			_, err := parseCqlshDatasetID(tt.out, tt.dataset)
+			assert.ErrorIs(t, err, ErrDataset)
+			assert.ErrorContains(t, err, tt.want)
+		})
+	}
+}
+
+func TestCqlshDatasetResolver(t *testing.T) {
+	t.Run("should query host & port once per name", func(t *testing.T) {
+		pth, args := writeCqlshScript(t, testCqlshOut)
+
+		testLogger, hook = setupLogs()
+		r := newCqlshDatasetResolver(pth, []string{testIP}, defaultCqlshPort, time.Minute, testLogger)
+
+		for i := 0; i < 2; i++ {
+			got, err := r.DatasetID(testDatasetName)
+			assert.NoError(t, err)
+			assertCorrectString(t, got, testWrongDataset)
+		}
+
+		gotArgs, err := os.ReadFile(args) //#nosec - test file
+		assert.NoError(t, err)
+
+		wantArgs := fmt.Sprintf("%v %v -e %v\n", testIP, strconv.Itoa(defaultCqlshPort), cqlshDatasetsQuery)
+		assertCorrectString(t, string(gotArgs), wantArgs)
+
+		gotLogMsg := hook.LastEntry().Message
+		wantLogMsg := fmt.Sprintf(cqlshDatasetLog, testDatasetName, testWrongDataset)
+		assertCorrectString(t, gotLogMsg, wantLogMsg)
+	})
+
+	t.Run("should try the next host if one does not answer", func(t *testing.T) {
+		pth, args := writeCqlshScript(t, testCqlshOut)
+
+		// Only testIP answers
+		script := fmt.Sprintf("#!/bin/sh\necho \"$@\" >> %q\n[ \"$1\" = %q ] || exit 1\ncat %q\n",
+			args, testIP, path.Join(path.Dir(pth), "out"))
+
+		err := os.WriteFile(pth, []byte(script), 0755) //#nosec - test script must be executable
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		testLogger, hook = setupLogs()
+		r := newCqlshDatasetResolver(pth, []string{testOtherIP, testIP}, defaultCqlshPort, time.Minute,
+			testLogger)
+
+		got, err := r.DatasetID("")
+		assert.NoError(t, err)
+		assertCorrectString(t, got, testDatasetID)
+
+		gotArgs, err := os.ReadFile(args) //#nosec - test file
+		assert.NoError(t, err)
+
+		query := fmt.Sprintf("%v -e %v\n", strconv.Itoa(defaultCqlshPort), cqlshDatasetsQuery)
+		assertCorrectString(t, string(gotArgs), testOtherIP+" "+query+testIP+" "+query)
+
+		assert.Equal(t, logrus.WarnLevel, hook.Entries[0].Level)
+		assert.Contains(t, hook.Entries[0].Message, fmt.Sprintf(cqlshHostErrLog, testOtherIP, ""))
+	})
+
+	t.Run("should error if cqlsh fails", func(t *testing.T) {
+		testLogger, _ = setupLogs()
+		r := newCqlshDatasetResolver(path.Join(t.TempDir(), "cqlsh"), []string{testIP}, defaultCqlshPort,
+			time.Minute, testLogger)
+
+		_, err := r.DatasetID("")
+		assert.ErrorIs(t, err, ErrDataset)
+	})
+}
+
+func TestGbrDatasetResolver(t *testing.T) {
+	t.Run("should find the async processed dataset", func(t *testing.T) {
+		e := &env{gbr: newFakeGBRClient(testDatasetID)}
+		e.logger, _ = setupLogs()
+
+		got, err := gbrDatasetResolver{e: e}.DatasetID("")
+		assert.NoError(t, err)
+		assertCorrectString(t, got, testDatasetID)
+	})
+
+	t.Run("should error on a name", func(t *testing.T) {
+		e := &env{gbr: newFakeGBRClient(testDatasetID)}
+		e.logger, _ = setupLogs()
+
+		_, err := gbrDatasetResolver{e: e}.DatasetID(testDatasetName)
+		assert.ErrorIs(t, err, ErrDataset)
+		assert.ErrorContains(t, err, fmt.Sprintf(errDatasetByName, resolverGbr, resolverCqlsh))
+	})
+}
+
+func TestSetDatasetResolver(t *testing.T) {
+	fakeExit := func(int) {
+		panic(osPanicTrue)
+	}
+
+	t.Run("should set gbr", func(t *testing.T) {
+		e := new(env)
+		e.logger, hook = setupLogs()
+
+		assert.NoError(t, e.setDatasetResolver(resolverGbr, "", "", 0, 0))
+		assert.Equal(t, DatasetResolver(gbrDatasetResolver{e: e}), e.datasets)
+
+		gotLogMsg := hook.Entries[0].Message
+		wantLogMsg := fmt.Sprintf(datasetResolverLog, resolverGbr)
+		assertCorrectString(t, gotLogMsg, wantLogMsg)
+	})
+
+	t.Run("should warn that gbr may give the pool ID", func(t *testing.T) {
+		e := new(env)
+		e.logger, hook = setupLogs()
+
+		assert.NoError(t, e.setDatasetResolver(resolverGbr, "", "", 0, 0))
+
+		assert.Equal(t, logrus.WarnLevel, hook.LastEntry().Level)
+		assertCorrectString(t, hook.LastEntry().Message, datasetResolverGbrLog)
+	})
+
+	t.Run("should set cqlsh with the default path", func(t *testing.T) {
+		e := new(env)
+		e.logger, hook = setupLogs()
+
+		assert.NoError(t, e.setDatasetResolver(resolverCqlsh, "", testIP, defaultCqlshPort, time.Minute))
+		assert.Equal(t, newCqlshDatasetResolver(defaultCqlshPath, []string{testIP}, defaultCqlshPort, time.Minute,
+			e.logger), e.datasets)
+
+		gotLogMsg := hook.LastEntry().Message
+		wantLogMsg := fmt.Sprintf(datasetResolverCqlshLog, defaultCqlshPath, []string{testIP}, defaultCqlshPort,
+			time.Minute)
+		assertCorrectString(t, gotLogMsg, wantLogMsg)
+	})
+
+	t.Run("should query each system IP in turn without a host", func(t *testing.T) {
+		e := &env{sysIPs: []net.IP{net.ParseIP(testIP), net.ParseIP(testOtherIP)}}
+		e.logger, _ = setupLogs()
+
+		assert.NoError(t, e.setDatasetResolver(resolverCqlsh, "", "", defaultCqlshPort, time.Minute))
+		assert.Equal(t, newCqlshDatasetResolver(defaultCqlshPath, []string{testIP, testOtherIP}, defaultCqlshPort,
+			time.Minute, e.logger), e.datasets)
+	})
+
+	t.Run("should error without a host or system IPs", func(t *testing.T) {
+		e := new(env)
+		e.logger, _ = setupLogs()
+
+		err := e.setDatasetResolver(resolverCqlsh, "", "", defaultCqlshPort, time.Minute)
+		assert.ErrorIs(t, err, ErrLookupIP)
+		assert.Nil(t, e.datasets)
+	})
+
+	t.Run("should fatal on an unknown resolver", func(t *testing.T) {
+		patch := monkey.Patch(os.Exit, fakeExit)
+		defer patch.Unpatch()
+
+		e := new(env)
+		e.logger, hook = setupLogs()
+
+		panicFunc := func() { _ = e.setDatasetResolver(testName, "", "", 0, 0) }
+		assert.PanicsWithValue(t, osPanicTrue, panicFunc, osPanicFalse)
+
+		gotLogMsg := hook.LastEntry().Message
+		wantLogMsg := fmt.Sprintf(datasetResolverInvalidLog, testName, datasetResolvers)
+		assertCorrectString(t, gotLogMsg, wantLogMsg)
+	})
+}
+
+func TestSetDataset(t *testing.T) {
+	t.Run("should resolve the id from the name", func(t *testing.T) {
+		pth, _ := writeCqlshScript(t, testCqlshOut)
+
+		e := new(env)
+		e.logger, hook = setupLogs()
+		e.datasets = newCqlshDatasetResolver(pth, []string{testIP}, defaultCqlshPort, time.Minute, e.logger)
+
+		assert.NoError(t, e.setDataset("", testDatasetName))
+		assertCorrectString(t, e.datasetName, testDatasetName)
+		assertCorrectString(t, e.datasetID, testWrongDataset)
+
+		assertCorrectString(t, hook.Entries[0].Message, fmt.Sprintf(datasetNameLog, testDatasetName))
+		assertCorrectString(t, hook.LastEntry().Message, fmt.Sprintf(datasetLog, testWrongDataset))
+	})
+
+	t.Run("should keep a given id", func(t *testing.T) {
+		e := &env{gbr: newFakeGBRClient(testDatasetID)}
+		e.logger, hook = setupLogs()
+
+		assert.NoError(t, e.setDataset(testDatasetID, ""))
+		assert.Empty(t, e.datasetName)
+		assertCorrectString(t, e.datasetID, testDatasetID)
+
+		assertCorrectString(t, hook.Entries[0].Message, datasetNameNoneLog)
+	})
+
+	t.Run("should error if the name cannot be resolved", func(t *testing.T) {
+		e := &env{gbr: newFakeGBRClient(testDatasetID)}
+		e.logger, _ = setupLogs()
+		e.datasets = gbrDatasetResolver{e: e}
+
+		err := e.setDataset("", testDatasetName)
+		assert.ErrorIs(t, err, ErrDataset)
+		assert.Empty(t, e.datasetID)
+	})
+}
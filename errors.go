@@ -0,0 +1,146 @@
+package main
+
+import (
+	"errors"
+)
+
+const (
+	exitOK = 0
+	// exitAborted matches the exit code of logger.Fatal
+	exitAborted = 1
+	// exitRetried is a run where a transient error outlasted gbr's retries,
+	// so running again may pick the file up
+	exitRetried = 3
+	exitSkipped = 4
+
+	// errWrap wraps an error in the sentinel that classifies it
+	errWrap    = "%w: %w"
+	errWrapMsg = "%w: %v"
+
+	reasonParseErr       = "sourcefile line could not be parsed"
+	reasonMoveErr        = "stagingPath could not be moved"
+	reasonGbrUnavailable = "gbr was unavailable"
+	reasonGbrOutput      = "gbr output could not be parsed"
+	reasonHashMismatch   = "hash changed across the move"
+	reasonPostHashErr    = "newPath could not be hashed after the move"
+	reasonCollisionErr   = "newPath collision failed the file"
+	reasonStatErr        = "stagingPath could not be checked"
+	reasonAborted        = "run aborted before file was processed"
+)
+
+var (
+	// ErrParse is a sourcefile line that cannot be parsed
+	ErrParse = errors.New("parse error")
+	// ErrMove is a file that could not be moved
+	ErrMove = errors.New("move error")
+	// ErrGbrUnavailable is gbr failing to run or giving output we cannot use
+	ErrGbrUnavailable = errors.New("gbr unavailable")
+	// ErrGbrOutput is gbr output that is malformed, so would be again if
+	// retried
+	ErrGbrOutput = errors.New("gbr output error")
+	// ErrHashMismatch is a file whose hash changed across a move
+	ErrHashMismatch = errors.New("hash mismatch")
+	// ErrPostHash is a file that was moved but could not be hashed at its new
+	// path, so is unverified
+	ErrPostHash = errors.New("post-move hash error")
+	// ErrCollision is a file whose newPath exists & whose -collision policy
+	// fails it
+	ErrCollision = errors.New("collision error")
+	// ErrStat is a listed file whose stagingPath cannot be checked
+	ErrStat = errors.New("stat error")
+	// ErrSourceFile is a sourcefile or export that is not set or cannot be
+	// read
+	ErrSourceFile = errors.New("sourcefile error")
+	// ErrOutDir is an -outdir that is not set, would overwrite the export or
+	// cannot be written to
+	ErrOutDir = errors.New("outdir error")
+	// ErrDataset is a datasetID that is invalid or is not the async processed
+	// dataset
+	ErrDataset = errors.New("dataset error")
+	// ErrLookupIP is a node whose IPs cannot be found, or a -fan-ip that is
+	// not an IP
+	ErrLookupIP = errors.New("lookup ip error")
+)
+
+// errClass is how an error is handled. Classes are ordered from least to
+// most severe, so the worst class seen in a run is the largest
+type errClass int
+
+const (
+	// classNone is no error
+	classNone errClass = iota
+	// classRetry is a transient error that the gbr client has already
+	// retried, so the file fails but may pass if run again
+	classRetry
+	// classSkip is an error with one file, which is skipped
+	classSkip
+	// classAbort is an error that stops any further files being started
+	classAbort
+)
+
+func (c errClass) String() string {
+	switch c {
+	case classNone:
+		return "none"
+	case classRetry:
+		return "retry"
+	case classSkip:
+		return "skip"
+	default:
+		return "abort"
+	}
+}
+
+// exitCode is the exit code for a run whose worst class is c
+func (c errClass) exitCode() int {
+	switch c {
+	case classNone:
+		return exitOK
+	case classRetry:
+		return exitRetried
+	case classSkip:
+		return exitSkipped
+	default:
+		return exitAborted
+	}
+}
+
+// classify returns the class of err. Anything not known to be transient or
+// limited to one file aborts
+func classify(err error) errClass {
+	switch {
+	case err == nil:
+		return classNone
+	case errors.Is(err, ErrGbrUnavailable):
+		return classRetry
+	case errors.Is(err, ErrParse), errors.Is(err, ErrMove), errors.Is(err, ErrGbrOutput),
+		errors.Is(err, ErrPostHash), errors.Is(err, ErrCollision), errors.Is(err, ErrStat):
+		return classSkip
+	default:
+		return classAbort
+	}
+}
+
+// errReason returns the f.reason for a file that failed with err
+func errReason(err error) string {
+	switch {
+	case errors.Is(err, ErrParse):
+		return reasonParseErr
+	case errors.Is(err, ErrMove):
+		return reasonMoveErr
+	case errors.Is(err, ErrGbrUnavailable):
+		return reasonGbrUnavailable
+	case errors.Is(err, ErrGbrOutput):
+		return reasonGbrOutput
+	case errors.Is(err, ErrHashMismatch):
+		return reasonHashMismatch
+	case errors.Is(err, ErrPostHash):
+		return reasonPostHashErr
+	case errors.Is(err, ErrCollision):
+		return reasonCollisionErr
+	case errors.Is(err, ErrStat):
+		return reasonStatErr
+	default:
+		return err.Error()
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClassify(t *testing.T) {
+	classTests := []struct {
+		name string
+		err  error
+		want errClass
+	}{
+		{name: "nil", err: nil, want: classNone},
+		{name: "gbr unavailable", err: fmt.Errorf(errWrapMsg, ErrGbrUnavailable, testContent), want: classRetry},
+		{name: "parse", err: fmt.Errorf(errWrapMsg, ErrParse, testContent), want: classSkip},
+		{name: "move", err: fmt.Errorf(errWrapMsg, ErrMove, testContent), want: classSkip},
+		{name: "gbr output", err: fmt.Errorf(errWrapMsg, ErrGbrOutput, testContent), want: classSkip},
+		{name: "hash mismatch", err: fmt.Errorf(errWrapMsg, ErrHashMismatch, testContent), want: classAbort},
+		{name: "post-move hash", err: fmt.Errorf(errWrapMsg, ErrPostHash, testContent), want: classSkip},
+		{name: "collision", err: fmt.Errorf(errWrapMsg, ErrCollision, testContent), want: classSkip},
+		{name: "stat", err: fmt.Errorf(errWrapMsg, ErrStat, testContent), want: classSkip},
+		{name: "unknown", err: errors.New(testContent), want: classAbort},
+	}
+
+	for _, tt := range classTests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, classify(tt.err))
+		})
+	}
+}
+
+func TestErrClassExitCode(t *testing.T) {
+	assert.Equal(t, exitOK, classNone.exitCode())
+	assert.Equal(t, exitRetried, classRetry.exitCode())
+	assert.Equal(t, exitSkipped, classSkip.exitCode())
+	assert.Equal(t, exitAborted, classAbort.exitCode())
+
+	assert.Less(t, classNone, classRetry)
+	assert.Less(t, classRetry, classSkip)
+	assert.Less(t, classSkip, classAbort)
+}
+
+func TestErrReason(t *testing.T) {
+	assertCorrectString(t, errReason(fmt.Errorf(errWrapMsg, ErrMove, testContent)), reasonMoveErr)
+	assertCorrectString(t, errReason(fmt.Errorf(errWrapMsg, ErrGbrUnavailable, testContent)), reasonGbrUnavailable)
+	assertCorrectString(t, errReason(fmt.Errorf(errWrapMsg, ErrGbrOutput, testContent)), reasonGbrOutput)
+	assertCorrectString(t, errReason(fmt.Errorf(errWrapMsg, ErrPostHash, testContent)), reasonPostHashErr)
+	assertCorrectString(t, errReason(fmt.Errorf(errWrapMsg, ErrCollision, testContent)), reasonCollisionErr)
+	assertCorrectString(t, errReason(fmt.Errorf(errWrapMsg, ErrStat, testContent)), reasonStatErr)
+	assertCorrectString(t, errReason(errors.New(testContent)), testContent)
+}
@@ -16,8 +16,32 @@ type file struct {
 	fanIP          net.IP
 	stagingPath    string
 	oldStagingPath string
-	hash           [32]byte
-	oldHash        [32]byte
+	hash           []byte
+	oldHash        []byte
 	fileInfo       fs.FileInfo
 	success        bool
+	reason         string
+	moveKind       moveKind
+	collision      collisionResult
+	planned        *planEntry
+	resumed        string
+	leftover       string
+	legalHold      legalHold
+	err            error
+	timings        timings
+}
+
+// timings records how long each stage of processing f took
+type timings struct {
+	verify   time.Duration
+	preHash  time.Duration
+	move     time.Duration
+	postHash time.Duration
+}
+
+// stopwatch returns a func that sets *d to the time since stopwatch was called
+func stopwatch(d *time.Duration) func() {
+	start := time.Now()
+
+	return func() { *d = time.Since(start) }
 }
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	gbrLog        = "gbr: %v with a timeout of %v"
+	gbrNoTimeout  = "gbr: %v with no timeout"
+	gbrTimeoutErr = "%v timed out after %v"
+	gbrCacheLog   = "gbr: caching pool ls -d for %v"
+	gbrNoCacheLog = "gbr: not caching pool ls -d"
+	gbrLimitsLog  = "gbr: at most %v file lookups at once & %v a second; retrying %v times from %v"
+	gbrNoRateLog  = "gbr: at most %v file lookups at once; retrying %v times from %v"
+	gbrCachedLog  = "gbr: pool ls -d cached %v ago"
+	gbrRetryLog   = "gbr: %v failed: %v; retrying in %v (attempt %v of %v)"
+
+	gbrPoolQuery = "pool ls -d"
+	gbrFileQuery = "file ls -i %v -d"
+
+	defaultGbrPath = "/usr/bin/gbr"
+)
+
+// GBRClient queries gbr. Each method returns gbr's output as is, so callers
+// parse it the same whichever client they are given
+type GBRClient interface {
+	// PoolList returns the output of gbr pool ls -d
+	PoolList() (string, error)
+	// FileByID returns the output of gbr file ls -i id -d
+	FileByID(id string) (string, error)
+}
+
+// execGBRClient runs the gbr binary at path, killing it after timeout unless
+// timeout is 0
+type execGBRClient struct {
+	path    string
+	timeout time.Duration
+}
+
+// newExecGBRClient returns a GBRClient that runs the gbr binary at path
+func newExecGBRClient(path string, timeout time.Duration) *execGBRClient {
+	return &execGBRClient{path: path, timeout: timeout}
+}
+
+func (c *execGBRClient) PoolList() (string, error) {
+	return c.run("pool", "ls", "-d")
+}
+
+func (c *execGBRClient) FileByID(id string) (string, error) {
+	return c.run("file", "ls", "-i", id, "-d")
+}
+
+// run returns the combined output of gbr with args
+func (c *execGBRClient) run(args ...string) (string, error) {
+	return runTimeout(c.path, c.timeout, args...)
+}
+
+// runTimeout returns the combined output of the binary at pth with args,
+// killing it after timeout unless timeout is 0. If it fails the error
+// includes its output, as gbr & cqlsh write their errors to it
+func runTimeout(pth string, timeout time.Duration, args ...string) (string, error) {
+	ctx := context.Background()
+
+	if timeout > 0 {
+		var cancel context.CancelFunc
+
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	cmd := exec.CommandContext(ctx, pth, args...) //#nosec - path is set by the operator
+
+	out, err := cmd.CombinedOutput()
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return "", fmt.Errorf(gbrTimeoutErr, cmd, timeout)
+	}
+
+	if err != nil {
+		return "", fmt.Errorf(wrapOsLog, err, string(out))
+	}
+
+	return string(out), nil
+}
+
+// setGBR sets e.gbr to a client that runs the gbr binary at pth
+func (e *env) setGBR(pth string, timeout time.Duration) {
+	logger := e.logger
+
+	if pth == "" {
+		pth = defaultGbrPath
+	}
+
+	if timeout < 0 {
+		timeout = 0
+	}
+
+	e.gbr = newExecGBRClient(pth, timeout)
+
+	if timeout == 0 {
+		logger.Info(fmt.Sprintf(gbrNoTimeout, pth))
+		return
+	}
+
+	logger.Info(fmt.Sprintf(gbrLog, pth, timeout))
+}
+
+// cachingGBRClient wraps a GBRClient so that a run does not hammer gbr. The
+// pool is memoized for ttl, unless ttl is 0, as it is looked up more than once
+// a run. File lookups run at most concurrency at once & rate a second, where
+// a rate of 0 is unlimited. A failed query is retried up to retries times,
+// doubling backoff after each
+type cachingGBRClient struct {
+	client  GBRClient
+	logger  *logrus.Logger
+	ttl     time.Duration
+	slots   chan struct{}
+	limiter *rateLimiter
+	retries int
+	backoff time.Duration
+	now     func() time.Time
+
+	mu     sync.Mutex
+	pool   string
+	poolAt time.Time
+}
+
+func newCachingGBRClient(
+	client GBRClient,
+	ttl time.Duration,
+	concurrency int,
+	rate int64,
+	retries int,
+	backoff time.Duration,
+	logger *logrus.Logger) *cachingGBRClient {
+	return &cachingGBRClient{
+		client:  client,
+		logger:  logger,
+		ttl:     ttl,
+		slots:   make(chan struct{}, max(concurrency, 1)),
+		limiter: newRateLimiter(rate),
+		retries: max(retries, 0),
+		backoff: backoff,
+		now:     time.Now,
+	}
+}
+
+// PoolList returns the cached pool if it is younger than c.ttl. Callers wait
+// on one another, so that only one of them runs the query
+func (c *cachingGBRClient) PoolList() (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if age := c.now().Sub(c.poolAt); c.ttl > 0 && !c.poolAt.IsZero() && age < c.ttl {
+		c.logger.Debug(fmt.Sprintf(gbrCachedLog, age.Round(time.Millisecond)))
+		return c.pool, nil
+	}
+
+	out, err := c.retry(gbrPoolQuery, c.client.PoolList)
+	if err != nil {
+		return "", err
+	}
+
+	c.pool = out
+	c.poolAt = c.now()
+
+	return out, nil
+}
+
+// FileByID is not cached, as each file is looked up once a run, bar retries
+// after an error
+func (c *cachingGBRClient) FileByID(id string) (string, error) {
+	return c.retry(fmt.Sprintf(gbrFileQuery, id), func() (string, error) {
+		c.slots <- struct{}{}
+		defer func() { <-c.slots }()
+
+		c.limiter.wait(1)
+
+		return c.client.FileByID(id)
+	})
+}
+
+// retry runs query until it succeeds or has been retried c.retries times
+func (c *cachingGBRClient) retry(name string, query func() (string, error)) (string, error) {
+	delay := c.backoff
+
+	for attempt := 1; ; attempt++ {
+		out, err := query()
+		if err == nil || attempt > c.retries {
+			return out, err
+		}
+
+		c.logger.Warn(fmt.Sprintf(gbrRetryLog, name, err, delay, attempt, c.retries))
+		time.Sleep(delay)
+
+		delay *= 2
+	}
+}
+
+// setGBRCache wraps e.gbr in a cachingGBRClient. It must be called after
+// setGBR
+func (e *env) setGBRCache(ttl time.Duration, concurrency int, rate int64, retries int, backoff time.Duration) {
+	logger := e.logger
+
+	if ttl < 0 {
+		ttl = 0
+	}
+
+	c := newCachingGBRClient(e.gbr, ttl, concurrency, rate, retries, backoff, logger)
+	e.gbr = c
+
+	if ttl == 0 {
+		logger.Info(gbrNoCacheLog)
+	} else {
+		logger.Info(fmt.Sprintf(gbrCacheLog, ttl))
+	}
+
+	if rate <= 0 {
+		logger.Info(fmt.Sprintf(gbrNoRateLog, cap(c.slots), c.retries, c.backoff))
+		return
+	}
+
+	logger.Info(fmt.Sprintf(gbrLimitsLog, cap(c.slots), rate, c.retries, c.backoff))
+}
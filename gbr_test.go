@@ -0,0 +1,270 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// writeGBRScript writes an executable gbr stand in that runs body & returns
+// its path
+func writeGBRScript(t *testing.T, body string) string {
+	t.Helper()
+
+	pth := path.Join(t.TempDir(), "gbr")
+
+	err := os.WriteFile(pth, []byte("#!/bin/sh\n"+body+"\n"), 0755) //#nosec - test script must be executable
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return pth
+}
+
+func TestExecGBRClient(t *testing.T) {
+	t.Run("should return gbr pool ls -d output", func(t *testing.T) {
+		pth := writeGBRScript(t, `echo "$@"`)
+		c := newExecGBRClient(pth, time.Minute)
+
+		out, err := c.PoolList()
+		assert.NoError(t, err)
+		assertCorrectString(t, out, "pool ls -d\n")
+	})
+
+	t.Run("should return gbr file ls -i id -d output", func(t *testing.T) {
+		pth := writeGBRScript(t, `echo "$@"`)
+		c := newExecGBRClient(pth, 0)
+
+		out, err := c.FileByID(testFileID)
+		assert.NoError(t, err)
+		assertCorrectString(t, out, fmt.Sprintf("file ls -i %v -d\n", testFileID))
+	})
+
+	t.Run("should include output in the error if gbr fails", func(t *testing.T) {
+		pth := writeGBRScript(t, "echo gbr is down >&2; exit 2")
+		c := newExecGBRClient(pth, time.Minute)
+
+		_, err := c.PoolList()
+		assert.ErrorContains(t, err, "exit status 2")
+		assert.ErrorContains(t, err, "gbr is down")
+	})
+
+	t.Run("should error if gbr times out", func(t *testing.T) {
+		pth := writeGBRScript(t, "exec sleep 5")
+		c := newExecGBRClient(pth, 50*time.Millisecond)
+
+		_, err := c.FileByID(testFileID)
+		assert.ErrorContains(t, err, "timed out after 50ms")
+	})
+
+	t.Run("should error if gbr does not exist", func(t *testing.T) {
+		c := newExecGBRClient(path.Join(t.TempDir(), "gbr"), time.Minute)
+
+		_, err := c.PoolList()
+		assert.Error(t, err)
+	})
+}
+
+func TestSetGBR(t *testing.T) {
+	t.Run("should default the path & log the timeout", func(t *testing.T) {
+		e := new(env)
+		e.logger, hook = setupLogs()
+
+		e.setGBR("", time.Minute)
+		assert.Equal(t, newExecGBRClient(defaultGbrPath, time.Minute), e.gbr)
+
+		gotLogMsg := hook.LastEntry().Message
+		wantLogMsg := fmt.Sprintf(gbrLog, defaultGbrPath, time.Minute)
+		assertCorrectString(t, gotLogMsg, wantLogMsg)
+	})
+
+	t.Run("should treat a negative timeout as no timeout", func(t *testing.T) {
+		e := new(env)
+		e.logger, hook = setupLogs()
+
+		e.setGBR(testPath, -time.Second)
+		assert.Equal(t, newExecGBRClient(testPath, 0), e.gbr)
+
+		gotLogMsg := hook.LastEntry().Message
+		wantLogMsg := fmt.Sprintf(gbrNoTimeout, testPath)
+		assertCorrectString(t, gotLogMsg, wantLogMsg)
+	})
+}
+
+// slowGBRClient blocks each query for delay, recording the most run at once
+type slowGBRClient struct {
+	*fakeGBRClient
+	delay time.Duration
+
+	mu      sync.Mutex
+	running int
+	most    int
+}
+
+func (c *slowGBRClient) FileByID(id string) (string, error) {
+	c.mu.Lock()
+	c.running++
+	c.most = max(c.most, c.running)
+	c.mu.Unlock()
+
+	time.Sleep(c.delay)
+
+	c.mu.Lock()
+	c.running--
+	c.mu.Unlock()
+
+	return c.fakeGBRClient.FileByID(id)
+}
+
+func TestCachingGBRClient(t *testing.T) {
+	t.Run("should look the pool up once within the ttl", func(t *testing.T) {
+		gbr := newFakeGBRClient(testDatasetID)
+		testLogger, _ = setupLogs()
+		c := newCachingGBRClient(gbr, time.Minute, 1, 0, 0, 0, testLogger)
+
+		now := time.Now()
+		c.now = func() time.Time { return now }
+
+		for i := 0; i < 3; i++ {
+			out, err := c.PoolList()
+			assert.NoError(t, err)
+			assertCorrectString(t, out, fmt.Sprintf(fakeGbrPoolOut, testDatasetID))
+		}
+
+		assert.Equal(t, 1, gbr.getCalls())
+
+		now = now.Add(time.Minute)
+
+		_, err := c.PoolList()
+		assert.NoError(t, err)
+		assert.Equal(t, 2, gbr.getCalls())
+	})
+
+	t.Run("should look the pool up every time without a ttl", func(t *testing.T) {
+		gbr := newFakeGBRClient(testDatasetID)
+		testLogger, _ = setupLogs()
+		c := newCachingGBRClient(gbr, 0, 1, 0, 0, 0, testLogger)
+
+		_, _ = c.PoolList()
+		_, _ = c.PoolList()
+
+		assert.Equal(t, 2, gbr.getCalls())
+	})
+
+	t.Run("should not cache a failed pool lookup", func(t *testing.T) {
+		gbr := newFakeGBRClient(testDatasetID)
+		gbr.fails = 1
+		testLogger, _ = setupLogs()
+		c := newCachingGBRClient(gbr, time.Minute, 1, 0, 0, 0, testLogger)
+
+		_, err := c.PoolList()
+		assert.ErrorIs(t, err, errFakeGBR)
+
+		_, err = c.PoolList()
+		assert.NoError(t, err)
+		assert.Equal(t, 2, gbr.getCalls())
+	})
+
+	t.Run("should retry a failed lookup with backoff", func(t *testing.T) {
+		gbr := newFakeGBRClient(testDatasetID)
+		gbr.addFile(file{id: testFileID, smbName: testSmbName, datasetID: testDatasetID})
+		gbr.fails = 2
+
+		testLogger, hook = setupLogs()
+		c := newCachingGBRClient(gbr, 0, 1, 0, 2, time.Millisecond, testLogger)
+
+		out, err := c.FileByID(testFileID)
+		assert.NoError(t, err)
+		assert.Contains(t, out, testSmbName)
+		assert.Equal(t, 3, gbr.getCalls())
+
+		query := fmt.Sprintf(gbrFileQuery, testFileID)
+		assertCorrectString(t, hook.Entries[0].Message,
+			fmt.Sprintf(gbrRetryLog, query, errFakeGBR, time.Millisecond, 1, 2))
+		assertCorrectString(t, hook.Entries[1].Message,
+			fmt.Sprintf(gbrRetryLog, query, errFakeGBR, 2*time.Millisecond, 2, 2))
+	})
+
+	t.Run("should return the error once retries run out", func(t *testing.T) {
+		gbr := newFakeGBRClient(testDatasetID)
+		gbr.fails = 3
+
+		testLogger, _ = setupLogs()
+		c := newCachingGBRClient(gbr, 0, 1, 0, 2, time.Millisecond, testLogger)
+
+		_, err := c.FileByID(testFileID)
+		assert.ErrorIs(t, err, errFakeGBR)
+		assert.Equal(t, 3, gbr.getCalls())
+	})
+
+	t.Run("should bound concurrent file lookups", func(t *testing.T) {
+		slow := &slowGBRClient{fakeGBRClient: newFakeGBRClient(testDatasetID), delay: 20 * time.Millisecond}
+		testLogger, _ = setupLogs()
+		c := newCachingGBRClient(slow, 0, 2, 0, 0, 0, testLogger)
+
+		var wg sync.WaitGroup
+
+		for i := 0; i < 6; i++ {
+			wg.Add(1)
+
+			go func() {
+				defer wg.Done()
+
+				_, _ = c.FileByID(testFileID)
+			}()
+		}
+
+		wg.Wait()
+
+		assert.Equal(t, 2, slow.most)
+		assert.Equal(t, 6, slow.getCalls())
+	})
+
+	t.Run("should rate limit file lookups", func(t *testing.T) {
+		gbr := newFakeGBRClient(testDatasetID)
+		testLogger, _ = setupLogs()
+		c := newCachingGBRClient(gbr, 0, 4, 50, 0, 0, testLogger)
+
+		start := time.Now()
+
+		for i := 0; i < 4; i++ {
+			_, _ = c.FileByID(testFileID)
+		}
+
+		// 4 lookups at 50 a second are spread over at least 3 gaps of 20ms
+		assert.GreaterOrEqual(t, time.Since(start), 60*time.Millisecond)
+	})
+}
+
+func TestSetGBRCache(t *testing.T) {
+	t.Run("should wrap e.gbr & log the limits", func(t *testing.T) {
+		gbr := newFakeGBRClient(testDatasetID)
+
+		e := &env{gbr: gbr}
+		e.logger, hook = setupLogs()
+
+		e.setGBRCache(time.Minute, 4, 10, 2, time.Second)
+
+		c, ok := e.gbr.(*cachingGBRClient)
+		assert.True(t, ok)
+		assert.Equal(t, GBRClient(gbr), c.client)
+
+		assertCorrectString(t, hook.Entries[0].Message, fmt.Sprintf(gbrCacheLog, time.Minute))
+		assertCorrectString(t, hook.LastEntry().Message, fmt.Sprintf(gbrLimitsLog, 4, 10, 2, time.Second))
+	})
+
+	t.Run("should log no cache & no rate", func(t *testing.T) {
+		e := &env{gbr: newFakeGBRClient(testDatasetID)}
+		e.logger, hook = setupLogs()
+
+		e.setGBRCache(-time.Minute, 0, 0, -1, time.Second)
+
+		assertCorrectString(t, hook.Entries[0].Message, gbrNoCacheLog)
+		assertCorrectString(t, hook.LastEntry().Message, fmt.Sprintf(gbrNoRateLog, 1, 0, time.Second))
+	})
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	errGbrFileLine      = "%w: line %v: %v"
+	errGbrFileHeader    = "%q is not a file header"
+	errGbrFileField     = "%q is not a field"
+	errGbrFileDupField  = "%v is repeated"
+	errGbrFileTwoFiles  = "output has more than one file"
+	errGbrFileNoHeader  = "%w: output has no file header"
+	errGbrFileMissing   = "%w: output has no %v"
+	errGbrFileVersion   = "version %q is not a number"
+	errGbrFileLegalHold = "legal hold %q is not Key=Value pairs"
+	errGbrFileEnabled   = "legal hold Enabled=%q is not true or false"
+
+	gbrNull = "null"
+
+	gbrFieldVersion          = "version"
+	gbrFieldType             = "type"
+	gbrFieldParentFolderID   = "parent folder id"
+	gbrFieldParentFolderName = "parent folder name"
+	gbrFieldParentID         = "parent id"
+	gbrFieldOriginalName     = "original file name"
+	gbrFieldFileURI          = "file URI"
+	gbrFieldFanURI           = "fan URI"
+	gbrFieldPoolID           = "pool id"
+	gbrFieldLegalHold        = "legal hold"
+	gbrFieldPolicies         = "policies"
+	gbrFieldFileHash         = "file hash"
+)
+
+var (
+	// gbrFileHeader matches the first line of a file, e.g.
+	// 1 - 05043fe1-00000006-... (file id: D5B58980A3E311EBBA0AB026285E5610)
+	gbrFileHeader = regexp.MustCompile(`^\d+ - (\S+) \(file id: ([0-9A-Fa-f]+)\)$`)
+	// gbrLegalHoldKey matches each Key= in a legal hold value
+	gbrLegalHoldKey = regexp.MustCompile(`(?:^|\s)([A-Za-z]+)=`)
+)
+
+// gbrFile is a file as described by gbr file ls -i id -d. Fields gbr gives as
+// null are empty
+type gbrFile struct {
+	name             string
+	id               string
+	version          int
+	fileType         string
+	parentFolderID   string
+	parentFolderName string
+	// parentID is the dataset the file is in
+	parentID     string
+	originalName string
+	fileURI      string
+	fanURI       string
+	poolID       string
+	fileHash     string
+	legalHold    legalHold
+	policies     []string
+}
+
+// legalHold is a gbrFile's legal hold. start & release are as gbr gives them,
+// as gbr gives a date in year 1 when there is no hold
+type legalHold struct {
+	enabled  bool
+	ownerID  string
+	matterID string
+	start    string
+	release  string
+}
+
+// parseGbrFile parses the output of gbr file ls -i id -d. It errors with
+// ErrGbrOutput if out is not one file with a name, id & parent id. Fields it
+// does not know are ignored
+func parseGbrFile(out string) (*gbrFile, error) {
+	var (
+		rec      *gbrFile
+		seen     = map[string]bool{}
+		indent   int
+		policies bool
+	)
+
+	scanner := bufio.NewScanner(strings.NewReader(out))
+
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		text := strings.TrimSpace(line)
+
+		if text == "" {
+			continue
+		}
+
+		lineErr := func(msg string) error {
+			return fmt.Errorf(errGbrFileLine, ErrGbrOutput, n, msg)
+		}
+
+		if rec == nil {
+			m := gbrFileHeader.FindStringSubmatch(text)
+			if m == nil {
+				return nil, lineErr(fmt.Sprintf(errGbrFileHeader, text))
+			}
+
+			rec = &gbrFile{name: m[1], id: m[2]}
+
+			continue
+		}
+
+		if gbrFileHeader.MatchString(text) {
+			return nil, lineErr(errGbrFileTwoFiles)
+		}
+
+		lineIndent := len(line) - len(strings.TrimLeft(line, " \t"))
+
+		// Policies are indented under the policies field
+		if policies && lineIndent > indent {
+			rec.policies = append(rec.policies, text)
+			continue
+		}
+
+		policies = false
+
+		key, value, ok := strings.Cut(text, ":")
+		if !ok {
+			return nil, lineErr(fmt.Sprintf(errGbrFileField, text))
+		}
+
+		key = strings.TrimSpace(key)
+		value = strings.TrimSpace(value)
+
+		if seen[key] {
+			return nil, lineErr(fmt.Sprintf(errGbrFileDupField, key))
+		}
+
+		seen[key] = true
+
+		if value == gbrNull {
+			value = ""
+		}
+
+		err := rec.set(key, value)
+		if err != nil {
+			return nil, lineErr(err.Error())
+		}
+
+		if key == gbrFieldPolicies {
+			policies = true
+			indent = lineIndent
+		}
+	}
+
+	err := scanner.Err()
+	if err != nil {
+		return nil, fmt.Errorf(errWrap, ErrGbrOutput, err)
+	}
+
+	if rec == nil {
+		return nil, fmt.Errorf(errGbrFileNoHeader, ErrGbrOutput)
+	}
+
+	if rec.parentID == "" {
+		return nil, fmt.Errorf(errGbrFileMissing, ErrGbrOutput, gbrFieldParentID)
+	}
+
+	return rec, nil
+}
+
+// set sets the field named key to value
+func (rec *gbrFile) set(key string, value string) error {
+	switch key {
+	case gbrFieldVersion:
+		v, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf(errGbrFileVersion, value)
+		}
+
+		rec.version = v
+	case gbrFieldType:
+		rec.fileType = value
+	case gbrFieldParentFolderID:
+		rec.parentFolderID = value
+	case gbrFieldParentFolderName:
+		rec.parentFolderName = value
+	case gbrFieldParentID:
+		rec.parentID = value
+	case gbrFieldOriginalName:
+		rec.originalName = value
+	case gbrFieldFileURI:
+		rec.fileURI = value
+	case gbrFieldFanURI:
+		rec.fanURI = value
+	case gbrFieldPoolID:
+		rec.poolID = value
+	case gbrFieldFileHash:
+		rec.fileHash = value
+	case gbrFieldLegalHold:
+		hold, err := parseLegalHold(value)
+		if err != nil {
+			return err
+		}
+
+		rec.legalHold = hold
+	case gbrFieldPolicies:
+		if value != "" {
+			rec.policies = append(rec.policies, value)
+		}
+	}
+
+	return nil
+}
+
+// parseLegalHold parses a legal hold value, e.g.
+// Enabled=false OwnerID=null MatterID=null Start=Sat Jan 01 05:00:00 EST 1 ...
+func parseLegalHold(value string) (legalHold, error) {
+	var hold legalHold
+
+	if value == "" {
+		return hold, nil
+	}
+
+	keys := gbrLegalHoldKey.FindAllStringSubmatchIndex(value, -1)
+	if keys == nil || strings.TrimSpace(value[:keys[0][0]]) != "" {
+		return hold, fmt.Errorf(errGbrFileLegalHold, value)
+	}
+
+	for i, k := range keys {
+		end := len(value)
+		if i+1 < len(keys) {
+			end = keys[i+1][0]
+		}
+
+		v := strings.TrimSpace(value[k[1]:end])
+		if v == gbrNull {
+			v = ""
+		}
+
+		switch value[k[2]:k[3]] {
+		case "Enabled":
+			enabled, err := strconv.ParseBool(v)
+			if err != nil {
+				return hold, fmt.Errorf(errGbrFileEnabled, v)
+			}
+
+			hold.enabled = enabled
+		case "OwnerID":
+			hold.ownerID = v
+		case "MatterID":
+			hold.matterID = v
+		case "Start":
+			hold.start = v
+		case "Release":
+			hold.release = v
+		}
+	}
+
+	return hold, nil
+}
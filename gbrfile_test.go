@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	testGbrFileHeader = "1 - " + testSmbName + " (file id: " + testFileID + ")\n"
+	testGbrParentID   = "    parent id:          " + testDatasetID + "\n"
+)
+
+func TestParseGbrFile(t *testing.T) {
+	t.Run("should parse every field", func(t *testing.T) {
+		got, err := parseGbrFile(testGbrFileIDDetailOut)
+		assert.NoError(t, err)
+
+		want := &gbrFile{
+			name:             testSmbName,
+			id:               testFileID,
+			version:          0,
+			fileType:         "file",
+			parentFolderID:   "3E4FF671B44E11ED86FF00155D014E0D",
+			parentFolderName: "6132",
+			parentID:         testDatasetID,
+			fanURI: "ftp://user@192.168.101.210:2121/download/2023_02/1eeb7769-fdb1-4313-8d76-ec719ad7a44c/" +
+				"mnt/nas01/" + testSmbName,
+			poolID: testDatasetID,
+			legalHold: legalHold{
+				start:   "Sat Jan 01 05:00:00 EST 1",
+				release: "Sat Jan 01 05:00:00 EST 1",
+			},
+			policies: []string{
+				"RetentionDisposition(null, enabled='true')(start='Mon Feb 27 19:08:25 EST 2023', " +
+					"end='Sat Jan 27 19:08:25 EST 2029', neverDispose='true')",
+			},
+		}
+		assert.Equal(t, want, got)
+	})
+
+	t.Run("should parse the fake gbr client's output", func(t *testing.T) {
+		gbr := newFakeGBRClient(testDatasetID)
+		gbr.addFile(file{id: testFileID, smbName: testSmbName, datasetID: testWrongDataset})
+
+		out, _ := gbr.FileByID(testFileID)
+
+		got, err := parseGbrFile(out)
+		assert.NoError(t, err)
+		assertCorrectString(t, got.name, testSmbName)
+		assertCorrectString(t, got.parentID, testWrongDataset)
+	})
+
+	t.Run("should ignore fields it does not know", func(t *testing.T) {
+		got, err := parseGbrFile(testGbrFileHeader + testGbrParentID + "    new field:     value\n")
+		assert.NoError(t, err)
+		assertCorrectString(t, got.parentID, testDatasetID)
+	})
+
+	errorTests := []struct {
+		name string
+		out  string
+		want string
+	}{
+		{"no output", "\n", "output has no file header"},
+		{"a java stack trace", testGbrFileIDErrOut, "line 1: \"java.lang.NumberFormatException"},
+		{"no parent id", testGbrFileHeader + "    version: 0\n", "output has no parent id"},
+		{"a line that is not a field", testGbrFileHeader + "    garbage\n", fmt.Sprintf(errGbrFileField, "garbage")},
+		{"a repeated field", testGbrFileHeader + testGbrParentID + testGbrParentID,
+			"line 3: " + fmt.Sprintf(errGbrFileDupField, "parent id")},
+		{"a second file", testGbrFileHeader + testGbrParentID + strings.Replace(testGbrFileHeader, "1 - ", "2 - ", 1),
+			errGbrFileTwoFiles},
+		{"a bad version", testGbrFileHeader + "    version: one\n", fmt.Sprintf(errGbrFileVersion, "one")},
+		{"a bad legal hold", testGbrFileHeader + "    legal hold: on\n", fmt.Sprintf(errGbrFileLegalHold, "on")},
+		{"a bad legal hold enabled", testGbrFileHeader + "    legal hold: Enabled=maybe\n",
+			fmt.Sprintf(errGbrFileEnabled, "maybe")},
+	}
+
+	for _, tt := range errorTests {
+		t.Run("should error on "+tt.name, func(t *testing.T) {
+			_, err := parseGbrFile(tt.out)
+			assert.ErrorIs(t, err, ErrGbrOutput)
+			assert.ErrorContains(t, err, tt.want)
+		})
+	}
+}
+
+func TestParseLegalHold(t *testing.T) {
+	t.Run("should parse an enabled hold", func(t *testing.T) {
+		got, err := parseLegalHold("Enabled=true OwnerID=jdoe MatterID=M-42 " +
+			"Start=Mon Feb 27 19:08:25 EST 2023 Release=null")
+		assert.NoError(t, err)
+
+		want := legalHold{
+			enabled:  true,
+			ownerID:  "jdoe",
+			matterID: "M-42",
+			start:    "Mon Feb 27 19:08:25 EST 2023",
+		}
+		assert.Equal(t, want, got)
+	})
+
+	t.Run("should parse no hold", func(t *testing.T) {
+		got, err := parseLegalHold("")
+		assert.NoError(t, err)
+		assert.Equal(t, legalHold{}, got)
+	})
+}
@@ -1,33 +1,51 @@
 package main
 
 import (
+	"crypto/md5" //#nosec G501 - md5 is offered as a quick integrity check, not for security
 	"crypto/sha256"
+	"crypto/sha512"
 	"fmt"
-
-	"github.com/spf13/afero"
+	"hash"
+	"hash/crc32"
+	"io"
+	"sort"
+	"sync"
+	"time"
 )
 
 const (
-	fHashLog = "%v (file.id:%v) %v-move file.hash: %x"
+	fHashLog = "%v (file.id:%v) %v-move file.hash(%v): %x"
+
+	// hashBufferSize bounds the memory used to hash a file, whatever its size
+	hashBufferSize = 1 << 20
+
+	hashSHA256 = "sha256"
+	hashSHA512 = "sha512"
+	hashMD5    = "md5"
+	hashCRC32C = "crc32c"
 )
 
-func (f *file) hasher() error {
+// hashAlgos maps the -hash names to their hash constructors
+var hashAlgos = map[string]func() hash.Hash{
+	hashSHA256: sha256.New,
+	hashSHA512: sha512.New,
+	hashMD5:    md5.New,
+	hashCRC32C: func() hash.Hash { return crc32.New(crc32.MakeTable(crc32.Castagnoli)) },
+}
+
+func (f *file) hasher(e *env) error {
 	var prePost string
 
-	e = ap.getEnv()
-	afs = e.afs
 	logger := e.logger
-	// fs.ReadFile handles close?
-	content, err := afero.ReadFile(afs, f.stagingPath)
+
+	sum, err := hashFile(f.stagingPath, e)
 	if err != nil {
 		// NB No need for fatal as if hash does not match, it will fail later
 		logger.Error(err)
 		return err
 	}
 
-	sha := sha256.Sum256(content)
-
-	f.hash = sha
+	f.hash = sum
 
 	if f.oldStagingPath == "" {
 		prePost = "pre"
@@ -35,7 +53,96 @@ func (f *file) hasher() error {
 		prePost = "post"
 	}
 
-	logger.Info(fmt.Sprintf(fHashLog, f.smbName, f.id, prePost, f.hash))
+	logger.Info(fmt.Sprintf(fHashLog, f.smbName, f.id, prePost, e.hashName(), f.hash))
 
 	return nil
 }
+
+// hashFile streams name from e.afs through the -hash algorithm, reading no
+// faster than e.readLimiter allows
+func hashFile(name string, e *env) ([]byte, error) {
+	content, err := e.afs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer content.Close()
+
+	h := hashAlgos[e.hashName()]()
+	buf := make([]byte, hashBufferSize)
+
+	_, err = io.CopyBuffer(h, &limitedReader{r: content, limiter: e.readLimiter}, buf)
+	if err != nil {
+		return nil, err
+	}
+
+	return h.Sum(nil), nil
+}
+
+// hashName returns the hash algorithm set in e, defaulting to sha256
+func (e *env) hashName() string {
+	if e.hashAlgo == "" {
+		return hashSHA256
+	}
+
+	return e.hashAlgo
+}
+
+// hashNames returns the supported hash algorithms in a stable order
+func hashNames() []string {
+	names := make([]string, 0, len(hashAlgos))
+
+	for name := range hashAlgos {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+// rateLimiter spreads reads from all workers so that, together, they read
+// no more than rate bytes per second
+type rateLimiter struct {
+	mu   sync.Mutex
+	rate int64
+	next time.Time
+}
+
+func newRateLimiter(rate int64) *rateLimiter {
+	return &rateLimiter{rate: rate}
+}
+
+// wait blocks until n more bytes can be read without exceeding the rate.
+// A nil rateLimiter or a rate of 0 never blocks
+func (l *rateLimiter) wait(n int) {
+	if l == nil || l.rate <= 0 || n <= 0 {
+		return
+	}
+
+	l.mu.Lock()
+
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+
+	delay := l.next.Sub(now)
+	l.next = l.next.Add(time.Duration(int64(n) * int64(time.Second) / l.rate))
+
+	l.mu.Unlock()
+
+	time.Sleep(delay)
+}
+
+// limitedReader is an io.Reader that waits on limiter for the bytes it reads
+type limitedReader struct {
+	r       io.Reader
+	limiter *rateLimiter
+}
+
+func (lr *limitedReader) Read(p []byte) (int, error) {
+	n, err := lr.r.Read(p)
+	lr.limiter.wait(n)
+
+	return n, err
+}
@@ -1,25 +1,25 @@
 package main
 
 import (
+	"bytes"
+	"crypto/md5" //#nosec - testing code can be insecure
 	"crypto/sha256"
-	"errors"
+	"crypto/sha512"
+	"encoding/binary"
 	"fmt"
+	"hash/crc32"
+	"io"
 	"testing"
+	"time"
 
-	"bou.ke/monkey"
 	"github.com/spf13/afero"
 	"github.com/stretchr/testify/assert"
 )
 
-const (
-	testFsReadFileErr = "fs.ReadFile err occurred"
-)
-
 func TestHasher(t *testing.T) {
-	e = new(env)
+	e := new(env)
 	afs, files := createAferoTest(t, 10, false)
 	e.afs = afs
-	ap = NewAsyncProcessor(e, files)
 
 	t.Run("should return the hash of 'pre'file & log it", func(t *testing.T) {
 		for _, f := range files {
@@ -32,33 +32,120 @@ func TestHasher(t *testing.T) {
 
 			prePost := "pre"
 			sha := sha256.Sum256(content)
-			err = f.hasher()
+			err = f.hasher(e)
 			assert.Nil(t, err)
-			assert.Equal(t, sha, f.hash)
+			assert.Equal(t, sha[:], f.hash)
 
 			gotLogMsg := hook.LastEntry().Message
-			wantLogMsg := fmt.Sprintf(fHashLog, f.smbName, f.id, prePost, f.hash)
+			wantLogMsg := fmt.Sprintf(fHashLog, f.smbName, f.id, prePost, hashSHA256, f.hash)
 			assertCorrectString(t, gotLogMsg, wantLogMsg)
 		}
 	})
 	t.Run("should log an error on failure to hash", func(t *testing.T) {
-		fakeFsReadFile := func(_ afero.Fs, _ string) ([]byte, error) {
-			err := errors.New(testFsReadFileErr)
-			return nil, err
-		}
-
-		patch := monkey.Patch(afero.ReadFile, fakeFsReadFile)
-		defer patch.Unpatch()
-
 		for _, f := range files {
 			e.logger, hook = setupLogs()
 
-			err := f.hasher()
+			f.stagingPath = f.stagingPath + testDoesNotExistFile
+
+			err := f.hasher(e)
 			assert.Error(t, err)
 
 			gotLogMsg := hook.Entries[0].Message
-			wantLogMsg := testFsReadFileErr
+			wantLogMsg := fmt.Sprintf(testFsysDoesNotExistErr, f.stagingPath)
 			assertCorrectString(t, gotLogMsg, wantLogMsg)
 		}
 	})
+	t.Run("should stream files larger than the hash buffer", func(t *testing.T) {
+		e.logger, hook = setupLogs()
+
+		content := genRandom(hashBufferSize*3+7, letterBytes)
+
+		err := afero.WriteFile(afs, testPath, content, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		f := file{stagingPath: testPath}
+
+		sum := sha256.Sum256(content)
+
+		err = f.hasher(e)
+		assert.Nil(t, err)
+		assert.Equal(t, sum[:], f.hash)
+	})
+	t.Run("should hash with the algorithm set in env", func(t *testing.T) {
+		content := []byte(testLongerContent)
+
+		err := afero.WriteFile(afs, testPath, content, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sha512Sum := sha512.Sum512(content)
+		md5Sum := md5.Sum(content) //#nosec - testing code can be insecure
+		crc32cSum := crc32.Checksum(content, crc32.MakeTable(crc32.Castagnoli))
+
+		hashTests := []struct {
+			algo string
+			want []byte
+		}{
+			{algo: hashSHA512, want: sha512Sum[:]},
+			{algo: hashMD5, want: md5Sum[:]},
+			{algo: hashCRC32C, want: binary.BigEndian.AppendUint32(nil, crc32cSum)},
+		}
+
+		for _, tt := range hashTests {
+			t.Run(tt.algo, func(t *testing.T) {
+				e.logger, hook = setupLogs()
+				e.hashAlgo = tt.algo
+				f := file{smbName: testName, id: testFileID, stagingPath: testPath}
+
+				err := f.hasher(e)
+				assert.Nil(t, err)
+				assert.Equal(t, tt.want, f.hash)
+
+				gotLogMsg := hook.LastEntry().Message
+				wantLogMsg := fmt.Sprintf(fHashLog, f.smbName, f.id, "pre", tt.algo, tt.want)
+				assertCorrectString(t, gotLogMsg, wantLogMsg)
+			})
+		}
+
+		e.hashAlgo = ""
+	})
+}
+
+func TestRateLimiter(t *testing.T) {
+	t.Run("should not block when there is no limit", func(t *testing.T) {
+		var l *rateLimiter
+
+		start := time.Now()
+
+		l.wait(hashBufferSize)
+		newRateLimiter(0).wait(hashBufferSize)
+
+		assert.Less(t, time.Since(start), 50*time.Millisecond)
+	})
+	t.Run("should block reads beyond the rate", func(t *testing.T) {
+		l := newRateLimiter(10000)
+
+		start := time.Now()
+
+		// first 1000 bytes are free, the next 1000 wait for the first 0.1s
+		l.wait(1000)
+		l.wait(1000)
+
+		assert.GreaterOrEqual(t, time.Since(start), 90*time.Millisecond)
+	})
+	t.Run("should limit reads through a limitedReader", func(t *testing.T) {
+		content := bytes.Repeat([]byte(testContent), 500)
+		lr := &limitedReader{r: bytes.NewReader(content), limiter: newRateLimiter(10000)}
+
+		start := time.Now()
+
+		got, err := io.ReadAll(lr)
+		assert.NoError(t, err)
+		assert.Equal(t, content, got)
+
+		assert.GreaterOrEqual(t, time.Since(start), 90*time.Millisecond)
+	})
 }
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+const (
+	fResumeCompletedLog = "%v (file.id:%v) journal shows file.stagingPath:%v was completed; skipping file"
+	fResumeMovedLog     = "%v (file.id:%v) journal shows file moved from:%v to:%v; finishing"
+	fResumeLeftoverLog  = "%v (file.id:%v) journal shows file copied to:%v; removing leftover:%v"
+	fResumeRedoLog      = "%v (file.id:%v) journal shows file at state:%v; starting again"
+	fResumeTempLog      = "%v (file.id:%v) journal shows file moving to:%v; removed partial copy:%v"
+	fResumeTempErrLog   = "%v (file.id:%v) journal shows file moving to:%v; partial copy:%v could not be removed: %v"
+
+	errJournalLine = "journal line %v: %w"
+
+	// stateVerified is journaled once a file passes verify
+	stateVerified = "verified"
+	// statePreHashed is journaled once a file has its pre-move hash
+	statePreHashed = "pre-hashed"
+	// stateMoving is journaled just before the rename, so a crash before
+	// stateMoved still records where the file was going
+	stateMoving = "moving"
+	// stateMoved is journaled once a file is at its new path
+	stateMoved = "moved"
+	// statePostVerified is journaled once the post-move hash matches
+	statePostVerified = "post-verified"
+)
+
+// journal is an append-only record of each file's progress. Every record is
+// fsynced before the file moves on, so after a crash the journal says how far
+// each file got. A nil journal records nothing
+type journal struct {
+	mu   sync.Mutex
+	file afero.File
+}
+
+// journalRecord is one line of the journal
+type journalRecord struct {
+	Time    time.Time `json:"time"`
+	ID      string    `json:"id"`
+	SmbName string    `json:"smbName,omitempty"`
+	State   string    `json:"state"`
+	OldPath string    `json:"oldPath"`
+	NewPath string    `json:"newPath,omitempty"`
+	Hash    string    `json:"hash,omitempty"`
+	Algo    string    `json:"algo,omitempty"`
+}
+
+// openJournal opens pth for appending records
+func openJournal(afs afero.Fs, pth string) (*journal, error) {
+	file, err := afs.OpenFile(pth, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &journal{file: file}, nil
+}
+
+// record appends & fsyncs a record of f reaching state. algo is the hash
+// algorithm of f.oldHash, which is only known for sure once a plan is loaded
+func (j *journal) record(f *file, state string, oldPath string, newPath string, algo string) error {
+	if j == nil {
+		return nil
+	}
+
+	rec := journalRecord{
+		Time:    time.Now().UTC(),
+		ID:      f.id,
+		SmbName: f.smbName,
+		State:   state,
+		OldPath: oldPath,
+		NewPath: newPath,
+	}
+
+	if len(f.oldHash) > 0 {
+		rec.Hash = hex.EncodeToString(f.oldHash)
+		rec.Algo = algo
+	}
+
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	_, err = j.file.Write(append(data, '\n'))
+	if err != nil {
+		return err
+	}
+
+	return j.file.Sync()
+}
+
+func (j *journal) close() error {
+	if j == nil {
+		return nil
+	}
+
+	return j.file.Close()
+}
+
+// readJournal returns the last record for each file id in pth. A torn last
+// line, as left by a crash mid-write, is ignored
+func readJournal(afs afero.Fs, pth string) (map[string]journalRecord, error) {
+	records := map[string]journalRecord{}
+
+	data, err := afero.ReadFile(afs, pth)
+	if errors.Is(err, fs.ErrNotExist) {
+		return records, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	lines := bytes.Split(bytes.TrimSuffix(data, []byte{'\n'}), []byte{'\n'})
+
+	for i, line := range lines {
+		if len(line) == 0 {
+			continue
+		}
+
+		var rec journalRecord
+
+		err = json.Unmarshal(line, &rec)
+		if err != nil {
+			if i == len(lines)-1 && !bytes.HasSuffix(data, []byte{'\n'}) {
+				break
+			}
+
+			return nil, fmt.Errorf(errJournalLine, i+1, err)
+		}
+
+		records[rec.ID] = rec
+	}
+
+	return records, nil
+}
+
+// journal records f reaching state in e's journal & fatals if it cannot, as
+// carrying on would leave a crash unrecoverable
+func (f *file) journal(state string, oldPath string, newPath string, e *env) {
+	err := e.journal.record(f, state, oldPath, newPath, e.hashName())
+	if err != nil {
+		e.logger.Fatal(err)
+	}
+}
+
+// resumeFrom picks f up from where the journal says it got to. A completed
+// file is marked as such, a moved file is pointed at its new path & anything
+// earlier starts again. Its journaled hash is from the journal's algorithm,
+// which setResumeAlgo has made e's. It is a no-op unless -resume is set
+func (f *file) resumeFrom(e *env) {
+	rec, ok := e.resumed[f.id]
+	if !ok {
+		return
+	}
+
+	hash, err := hex.DecodeString(rec.Hash)
+	if err != nil {
+		e.logger.Fatal(err)
+	}
+
+	resumed := rec.State
+
+	switch rec.State {
+	case statePostVerified:
+		e.logger.Info(fmt.Sprintf(fResumeCompletedLog, f.smbName, f.id, rec.NewPath))
+	case stateMoved:
+		e.logger.Info(fmt.Sprintf(fResumeMovedLog, f.smbName, f.id, rec.OldPath, rec.NewPath))
+	case stateMoving:
+		f.removeCopyTemp(rec.NewPath, e)
+
+		if !exists(rec.NewPath, e) {
+			e.logger.Info(fmt.Sprintf(fResumeRedoLog, f.smbName, f.id, rec.State))
+			return
+		}
+
+		if exists(rec.OldPath, e) {
+			// a cross-device copy is only renamed into place once verified,
+			// so the crash came before the source was removed
+			e.logger.Warn(fmt.Sprintf(fResumeLeftoverLog, f.smbName, f.id, rec.NewPath, rec.OldPath))
+			f.leftover = rec.OldPath
+		} else {
+			e.logger.Info(fmt.Sprintf(fResumeMovedLog, f.smbName, f.id, rec.OldPath, rec.NewPath))
+		}
+
+		resumed = stateMoved
+	default:
+		e.logger.Info(fmt.Sprintf(fResumeRedoLog, f.smbName, f.id, rec.State))
+		return
+	}
+
+	f.resumed = resumed
+	f.oldStagingPath = rec.OldPath
+	f.stagingPath = rec.NewPath
+	f.oldHash = hash
+	f.moveKind = moveCopy
+}
+
+// removeCopyTemp removes the temp file a crash mid copyMove to dst may have
+// left behind
+func (f *file) removeCopyTemp(dst string, e *env) {
+	tmp := f.copyTempPath(dst)
+
+	err := e.afs.Remove(tmp)
+
+	switch {
+	case err == nil:
+		e.logger.Info(fmt.Sprintf(fResumeTempLog, f.smbName, f.id, dst, tmp))
+	case !errors.Is(err, fs.ErrNotExist):
+		e.logger.Warn(fmt.Sprintf(fResumeTempErrLog, f.smbName, f.id, dst, tmp, err))
+	}
+}
+
+func exists(pth string, e *env) bool {
+	_, err := e.afs.Stat(pth)
+
+	return err == nil
+}
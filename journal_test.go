@@ -0,0 +1,293 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+const testJournalFile = "journal.jsonl"
+
+func TestJournal(t *testing.T) {
+	t.Run("should keep the last record for each file", func(t *testing.T) {
+		afs := afero.NewMemMapFs()
+
+		j, err := openJournal(afs, testJournalFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		f := &file{id: testFileID, oldHash: []byte(testContent)}
+
+		assert.NoError(t, j.record(f, stateVerified, testPath, "", hashSHA256))
+		assert.NoError(t, j.record(f, stateMoving, testPath, testName, hashSHA256))
+		assert.NoError(t, j.record(&file{id: testDatasetID}, stateVerified, testName, "", hashSHA256))
+		assert.NoError(t, j.close())
+
+		records, err := readJournal(afs, testJournalFile)
+		assert.NoError(t, err)
+		assert.Len(t, records, 2)
+
+		rec := records[testFileID]
+		assertCorrectString(t, rec.State, stateMoving)
+		assertCorrectString(t, rec.OldPath, testPath)
+		assertCorrectString(t, rec.NewPath, testName)
+		assertCorrectString(t, rec.Hash, hex.EncodeToString([]byte(testContent)))
+		assertCorrectString(t, rec.Algo, hashSHA256)
+		assert.Empty(t, records[testDatasetID].Algo)
+	})
+
+	t.Run("should append to an existing journal", func(t *testing.T) {
+		afs := afero.NewMemMapFs()
+
+		for _, state := range []string{stateVerified, statePreHashed} {
+			j, err := openJournal(afs, testJournalFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			assert.NoError(t, j.record(&file{id: testFileID}, state, testPath, "", hashSHA256))
+			assert.NoError(t, j.close())
+		}
+
+		data, err := afero.ReadFile(afs, testJournalFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assert.Equal(t, 2, countLines(data))
+	})
+
+	t.Run("should ignore a torn last line", func(t *testing.T) {
+		afs := afero.NewMemMapFs()
+		data := `{"id":"` + testFileID + `","state":"moved","oldPath":"a","newPath":"b"}` + "\n" +
+			`{"id":"` + testFileID + `","state":"post-`
+
+		err := afero.WriteFile(afs, testJournalFile, []byte(data), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		records, err := readJournal(afs, testJournalFile)
+		assert.NoError(t, err)
+		assertCorrectString(t, records[testFileID].State, stateMoved)
+	})
+
+	t.Run("should error on a corrupt line before the last", func(t *testing.T) {
+		afs := afero.NewMemMapFs()
+		data := "{\n" + `{"id":"` + testFileID + `","state":"moved"}` + "\n"
+
+		err := afero.WriteFile(afs, testJournalFile, []byte(data), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = readJournal(afs, testJournalFile)
+		assert.ErrorContains(t, err, "journal line 1")
+	})
+
+	t.Run("should read a missing journal as empty", func(t *testing.T) {
+		records, err := readJournal(afero.NewMemMapFs(), testJournalFile)
+		assert.NoError(t, err)
+		assert.Empty(t, records)
+	})
+
+	t.Run("a nil journal should record nothing", func(t *testing.T) {
+		var j *journal
+
+		assert.NoError(t, j.record(&file{}, stateVerified, testPath, "", hashSHA256))
+		assert.NoError(t, j.close())
+	})
+}
+
+func TestProcessFilesJournal(t *testing.T) {
+	setup := func(t *testing.T, numFiles int) (*env, afero.Fs, []file) {
+		afs, files := createAferoTest(t, numFiles, true)
+		hostname, _ := os.Hostname()
+		ips, _ := net.LookupIP(hostname)
+		e := new(env)
+
+		e.logger, hook = setupLogs()
+		e.afs = afs
+		e.fsys = afero.NewIOFS(afs)
+		e.sysIPs = []net.IP{ips[0]}
+		e.datasetID = testDatasetID
+		e.gbr = testGBR
+		e.sourceFile = fmt.Sprintf(testSourceFile, getWorkDir())
+
+		return e, afs, files
+	}
+
+	openTestJournal := func(t *testing.T, e *env) {
+		t.Helper()
+
+		j, err := openJournal(e.afs, testJournalFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		e.journal = j
+	}
+
+	t.Run("should journal each state a file reaches", func(t *testing.T) {
+		e, afs, files := setup(t, 1)
+		openTestJournal(t, e)
+
+		NewAsyncProcessor(e, files).processFiles()
+		assert.NoError(t, e.journal.close())
+
+		data, err := afero.ReadFile(afs, testJournalFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assert.Equal(t, 5, countLines(data))
+
+		records, err := readJournal(afs, testJournalFile)
+		assert.NoError(t, err)
+
+		rec := records[files[0].id]
+		assertCorrectString(t, rec.State, statePostVerified)
+		assertCorrectString(t, rec.OldPath, files[0].oldStagingPath)
+		assertCorrectString(t, rec.NewPath, files[0].stagingPath)
+		assertCorrectString(t, rec.Hash, hex.EncodeToString(files[0].hash))
+	})
+
+	t.Run("should resume an interrupted run", func(t *testing.T) {
+		e, afs, files := setup(t, 4)
+		openTestJournal(t, e)
+
+		// files[0] completed, files[1] crashed after the rename, files[2] crashed
+		// after a cross-device copy but before removing the source & files[3]
+		// was only verified
+		for i := range files[:3] {
+			f := &files[i]
+			dst := mustNewPath(t, *f)
+
+			sum, err := hashFile(f.stagingPath, e)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			f.oldHash = sum
+			f.journal(stateMoving, f.stagingPath, dst, e)
+
+			content, err := afero.ReadFile(afs, f.stagingPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = afero.WriteFile(afs, dst, content, 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if i < 2 {
+				err = afs.Remove(f.stagingPath)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if i == 0 {
+				f.journal(statePostVerified, f.stagingPath, dst, e)
+			}
+		}
+
+		files[3].journal(stateVerified, files[3].stagingPath, "", e)
+		assert.NoError(t, e.journal.close())
+
+		records, err := readJournal(afs, testJournalFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		e.resumed = records
+		e.logger, hook = setupLogs()
+		openTestJournal(t, e)
+		ap := NewAsyncProcessor(e, []file{})
+
+		ap.setFiles()
+		ap.processFiles()
+
+		resumed := ap.getFiles()
+		assert.Len(t, resumed, len(files))
+
+		for i, f := range resumed[:3] {
+			assert.True(t, f.success, f.reason)
+			assertCorrectString(t, f.stagingPath, mustNewPath(t, files[i]))
+
+			_, err := afs.Stat(files[i].stagingPath)
+			assert.Error(t, err, i)
+		}
+
+		assert.Empty(t, resumed[0].hash)
+		assertCorrectString(t, resumed[2].leftover, files[2].stagingPath)
+
+		// files[3] starts again from its stagingPath
+		assert.Empty(t, resumed[3].resumed)
+		assertCorrectString(t, resumed[3].stagingPath, files[3].stagingPath)
+		assert.NoError(t, e.journal.close())
+
+		records, err = readJournal(afs, testJournalFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, f := range files[:3] {
+			assertCorrectString(t, records[f.id].State, statePostVerified)
+		}
+	})
+
+	t.Run("should remove a partial copy left by a crash mid copy", func(t *testing.T) {
+		e, afs, files := setup(t, 1)
+		openTestJournal(t, e)
+
+		f := &files[0]
+		dst := mustNewPath(t, *f)
+		tmp := f.copyTempPath(dst)
+
+		f.journal(stateMoving, f.stagingPath, dst, e)
+		assert.NoError(t, e.journal.close())
+
+		err := afero.WriteFile(afs, tmp, []byte(testContent), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		records, err := readJournal(afs, testJournalFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		e.resumed = records
+		e.logger, hook = setupLogs()
+
+		resumed := *f
+		resumed.resumeFrom(e)
+
+		_, err = afs.Stat(tmp)
+		assert.True(t, os.IsNotExist(err))
+		assert.Empty(t, resumed.resumed)
+		assertCorrectString(t, resumed.stagingPath, f.stagingPath)
+
+		gotLogMsg := hook.Entries[0].Message
+		wantLogMsg := fmt.Sprintf(fResumeTempLog, f.smbName, f.id, dst, tmp)
+		assertCorrectString(t, gotLogMsg, wantLogMsg)
+	})
+}
+
+func countLines(data []byte) (n int) {
+	for _, b := range data {
+		if b == '\n' {
+			n++
+		}
+	}
+
+	return n
+}
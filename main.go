@@ -1,14 +1,20 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"io/fs"
+	"maps"
 	"net"
 	"os"
 	"path"
 	"path/filepath"
 	"regexp"
+	"slices"
+	"sort"
 	"strings"
+	"sync"
 
 	log "github.com/JLCodeSource/process_async_ds/logger"
 	"github.com/spf13/afero"
@@ -31,11 +37,46 @@ const (
 	dryRunFalseLog              = "dryrun: false; executing move"
 	testRunTrueLog              = "testrun: setting to true"
 	testRunFalseLog             = "testrun: setting to false"
-	complexIPLog                = "net.LookupIP: unexpected; more ips than expected"
+	workersLog                  = "workers: %v"
+	workersInvalidLog           = "workers: %v is not a valid number of workers; setting to 1"
+	mountWorkersLog             = "mountworkers: %v"
+	mountWorkersInvalidLog      = "mountworkers: %v is not a valid number of workers per mount; setting to 1"
+	hashRateLog                 = "hashrate: limiting reads to %v MiB/s"
+	hashRateUnlimitedLog        = "hashrate: No limit set; reading at full speed"
+	hashAlgoLog                 = "hash: %v"
+	hashAlgoInvalidLog          = "hash: %v is not a supported algorithm; use one of %v"
+	paranoidTrueLog             = "paranoid: true; re-hashing every file after move"
+	paranoidFalseLog            = "paranoid: false; skipping post-move hash for in place renames"
+	mappingLog                  = "mapping: %v rules loaded from %v"
+	mappingDefaultLog           = "mapping: No rules file set; using default rules"
+	collisionLog                = "collision: %v"
+	collisionInvalidLog         = "collision: %v is not a supported policy; use one of %v"
+	planFileLog                 = "plan: %v"
+	planFileMissingLog          = "plan: No plan file set; use -plan"
+	commandLog                  = "command: %v"
+	journalLog                  = "journal: appending to %v"
+	journalNoneLog              = "journal: No journal set; an interrupted run cannot be resumed"
+	journalDryRunLog            = "journal: dryrun; not journaling to %v"
+	resumeDryRunLog             = "resume: dryrun; not resuming from %v, so every file starts again"
+	resumeLog                   = "resume: %v files in journal %v"
+	resumeNoJournalLog          = "resume: needs -journal"
+	resumeAlgoLog               = "resume: journal %v hashes with %v, not -hash %v; using %v"
+	resumeMixedAlgosLog         = "resume: journal %v mixes hash algorithms %v"
+	usageLog                    = "Usage: %v [%v] [flags]\n"
+	noIPLog                     = "net.LookupIP: no ips"
 	wrapOsLog                   = "%v: %v"
 	osHostnameLog               = "os.Hostname"
 	osExecutableLog             = "os.Executable"
 	wrapLookupIPLog             = "net.LookupIP: %v=%v"
+	wrapInterfaceAddrsLog       = "net.InterfaceAddrs: %v"
+	sysIPsLog                   = "sysIPs: %v"
+	sysIPsFanIPLog              = "sysIPs: %v set by -fan-ip"
+	sysIPsInvalidLog            = "sysIPs: -fan-ip %q is not an IP"
+	sysIPsLookupErrLog          = "sysIPs: %v; using interface addresses only"
+	sysIPsAddrsErrLog           = "sysIPs: %v; using hostname addresses only"
+	parseLineErrLog             = "sourcefile line %v: %v; handling as %v"
+	fNotListedLog               = "%v (file.id:%v) not added to list: %v"
+	exitCodeLog                 = "exit: worst error class:%v; exiting with code %v"
 
 	eMatchAsyncProcessedDSTrueLog  = "env.datasetID:%v matches asyncProcessedDataset: %v"
 	eMatchAsyncProcessedDSFalseLog = "env.datasetID:%v does not match asyncProcessedDataset: %v"
@@ -44,28 +85,119 @@ const (
 
 	regexDatasetMatch = "^[A-F0-9]{32}$"
 
-	sourceFileArgTxt  = "sourcefile"
-	sourceFileArgHelp = "source path/file (default '')"
-	datasetIDArgTxt   = "datasetid"
-	datasetIDArgHelp  = "async processed dataset id (default '')"
-	timelimitArgTxt   = "days"
-	timelimitArgHelp  = "number of days ago (default 0)"
-	dryrunArgTxt      = "dryrun"
-	dryrunArgHelp     = "execute as dry run"
-	testrunArgTxt     = "test"
-	testrunArgHelp    = "execute with test fs (default false)"
+	sourceFileArgTxt      = "sourcefile"
+	sourceFileArgHelp     = "source path/file (default '')"
+	datasetIDArgTxt       = "datasetid"
+	datasetIDArgHelp      = "async processed dataset id (default '')"
+	timelimitArgTxt       = "days"
+	timelimitArgHelp      = "number of days ago (default 0)"
+	dryrunArgTxt          = "dryrun"
+	dryrunArgHelp         = "execute as dry run"
+	testrunArgTxt         = "test"
+	testrunArgHelp        = "execute with test fs (default false)"
+	workersArgTxt         = "workers"
+	workersArgHelp        = "number of files to process concurrently"
+	mountWorkersArgTxt    = "mountworkers"
+	mountWorkersArgHelp   = "number of files to process concurrently on each staging mount"
+	hashRateArgTxt        = "hashrate"
+	hashRateArgHelp       = "limit total read rate while hashing in MiB/s (default 0, unlimited)"
+	hashAlgoArgTxt        = "hash"
+	hashAlgoArgHelp       = "hash algorithm: sha256, sha512, md5 or crc32c"
+	paranoidArgTxt        = "paranoid"
+	paranoidArgHelp       = "re-hash every file after move, even on an in place rename"
+	mappingArgTxt         = "mapping"
+	mappingArgHelp        = "JSON file of source to destination path mapping rules (default mb/FAN & dataN/staging to .processed)"
+	printMappingArgTxt    = "print-mapping"
+	printMappingArgHelp   = "print where each file in sourcefile would move to & exit"
+	collisionArgTxt       = "collision"
+	collisionArgHelp      = "if newPath exists: skip, fail, overwrite-if-identical-hash or rename-with-suffix"
+	planArgTxt            = "plan"
+	planArgHelp           = "plan file written by the plan command & executed by the apply or restore command"
+	journalArgTxt         = "journal"
+	journalArgHelp        = "append each file's progress to this journal so an interrupted run can be resumed, or the journal to restore from"
+	resumeArgTxt          = "resume"
+	resumeArgHelp         = "pick up where the -journal says an interrupted run got to"
+	reportArgTxt          = "report"
+	reportArgHelp         = "write each file's result to this .json or .csv file"
+	exportArgTxt          = "export"
+	exportArgHelp         = "raw FileGet.jar export read by the cleanse command"
+	outDirArgTxt          = "outdir"
+	outDirArgHelp         = "directory the cleanse & split commands write their output to"
+	inventoryArgTxt       = "inventory"
+	inventoryArgHelp      = "node inventory of site,node,ip lines read by the split command"
+	orderArgTxt           = "order"
+	orderArgHelp          = "order to process files in: size-desc, size-asc, ctime-asc, ctime-desc or input"
+	maxFilesArgTxt        = "max-files"
+	maxFilesArgHelp       = "process at most this many files that pass verify, in -order (default 0, unlimited)"
+	maxBytesArgTxt        = "max-bytes"
+	maxBytesArgHelp       = "process files that pass verify, in -order, until the next would take the total past this many bytes (default 0, unlimited)"
+	gbrPathArgTxt         = "gbr"
+	gbrPathArgHelp        = "path to the gbr binary"
+	gbrTimeoutArgTxt      = "gbr-timeout"
+	gbrTimeoutArgHelp     = "kill a gbr or cqlsh query that takes longer than this (0 to wait forever)"
+	gbrCacheTTLArgTxt     = "gbr-cache-ttl"
+	gbrCacheTTLArgHelp    = "reuse gbr's pool lookup for this long (0 to look it up every time)"
+	gbrConcurrencyArgTxt  = "gbr-concurrency"
+	gbrConcurrencyArgHelp = "run at most this many gbr file lookups at once"
+	gbrRateArgTxt         = "gbr-rate"
+	gbrRateArgHelp        = "run at most this many gbr file lookups a second (default 0, unlimited)"
+	gbrRetriesArgTxt      = "gbr-retries"
+	gbrRetriesArgHelp     = "retry a failed gbr query this many times"
+	gbrBackoffArgTxt      = "gbr-backoff"
+	gbrBackoffArgHelp     = "wait this long before retrying a failed gbr query, doubling after each retry"
+	datasetNameArgTxt     = "dataset-name"
+	datasetNameArgHelp    = "name of the dataset, looked up instead of -datasetid or checked against it"
+	datasetResolverArgTxt = "dataset-resolver"
+	datasetResolverHelp   = "look the dataset up with cqlsh (datasets_by_name) or gbr (pool ls -d, whose first ID may be the pool's)"
+	cqlshPathArgTxt       = "cqlsh"
+	cqlshPathArgHelp      = "path to the cqlsh binary used by -dataset-resolver cqlsh"
+	cqlshHostArgTxt       = "cqlsh-host"
+	cqlshHostArgHelp      = "metadata service host queried by cqlsh (default each -fan-ip or node IP in turn)"
+	cqlshPortArgTxt       = "cqlsh-port"
+	cqlshPortArgHelp      = "metadata service port queried by cqlsh"
+	fanIPArgTxt           = "fan-ip"
+	fanIPArgHelp          = "comma separated IPs a file's fan IP must match (default this node's hostname & interface IPs)"
+
+	mebibyte = 1 << 20
 )
 
 var (
-	sourceFile string
-	datasetID  string
-	numDays    int64
-	dryrun     bool
-	testrun    bool
-	ap         AsyncProcessor
-	e          *env
-	afs        afero.Fs
-	files      []file
+	sourceFile    string
+	datasetID     string
+	numDays       int64
+	dryrun        bool
+	testrun       bool
+	workers       int
+	mountWorkers  int
+	hashRate      int64
+	hashAlgo      string
+	paranoid      bool
+	mappingFile   string
+	printMapping  bool
+	collision     string
+	planFile      string
+	journalFile   string
+	resume        bool
+	reportFile    string
+	exportFile    string
+	outDir        string
+	inventoryFile string
+	order         string
+	maxFiles      int
+	maxBytes      int64
+	gbrPath       string
+	gbrTimeout    time.Duration
+	gbrCacheTTL   time.Duration
+	gbrConc       int
+	gbrRate       int64
+	gbrRetries    int
+	gbrBackoff    time.Duration
+	datasetName   string
+	resolver      string
+	cqlshPath     string
+	cqlshHost     string
+	cqlshPort     int
+	fanIP         string
 
 	// testIntegrationTestSetup
 	testIntegrationTestSetup AsyncProcessor
@@ -77,13 +209,38 @@ type env struct {
 	exePath string
 	fsys    fs.FS
 	afs     afero.Fs
-	sysIP   net.IP
-
-	sourceFile string
-	datasetID  string
-	limit      time.Time
-	dryrun     bool
-	testrun    bool
+	// outFs is where the tool's own output, e.g. the report, is written. It
+	// stays writable when -dryrun makes afs read only
+	outFs  afero.Fs
+	sysIPs []net.IP
+
+	sourceFile    string
+	datasetID     string
+	limit         time.Time
+	dryrun        bool
+	testrun       bool
+	workers       int
+	mountWorkers  int
+	readLimiter   *rateLimiter
+	hashAlgo      string
+	paranoid      bool
+	mappingRules  []mappingRule
+	collision     string
+	planFile      string
+	journalFile   string
+	journal       *journal
+	resumed       map[string]journalRecord
+	reportFile    string
+	exportFile    string
+	outDir        string
+	inventoryFile string
+	order         string
+	maxFiles      int
+	maxBytes      int64
+	limits        *limiter
+	gbr           GBRClient
+	datasets      DatasetResolver
+	datasetName   string
 }
 
 // AsyncProcessor interface is the interface for AD
@@ -93,14 +250,31 @@ type AsyncProcessor interface {
 	setEnv(*env)
 	setFiles()
 	processFiles()
+	planFiles()
+	loadPlan()
+	loadRestore()
+	restoreFiles()
+	getResults() []result
+	printSummary(io.Writer)
+	writeReport()
+	exitCode() int
 	//parseSourceFile() []string
 	//parseLine(string) file
 }
 
-// asyncProcessor is the async processing instance
+// asyncProcessor is the async processing instance. worst is the most severe
+// errClass seen so far & elapsed the time spent processing files
 type asyncProcessor struct {
 	env   *env
 	files []file
+	// unlisted are the sourcefile lines setFiles could not list, which are
+	// reported but never processed
+	unlisted []file
+	results  []result
+	elapsed  time.Duration
+
+	mu    sync.Mutex
+	worst errClass
 }
 
 // NewAsyncProcessor returns a pointer to an AsyncProcessor
@@ -112,19 +286,22 @@ func NewAsyncProcessor(env *env, files []file) AsyncProcessor {
 }
 
 // verify env
-func (e *env) verifyDataset() bool {
-	ds := getAsyncProcessedDSID(e.logger)
+func (e *env) verifyDataset() error {
+	ds, err := e.asyncProcessedDSID()
+	if err != nil {
+		return err
+	}
+
 	if e.datasetID != ds {
-		e.logger.Fatal(fmt.Sprintf(eMatchAsyncProcessedDSFalseLog, e.datasetID, ds))
-		return false
+		return fmt.Errorf(errWrapMsg, ErrDataset, fmt.Sprintf(eMatchAsyncProcessedDSFalseLog, e.datasetID, ds))
 	}
 
 	e.logger.Info(fmt.Sprintf(eMatchAsyncProcessedDSTrueLog, e.datasetID, ds))
 
-	return true
+	return nil
 }
 
-func (e *env) setSourceFile(ex string, f string) {
+func (e *env) setSourceFile(ex string, f string) error {
 	var pth string
 
 	filesystem := e.fsys
@@ -143,49 +320,55 @@ func (e *env) setSourceFile(ex string, f string) {
 
 	_, err := fs.Stat(filesystem, pth)
 	if err != nil {
-		e.logger.Fatal(err.Error())
+		return fmt.Errorf(errWrap, ErrSourceFile, err)
 	}
 
 	e.sourceFile = f
 
 	e.logger.Info(fmt.Sprintf(sourceLog, f))
+
+	return nil
 }
 
-func (e *env) setDatasetID(id string) {
+func (e *env) setDatasetID(id string) error {
 	logger := e.logger
 	match, err := regexp.MatchString(regexDatasetMatch, id)
 
 	if err != nil {
-		logger.Fatal(err.Error())
+		return err
 	}
 
 	if !match {
-		logger.Fatal(fmt.Sprintf(datasetRegexLog, id, regexDatasetMatch))
+		return fmt.Errorf(errWrapMsg, ErrDataset, fmt.Sprintf(datasetRegexLog, id, regexDatasetMatch))
 	}
 
-	// if no fatal datsets match
-	ok := e.compareDatasetID(id)
-	if !ok {
-		return
+	err = e.compareDatasetID(id)
+	if err != nil {
+		return err
 	}
 
 	e.datasetID = id
 
 	logger.Info(fmt.Sprintf(datasetLog, id))
+
+	return nil
 }
 
-func (e *env) compareDatasetID(datasetID string) bool {
+func (e *env) compareDatasetID(datasetID string) error {
 	logger := e.logger
-	asyncProcessedDS := getAsyncProcessedDSID(logger)
+
+	asyncProcessedDS, err := e.asyncProcessedDSID()
+	if err != nil {
+		return err
+	}
 
 	if asyncProcessedDS != datasetID {
-		logger.Fatal(fmt.Sprintf(compareDatasetIDNotMatchLog, datasetID, asyncProcessedDS))
-		return false
+		return fmt.Errorf(errWrapMsg, ErrDataset, fmt.Sprintf(compareDatasetIDNotMatchLog, datasetID, asyncProcessedDS))
 	}
 
 	logger.Info(fmt.Sprintf(compareDatasetIDMatchLog, datasetID, asyncProcessedDS))
 
-	return true
+	return nil
 }
 
 func (e *env) setTimeLimit(days int64) {
@@ -207,13 +390,15 @@ func (e *env) setTimeLimit(days int64) {
 func (e *env) setDryRun(dryrun bool) {
 	logger := e.logger
 
+	e.outFs = afero.NewOsFs()
+
 	if dryrun {
-		e.afs = afero.NewReadOnlyFs(afero.NewOsFs())
+		e.afs = afero.NewReadOnlyFs(e.outFs)
 		e.dryrun = true
 
 		logger.Info(dryRunTrueLog)
 	} else {
-		e.afs = afero.NewOsFs()
+		e.afs = e.outFs
 		e.dryrun = false
 
 		logger.Warn(dryRunFalseLog)
@@ -234,12 +419,267 @@ func (e *env) setTestRun(testrun bool) bool {
 	return testrun
 }
 
-func (e *env) setSysIP() {
-	hostname := wrapOs(e.logger, osHostnameLog, os.Hostname)
+func (e *env) setWorkers(workers int) {
+	logger := e.logger
+
+	if workers < 1 {
+		logger.Warn(fmt.Sprintf(workersInvalidLog, workers))
+
+		workers = 1
+	}
+
+	e.workers = workers
+
+	logger.Info(fmt.Sprintf(workersLog, workers))
+}
+
+func (e *env) setMountWorkers(mountWorkers int) {
+	logger := e.logger
+
+	if mountWorkers < 1 {
+		logger.Warn(fmt.Sprintf(mountWorkersInvalidLog, mountWorkers))
+
+		mountWorkers = 1
+	}
+
+	e.mountWorkers = mountWorkers
+
+	logger.Info(fmt.Sprintf(mountWorkersLog, mountWorkers))
+}
+
+func (e *env) setHashRate(mibps int64) {
+	logger := e.logger
+
+	if mibps <= 0 {
+		e.readLimiter = nil
+
+		logger.Info(hashRateUnlimitedLog)
+
+		return
+	}
+
+	e.readLimiter = newRateLimiter(mibps * mebibyte)
+
+	logger.Info(fmt.Sprintf(hashRateLog, mibps))
+}
+
+func (e *env) setHashAlgo(algo string) {
+	logger := e.logger
+
+	if _, ok := hashAlgos[algo]; !ok {
+		logger.Fatal(fmt.Sprintf(hashAlgoInvalidLog, algo, hashNames()))
+	}
+
+	e.hashAlgo = algo
+
+	logger.Info(fmt.Sprintf(hashAlgoLog, algo))
+}
+
+func (e *env) setParanoid(paranoid bool) {
+	logger := e.logger
+
+	e.paranoid = paranoid
+
+	if paranoid {
+		logger.Info(paranoidTrueLog)
+	} else {
+		logger.Info(paranoidFalseLog)
+	}
+}
+
+func (e *env) setMapping(pth string) {
+	logger := e.logger
+
+	if pth == "" {
+		e.mappingRules = defaultMappingRules
+
+		logger.Info(mappingDefaultLog)
+
+		return
+	}
+
+	data, err := afero.ReadFile(e.afs, pth)
+	if err != nil {
+		logger.Fatal(err)
+	}
+
+	rules, err := parseMappingRules(data)
+	if err != nil {
+		logger.Fatal(err)
+	}
+
+	e.mappingRules = rules
+
+	logger.Info(fmt.Sprintf(mappingLog, len(rules), pth))
+}
+
+func (e *env) setCollision(policy string) {
+	logger := e.logger
+
+	if !slices.Contains(collisionPolicies, policy) {
+		logger.Fatal(fmt.Sprintf(collisionInvalidLog, policy, collisionPolicies))
+	}
 
-	ip := wrapLookupIP(e.logger, hostname, net.LookupIP)
+	e.collision = policy
 
-	e.sysIP = ip
+	logger.Info(fmt.Sprintf(collisionLog, policy))
+}
+
+func (e *env) setPlanFile(pth string) {
+	logger := e.logger
+
+	if pth == "" {
+		logger.Fatal(planFileMissingLog)
+	}
+
+	e.planFile = pth
+
+	logger.Info(fmt.Sprintf(planFileLog, pth))
+}
+
+func (e *env) setJournal(pth string, resume bool) {
+	logger := e.logger
+
+	if pth == "" {
+		if resume {
+			logger.Fatal(resumeNoJournalLog)
+		}
+
+		logger.Warn(journalNoneLog)
+
+		return
+	}
+
+	if e.dryrun {
+		logger.Warn(fmt.Sprintf(journalDryRunLog, pth))
+
+		if resume {
+			logger.Warn(fmt.Sprintf(resumeDryRunLog, pth))
+		}
+
+		return
+	}
+
+	if resume {
+		records, err := readJournal(e.afs, pth)
+		if err != nil {
+			logger.Fatal(err)
+		}
+
+		e.resumed = records
+
+		logger.Info(fmt.Sprintf(resumeLog, len(records), pth))
+
+		e.setResumeAlgo(pth, records)
+	}
+
+	j, err := openJournal(e.afs, pth)
+	if err != nil {
+		logger.Fatal(err)
+	}
+
+	e.journal = j
+	e.journalFile = pth
+
+	logger.Info(fmt.Sprintf(journalLog, pth))
+}
+
+// setResumeAlgo switches e to the hash algorithm of the journal at pth, so
+// that the hashes of the files it resumes are compared like for like
+func (e *env) setResumeAlgo(pth string, records map[string]journalRecord) {
+	logger := e.logger
+	algos := map[string]bool{}
+
+	for _, rec := range records {
+		if rec.Hash != "" && rec.Algo != "" {
+			algos[rec.Algo] = true
+		}
+	}
+
+	if len(algos) > 1 {
+		logger.Fatal(fmt.Sprintf(resumeMixedAlgosLog, pth, slices.Sorted(maps.Keys(algos))))
+	}
+
+	for algo := range algos {
+		if algo != e.hashName() {
+			logger.Warn(fmt.Sprintf(resumeAlgoLog, pth, algo, e.hashName(), algo))
+			e.setHashAlgo(algo)
+		}
+	}
+}
+
+// setRestoreSource sets the plan or journal that restore reads its moves
+// from. Exactly one must be set
+func (e *env) setRestoreSource(planPth string, journalPth string) {
+	logger := e.logger
+
+	if (planPth == "") == (journalPth == "") {
+		logger.Fatal(restoreNoSourceLog)
+	}
+
+	e.planFile = planPth
+	e.journalFile = journalPth
+
+	logger.Info(fmt.Sprintf(restoreSourceLog, planPth+journalPth))
+}
+
+// setSysIPs sets the IPs a file's fan IP may match. override is a comma
+// separated list of IPs; if it is "" they are the IPs the hostname resolves
+// to & those of the node's interfaces, as a node may be on more than one
+// network
+func (e *env) setSysIPs(override string) error {
+	logger := e.logger
+
+	if override != "" {
+		var ips []net.IP
+
+		for _, s := range strings.Split(override, ",") {
+			ip := net.ParseIP(strings.TrimSpace(s))
+			if ip == nil {
+				return fmt.Errorf(errWrapMsg, ErrLookupIP, fmt.Sprintf(sysIPsInvalidLog, s))
+			}
+
+			ips = append(ips, ip)
+		}
+
+		e.sysIPs = ips
+
+		logger.Info(fmt.Sprintf(sysIPsFanIPLog, ips))
+
+		return nil
+	}
+
+	hostname := wrapOs(logger, osHostnameLog, os.Hostname)
+
+	ips, lookupErr := wrapLookupIP(logger, hostname, net.LookupIP)
+	if lookupErr != nil {
+		logger.Warn(fmt.Sprintf(sysIPsLookupErrLog, lookupErr))
+	}
+
+	addrs, addrsErr := wrapInterfaceAddrs(logger, net.InterfaceAddrs)
+	if addrsErr != nil {
+		if lookupErr != nil {
+			return fmt.Errorf(errWrap, lookupErr, addrsErr)
+		}
+
+		logger.Warn(fmt.Sprintf(sysIPsAddrsErrLog, addrsErr))
+	}
+
+	for _, ip := range addrs {
+		if !slices.ContainsFunc(ips, ip.Equal) {
+			ips = append(ips, ip)
+		}
+	}
+
+	if len(ips) == 0 {
+		return fmt.Errorf(errWrapMsg, ErrLookupIP, noIPLog)
+	}
+
+	e.sysIPs = ips
+
+	logger.Info(fmt.Sprintf(sysIPsLog, ips))
+
+	return nil
 }
 
 func (e *env) setPWD(ex string) string {
@@ -279,7 +719,7 @@ func (ap *asyncProcessor) setEnv(env *env) {
 }
 
 func (ap *asyncProcessor) setFiles() {
-	e = ap.env
+	e := ap.env
 	afs := e.afs
 	logger := e.logger
 
@@ -290,13 +730,28 @@ func (ap *asyncProcessor) setFiles() {
 
 	lines := parseSourceFile(e)
 
-	for _, line := range lines {
-		newFile := parseLine(line, e)
+	for i, line := range lines {
+		newFile, err := parseLine(line, e)
+		if err != nil {
+			class := classify(err)
+			ap.see(class)
+			logger.Error(fmt.Sprintf(parseLineErrLog, i+1, err, class))
+
+			if class == classAbort {
+				return
+			}
+
+			smbName, _, _ := strings.Cut(line, "|")
+			ap.unlisted = append(ap.unlisted, file{smbName: smbName, err: err, reason: errReason(err)})
+
+			continue
+		}
+
+		newFile.resumeFrom(e)
 		newFile.fileInfo, err = afs.Stat(newFile.stagingPath)
 
 		if err != nil {
-			// Need to add testing
-			logger.Error(err)
+			ap.unlist(newFile, err)
 			continue
 		}
 
@@ -310,6 +765,25 @@ func (ap *asyncProcessor) setFiles() {
 			newFile.fanIP,
 			newFile.fileInfo.Name()))
 	}
+
+	ap.orderFiles()
+}
+
+// unlist records f, whose stagingPath could not be stat'd, as unlisted. A
+// missing stagingPath, such as that of a file moved by an earlier run, is
+// skipped, while any other error fails f
+func (ap *asyncProcessor) unlist(f file, err error) {
+	if errors.Is(err, fs.ErrNotExist) {
+		f.reason = reasonNotExist
+		ap.env.logger.Warn(fmt.Sprintf(fNotListedLog, f.smbName, f.id, f.reason))
+	} else {
+		f.err = fmt.Errorf(errWrap, ErrStat, err)
+		f.reason = errReason(f.err)
+		ap.see(classify(f.err))
+		ap.env.logger.Error(fmt.Sprintf(fNotListedLog, f.smbName, f.id, f.err))
+	}
+
+	ap.unlisted = append(ap.unlisted, f)
 }
 
 func init() {
@@ -318,19 +792,123 @@ func init() {
 		os.Args = append(os.Args, "--help")
 	}
 
-	// Get pointer to new Env
-	e = new(env)
-
 	log.Init()
 
-	// Set logger
-	e.logger = log.GetLogger()
-
 	flag.StringVar(&sourceFile, sourceFileArgTxt, "", sourceFileArgHelp)
 	flag.StringVar(&datasetID, datasetIDArgTxt, "", datasetIDArgHelp)
 	flag.Int64Var(&numDays, timelimitArgTxt, 0, timelimitArgHelp)
 	flag.BoolVar(&dryrun, dryrunArgTxt, true, dryrunArgHelp)
 	flag.BoolVar(&testrun, testrunArgTxt, false, testrunArgHelp)
+	flag.IntVar(&workers, workersArgTxt, 1, workersArgHelp)
+	flag.IntVar(&mountWorkers, mountWorkersArgTxt, 1, mountWorkersArgHelp)
+	flag.Int64Var(&hashRate, hashRateArgTxt, 0, hashRateArgHelp)
+	flag.StringVar(&hashAlgo, hashAlgoArgTxt, hashSHA256, hashAlgoArgHelp)
+	flag.BoolVar(&paranoid, paranoidArgTxt, false, paranoidArgHelp)
+	flag.StringVar(&mappingFile, mappingArgTxt, "", mappingArgHelp)
+	flag.BoolVar(&printMapping, printMappingArgTxt, false, printMappingArgHelp)
+	flag.StringVar(&collision, collisionArgTxt, collisionFail, collisionArgHelp)
+	flag.StringVar(&planFile, planArgTxt, "", planArgHelp)
+	flag.StringVar(&journalFile, journalArgTxt, "", journalArgHelp)
+	flag.BoolVar(&resume, resumeArgTxt, false, resumeArgHelp)
+	flag.StringVar(&reportFile, reportArgTxt, "", reportArgHelp)
+	flag.StringVar(&exportFile, exportArgTxt, "", exportArgHelp)
+	flag.StringVar(&outDir, outDirArgTxt, "", outDirArgHelp)
+	flag.StringVar(&inventoryFile, inventoryArgTxt, "", inventoryArgHelp)
+	flag.StringVar(&order, orderArgTxt, orderInput, orderArgHelp)
+	flag.IntVar(&maxFiles, maxFilesArgTxt, 0, maxFilesArgHelp)
+	flag.Int64Var(&maxBytes, maxBytesArgTxt, 0, maxBytesArgHelp)
+	flag.StringVar(&gbrPath, gbrPathArgTxt, defaultGbrPath, gbrPathArgHelp)
+	flag.DurationVar(&gbrTimeout, gbrTimeoutArgTxt, time.Minute, gbrTimeoutArgHelp)
+	flag.DurationVar(&gbrCacheTTL, gbrCacheTTLArgTxt, 10*time.Minute, gbrCacheTTLArgHelp)
+	flag.IntVar(&gbrConc, gbrConcurrencyArgTxt, 4, gbrConcurrencyArgHelp)
+	flag.Int64Var(&gbrRate, gbrRateArgTxt, 0, gbrRateArgHelp)
+	flag.IntVar(&gbrRetries, gbrRetriesArgTxt, 2, gbrRetriesArgHelp)
+	flag.DurationVar(&gbrBackoff, gbrBackoffArgTxt, time.Second, gbrBackoffArgHelp)
+	flag.StringVar(&datasetName, datasetNameArgTxt, "", datasetNameArgHelp)
+	flag.StringVar(&resolver, datasetResolverArgTxt, resolverCqlsh, datasetResolverHelp)
+	flag.StringVar(&cqlshPath, cqlshPathArgTxt, defaultCqlshPath, cqlshPathArgHelp)
+	flag.StringVar(&cqlshHost, cqlshHostArgTxt, "", cqlshHostArgHelp)
+	flag.IntVar(&cqlshPort, cqlshPortArgTxt, defaultCqlshPort, cqlshPortArgHelp)
+	flag.StringVar(&fanIP, fanIPArgTxt, "", fanIPArgHelp)
+
+	flag.Usage = usage
+}
+
+func main() {
+	// Strip the command so the flags after it parse as usual
+	cmd := parseCommand()
+
+	// Parse flags
+	flag.Parse()
+
+	e := newEnv()
+
+	os.Exit(commands[cmd](e, NewAsyncProcessor(e, []file{})))
+}
+
+const (
+	planCmd    = "plan"
+	applyCmd   = "apply"
+	restoreCmd = "restore"
+	cleanseCmd = "cleanse"
+	splitCmd   = "split"
+)
+
+// commands maps the optional first argument to what it runs. Without one, the
+// files in sourcefile are verified & moved in one go. Each returns the exit
+// code for the worst errClass seen
+var commands = map[string]func(*env, AsyncProcessor) int{
+	"":         run,
+	planCmd:    runPlan,
+	applyCmd:   runApply,
+	restoreCmd: runRestore,
+	cleanseCmd: runCleanse,
+	splitCmd:   runSplit,
+}
+
+// parseCommand removes a known command from os.Args[1] & returns it, or ""
+// if there is none
+func parseCommand() string {
+	if len(os.Args) < 2 || os.Args[1] == "" {
+		return ""
+	}
+
+	cmd := os.Args[1]
+	if _, ok := commands[cmd]; !ok {
+		return ""
+	}
+
+	os.Args = append(os.Args[:1], os.Args[2:]...)
+
+	return cmd
+}
+
+// commandNames returns the named commands in a stable order
+func commandNames() []string {
+	var names []string
+
+	for name := range commands {
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(), usageLog, os.Args[0], strings.Join(commandNames(), "|"))
+	flag.PrintDefaults()
+}
+
+// newEnv returns a pointer to a new env rooted at the executable's filesystem
+func newEnv() *env {
+	e := new(env)
+
+	// Set logger
+	e.logger = log.GetLogger()
 
 	// Get executable path
 	e.exePath = wrapOs(e.logger, osExecutableLog, os.Executable)
@@ -341,31 +919,189 @@ func init() {
 	e.fsys = os.DirFS(root)
 	e.afs = afero.NewOsFs()
 
-	ap = NewAsyncProcessor(e, files)
-}
+	e.setGBR(gbrPath, gbrTimeout)
+	e.setGBRCache(gbrCacheTTL, gbrConc, gbrRate, gbrRetries, gbrBackoff)
 
-func main() {
-	// Parse flags
-	flag.Parse()
+	return e
+}
 
+// run applies the parsed flags to e & processes the files with ap
+func run(e *env, ap AsyncProcessor) int {
 	if e.setTestRun(testrun) {
 		ap = testIntegrationTestSetup
 	}
 
-	e.setSourceFile(e.exePath, sourceFile)
-	e.setDatasetID(datasetID)
+	e.must(e.setSourceFile(e.exePath, sourceFile))
+
+	if printMapping {
+		e.setMapping(mappingFile)
+		e.printMapping(os.Stdout)
+
+		return exitOK
+	}
+
+	e.must(e.setSysIPs(fanIP))
+	e.must(e.setDatasetResolver(resolver, cqlshPath, cqlshHost, cqlshPort, gbrTimeout))
+	e.must(e.setDataset(datasetID, datasetName))
 	e.setTimeLimit(numDays)
 	e.setDryRun(dryrun)
+	e.setOptions()
+	e.setJournal(journalFile, resume)
+	e.setReport(reportFile)
+	e.setOrder(order)
+	e.setLimits(maxFiles, maxBytes)
+
+	e.must(e.verifyDataset())
+
+	ap.setFiles()
+
+	ap.processFiles()
 
-	e.setSysIP()
+	e.closeJournal()
 
-	e.verifyDataset()
+	ap.printSummary(os.Stdout)
+	ap.writeReport()
+
+	return ap.exitCode()
+}
+
+// runPlan verifies & hashes the files in sourcefile & writes what apply
+// would do to -plan. Nothing is moved
+func runPlan(e *env, ap AsyncProcessor) int {
+	e.logger.Info(fmt.Sprintf(commandLog, planCmd))
+
+	if e.setTestRun(testrun) {
+		ap = testIntegrationTestSetup
+	}
+
+	e.must(e.setSourceFile(e.exePath, sourceFile))
+	e.must(e.setSysIPs(fanIP))
+	e.must(e.setDatasetResolver(resolver, cqlshPath, cqlshHost, cqlshPort, gbrTimeout))
+	e.must(e.setDataset(datasetID, datasetName))
+	e.setTimeLimit(numDays)
+	e.setPlanFile(planFile)
+	e.setOptions()
+	e.setReport(reportFile)
+	e.setOrder(order)
+	e.setLimits(maxFiles, maxBytes)
+
+	e.must(e.verifyDataset())
 
 	ap.setFiles()
 
-	// verify here?
-	// add check for dryrun
+	ap.planFiles()
+
+	ap.printSummary(os.Stdout)
+	ap.writeReport()
+
+	return ap.exitCode()
+}
+
+// runApply re-verifies the files in -plan & moves each one exactly as planned
+// unless it has changed since
+func runApply(e *env, ap AsyncProcessor) int {
+	e.logger.Info(fmt.Sprintf(commandLog, applyCmd))
+
+	if e.setTestRun(testrun) {
+		ap = testIntegrationTestSetup
+	}
+
+	e.setPlanFile(planFile)
+	e.setDryRun(dryrun)
+	e.setOptions()
+	e.setJournal(journalFile, resume)
+	e.setReport(reportFile)
+	e.must(e.setSysIPs(fanIP))
+	e.must(e.setDatasetResolver(resolver, cqlshPath, cqlshHost, cqlshPort, gbrTimeout))
+
+	ap.loadPlan()
+
+	e.must(e.verifyDataset())
+
 	ap.processFiles()
+
+	e.closeJournal()
+
+	ap.printSummary(os.Stdout)
+	ap.writeReport()
+
+	return ap.exitCode()
+}
+
+// runRestore moves the files recorded in -plan or -journal back to where they
+// were moved from, once their hashes are checked
+func runRestore(e *env, ap AsyncProcessor) int {
+	e.logger.Info(fmt.Sprintf(commandLog, restoreCmd))
+
+	if e.setTestRun(testrun) {
+		ap = testIntegrationTestSetup
+	}
+
+	e.setDryRun(dryrun)
+	e.setOptions()
+	e.setRestoreSource(planFile, journalFile)
+	e.setReport(reportFile)
+
+	ap.loadRestore()
+
+	ap.restoreFiles()
+
+	ap.printSummary(os.Stdout)
+	ap.writeReport()
+
+	return ap.exitCode()
+}
+
+// must aborts the run if err is not nil. It is for errors before any file is
+// processed, which leave nothing to skip or retry
+func (e *env) must(err error) {
+	if err != nil {
+		e.logger.Fatal(err)
+	}
+}
+
+// see records that an error of class was seen
+func (ap *asyncProcessor) see(class errClass) {
+	ap.mu.Lock()
+	defer ap.mu.Unlock()
+
+	ap.worst = max(ap.worst, class)
+}
+
+// aborted reports whether an error has aborted the run
+func (ap *asyncProcessor) aborted() bool {
+	ap.mu.Lock()
+	defer ap.mu.Unlock()
+
+	return ap.worst == classAbort
+}
+
+// exitCode returns the exit code for the worst errClass seen
+func (ap *asyncProcessor) exitCode() int {
+	ap.mu.Lock()
+	defer ap.mu.Unlock()
+
+	ap.env.logger.Info(fmt.Sprintf(exitCodeLog, ap.worst, ap.worst.exitCode()))
+
+	return ap.worst.exitCode()
+}
+
+func (e *env) closeJournal() {
+	err := e.journal.close()
+	if err != nil {
+		e.logger.Error(err)
+	}
+}
+
+// setOptions applies the flags that tune how files are processed
+func (e *env) setOptions() {
+	e.setWorkers(workers)
+	e.setMountWorkers(mountWorkers)
+	e.setHashRate(hashRate)
+	e.setHashAlgo(hashAlgo)
+	e.setParanoid(paranoid)
+	e.setMapping(mappingFile)
+	e.setCollision(collision)
 }
 
 func wrapOs(logger *logrus.Logger, wrapped string, f func() (string, error)) string {
@@ -379,16 +1115,39 @@ func wrapOs(logger *logrus.Logger, wrapped string, f func() (string, error)) str
 	return out
 }
 
-func wrapLookupIP(logger *logrus.Logger, hostname string, f func(string) ([]net.IP, error)) net.IP {
+func wrapLookupIP(logger *logrus.Logger, hostname string, f func(string) ([]net.IP, error)) ([]net.IP, error) {
 	ips, err := f(hostname)
 	if err != nil {
-		logger.Fatal(err)
-	} else if len(ips) > 1 {
-		logger.Fatal(complexIPLog)
+		return nil, fmt.Errorf(errWrap, ErrLookupIP, err)
+	} else if len(ips) == 0 {
+		return nil, fmt.Errorf(errWrapMsg, ErrLookupIP, noIPLog)
+	}
+
+	logger.Info(fmt.Sprintf(wrapLookupIPLog, hostname, ips))
+
+	return ips, nil
+}
+
+// wrapInterfaceAddrs returns the IPs of the node's interfaces, leaving out
+// loopback & link local addresses, which a fan IP cannot be
+func wrapInterfaceAddrs(logger *logrus.Logger, f func() ([]net.Addr, error)) ([]net.IP, error) {
+	addrs, err := f()
+	if err != nil {
+		return nil, fmt.Errorf(errWrap, ErrLookupIP, err)
+	}
+
+	var ips []net.IP
+
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || ipNet.IP.IsLoopback() || ipNet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+
+		ips = append(ips, ipNet.IP)
 	}
 
-	ip := ips[0]
-	logger.Info(fmt.Sprintf(wrapLookupIPLog, hostname, ip.String()))
+	logger.Info(fmt.Sprintf(wrapInterfaceAddrsLog, ips))
 
-	return ip
+	return ips, nil
 }
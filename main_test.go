@@ -2,6 +2,7 @@ package main
 
 import (
 	"errors"
+	"flag"
 	"fmt"
 	"io/fs"
 	"net"
@@ -37,6 +38,7 @@ const (
 	testArgsSourceFile = "-sourcefile=%vtest.file"
 	testArgsDataset    = "-datasetid=%v"
 	testArgsDays       = "-days=123"
+	testArgsResolver   = "-dataset-resolver=gbr"
 	testArgsHelp       = "-help"
 
 	testPostArgsSourceFile = "%vtest.file"
@@ -80,9 +82,6 @@ var (
 )
 
 func TestMainFunc(t *testing.T) {
-	//files := &[]File{}
-	//e = new(env)
-	//ap = NewAsyncProcessor(e, files)
 	t.Run("verify main args work", func(t *testing.T) {
 		afs, files := createAferoTest(t, 5, true)
 		hostname, _ := os.Hostname()
@@ -92,6 +91,8 @@ func TestMainFunc(t *testing.T) {
 		os.Args = append(os.Args, fmt.Sprintf(testArgsSourceFile, workdir))
 		os.Args = append(os.Args, fmt.Sprintf(testArgsDataset, testDatasetID))
 		os.Args = append(os.Args, testArgsDays)
+		// The test gbr client stands in for the metadata service
+		os.Args = append(os.Args, testArgsResolver)
 
 		now = time.Now()
 		limit = now.Add(-24 * time.Duration(testPostArgsDays) * time.Hour)
@@ -99,10 +100,11 @@ func TestMainFunc(t *testing.T) {
 		dryrun = true
 		testrun = false
 
-		e = new(env)
+		e := new(env)
 		e.logger, hook = setupLogs()
 		e.afs = afs
 		e.fsys = os.DirFS("/")
+		e.gbr = testGBR
 		//e.sourceFile = sourceFile
 		/* e = &env{
 			logger: testLogger,
@@ -117,12 +119,13 @@ func TestMainFunc(t *testing.T) {
 			//testrun:    false,
 		} */
 
-		ap = mockAsyncProcessor{
+		ap := mockAsyncProcessor{
 			env:   e,
 			files: files,
 		}
 
-		main()
+		flag.Parse()
+		run(e, ap)
 
 		gotLogMsg := hook.LastEntry().Message
 		wantLogMsg := fmt.Sprintf(eMatchAsyncProcessedDSTrueLog, e.datasetID, testDatasetID)
@@ -135,7 +138,7 @@ func TestMainFunc(t *testing.T) {
 		}
 		defer f.Close()
 
-		assert.Equal(t, e.sysIP, ips[0])
+		assert.Contains(t, e.sysIPs, ips[0])
 
 		_, err = f.Stat()
 		assert.NoError(t, err)
@@ -192,15 +195,15 @@ func TestMainFunc(t *testing.T) {
 func TestNewAsyncProcessor(t *testing.T) {
 	t.Run("should return the ap", func(t *testing.T) {
 		testLogger, _ = setupLogs()
-		e = new(env)
+		e := new(env)
 		e.logger = testLogger
-		files = []file{}
+		files := []file{}
 		f := file{
 			smbName:     testName,
 			stagingPath: testStagingPath,
 		}
 		files = append(files, f)
-		ap = NewAsyncProcessor(e, files)
+		ap := NewAsyncProcessor(e, files)
 		ap = mockAsyncProcessor{
 			env:   e,
 			files: files,
@@ -292,29 +295,23 @@ func TestOsWrapper(t *testing.T) {
 }
 
 func TestWrapLookupIP(t *testing.T) {
-	t.Run("wrapLookupIP should return & log the IP", func(t *testing.T) {
+	t.Run("wrapLookupIP should return & log the IPs", func(t *testing.T) {
 		testLogger, hook = setupLogs()
 
 		hostname, _ := os.Hostname()
 		ips, _ := net.LookupIP(hostname)
 
-		ip := wrapLookupIP(testLogger, hostname, net.LookupIP)
+		got, err := wrapLookupIP(testLogger, hostname, net.LookupIP)
+		assert.NoError(t, err)
 
-		assertCorrectString(t, ip.String(), ips[0].String())
+		assert.Equal(t, ips, got)
 
 		gotLogMsg := hook.LastEntry().Message
-		wantLogMsg := fmt.Sprintf(wrapLookupIPLog, hostname, ip)
+		wantLogMsg := fmt.Sprintf(wrapLookupIPLog, hostname, got)
 		assertCorrectString(t, gotLogMsg, wantLogMsg)
 	})
 
-	t.Run("wrapLookupIP should panic & log the err on err", func(t *testing.T) {
-		fakeExit := func(int) {
-			panic(osPanicTrue)
-		}
-
-		patch := monkey.Patch(os.Exit, fakeExit)
-		defer patch.Unpatch()
-
+	t.Run("wrapLookupIP should return ErrLookupIP on err", func(t *testing.T) {
 		fakeLookupIP := func(string) ([]net.IP, error) {
 			err := errors.New(testLookupIPErr)
 			return nil, err
@@ -326,22 +323,13 @@ func TestWrapLookupIP(t *testing.T) {
 		hostname, _ := os.Hostname()
 
 		testLogger, hook = setupLogs()
-		panicFunc := func() { wrapLookupIP(testLogger, hostname, net.LookupIP) }
-		assert.PanicsWithValue(t, osPanicTrue, panicFunc, osPanicFalse)
 
-		gotLogMsg := hook.LastEntry().Message
-		wantLogMsg := testLookupIPErr
-		assertCorrectString(t, gotLogMsg, wantLogMsg)
+		_, err := wrapLookupIP(testLogger, hostname, net.LookupIP)
+		assert.ErrorIs(t, err, ErrLookupIP)
+		assert.ErrorContains(t, err, testLookupIPErr)
 	})
 
-	t.Run("wrapLookupIP should panic & log an err if there are more than one IP", func(t *testing.T) {
-		fakeExit := func(int) {
-			panic(osPanicTrue)
-		}
-
-		patch := monkey.Patch(os.Exit, fakeExit)
-		defer patch.Unpatch()
-
+	t.Run("wrapLookupIP should return every IP if there are more than one", func(t *testing.T) {
 		fakeLookupIP := func(string) ([]net.IP, error) {
 			var ips []net.IP
 
@@ -360,17 +348,65 @@ func TestWrapLookupIP(t *testing.T) {
 		hostname, _ := os.Hostname()
 
 		testLogger, hook = setupLogs()
-		panicFunc := func() { wrapLookupIP(testLogger, hostname, net.LookupIP) }
-		assert.PanicsWithValue(t, osPanicTrue, panicFunc, osPanicFalse)
+
+		got, err := wrapLookupIP(testLogger, hostname, net.LookupIP)
+		assert.NoError(t, err)
+		assert.Equal(t, []net.IP{net.ParseIP("192.168.101.1"), net.ParseIP("192.168.101.2")}, got)
+	})
+
+	t.Run("wrapLookupIP should return ErrLookupIP if there are no IPs", func(t *testing.T) {
+		fakeLookupIP := func(string) ([]net.IP, error) {
+			return nil, nil
+		}
+
+		testLogger, _ = setupLogs()
+
+		_, err := wrapLookupIP(testLogger, testName, fakeLookupIP)
+		assert.ErrorIs(t, err, ErrLookupIP)
+		assert.ErrorContains(t, err, noIPLog)
+	})
+}
+
+func TestWrapInterfaceAddrs(t *testing.T) {
+	t.Run("should skip loopback, link local & non IP addresses", func(t *testing.T) {
+		fakeInterfaceAddrs := func() ([]net.Addr, error) {
+			return []net.Addr{
+				&net.IPNet{IP: net.ParseIP("127.0.0.1")},
+				&net.IPNet{IP: net.ParseIP("fe80::1")},
+				&net.IPNet{IP: net.ParseIP(testIP)},
+				&net.UnixAddr{Name: testName},
+				&net.IPNet{IP: net.ParseIP("10.0.0.5")},
+			}, nil
+		}
+
+		testLogger, hook = setupLogs()
+
+		got, err := wrapInterfaceAddrs(testLogger, fakeInterfaceAddrs)
+		assert.NoError(t, err)
+
+		want := []net.IP{net.ParseIP(testIP), net.ParseIP("10.0.0.5")}
+		assert.Equal(t, want, got)
 
 		gotLogMsg := hook.LastEntry().Message
-		wantLogMsg := complexIPLog
+		wantLogMsg := fmt.Sprintf(wrapInterfaceAddrsLog, want)
 		assertCorrectString(t, gotLogMsg, wantLogMsg)
 	})
+
+	t.Run("should return ErrLookupIP on err", func(t *testing.T) {
+		fakeInterfaceAddrs := func() ([]net.Addr, error) {
+			return nil, errors.New(testName)
+		}
+
+		testLogger, _ = setupLogs()
+
+		_, err := wrapInterfaceAddrs(testLogger, fakeInterfaceAddrs)
+		assert.ErrorIs(t, err, ErrLookupIP)
+		assert.ErrorContains(t, err, testName)
+	})
 }
 
 func TestSetSourceFile(t *testing.T) {
-	e = new(env)
+	e := new(env)
 
 	t.Run("check for source file", func(t *testing.T) {
 		e.logger, hook = setupLogs()
@@ -379,7 +415,7 @@ func TestSetSourceFile(t *testing.T) {
 		}
 		files := []file{}
 		NewAsyncProcessor(e, files)
-		e.setSourceFile("", testPath)
+		assert.NoError(t, e.setSourceFile("", testPath))
 
 		got := e.sourceFile
 		want := testPath
@@ -398,7 +434,7 @@ func TestSetSourceFile(t *testing.T) {
 		fullpath := string(os.PathSeparator) + testPath
 		files := []file{}
 		NewAsyncProcessor(e, files)
-		e.setSourceFile("", string(os.PathSeparator)+testPath)
+		assert.NoError(t, e.setSourceFile("", string(os.PathSeparator)+testPath))
 
 		got := e.sourceFile
 		want := string(os.PathSeparator) + testPath
@@ -420,7 +456,7 @@ func TestSetSourceFile(t *testing.T) {
 		}
 		files := []file{}
 		NewAsyncProcessor(e, files)
-		e.setSourceFile(ex, testName)
+		assert.NoError(t, e.setSourceFile(ex, testName))
 
 		got := e.sourceFile
 		want := testName
@@ -431,37 +467,16 @@ func TestSetSourceFile(t *testing.T) {
 		assertCorrectString(t, gotLogMsg, wantLogMsg)
 	})
 	t.Run("check for empty root", func(t *testing.T) {
-		fakeExit := func(int) {
-			panic(osPanicTrue)
-		}
-
-		patch := monkey.Patch(os.Exit, fakeExit)
-		defer patch.Unpatch()
-
 		e.logger, hook = setupLogs()
 		e.fsys = os.DirFS("")
 		files := []file{}
 		NewAsyncProcessor(e, files)
 
-		panicFunc := func() {
-			e.setSourceFile("/", testDoesNotExistFile)
-		}
-
-		assert.PanicsWithValue(t, osPanicTrue, panicFunc, osPanicFalse)
-
-		gotLogMsg := hook.LastEntry().Message
-		wantLogMsg := fmt.Sprintf(testEmptyRootErr, testDoesNotExistFile)
-
-		assertCorrectString(t, gotLogMsg, wantLogMsg)
+		err := e.setSourceFile("/", testDoesNotExistFile)
+		assert.ErrorIs(t, err, ErrSourceFile)
+		assert.ErrorContains(t, err, fmt.Sprintf(testEmptyRootErr, testDoesNotExistFile))
 	})
 	t.Run("error if file does not exist", func(t *testing.T) {
-		fakeExit := func(int) {
-			panic(osPanicTrue)
-		}
-
-		patch := monkey.Patch(os.Exit, fakeExit)
-		defer patch.Unpatch()
-
 		e.logger, hook = setupLogs()
 		e.fsys = fstest.MapFS{
 			testMismatchPath: &fstest.MapFile{Data: []byte(testContent)},
@@ -469,23 +484,16 @@ func TestSetSourceFile(t *testing.T) {
 		files := []file{}
 		NewAsyncProcessor(e, files)
 
-		panicFunc := func() {
-			e.setSourceFile("/", testDoesNotExistFile)
-		}
-
-		assert.PanicsWithValue(t, osPanicTrue, panicFunc, osPanicFalse)
-
-		gotLogMsg := hook.LastEntry().Message
-		wantLogMsg := fmt.Sprintf(testOpenDoesNotExistErr, testDoesNotExistFile)
-
-		assertCorrectString(t, gotLogMsg, wantLogMsg)
+		err := e.setSourceFile("/", testDoesNotExistFile)
+		assert.ErrorIs(t, err, ErrSourceFile)
+		assert.ErrorContains(t, err, fmt.Sprintf(testOpenDoesNotExistErr, testDoesNotExistFile))
 	})
 }
 
 func TestGetFiles(t *testing.T) {
 	files := []file{}
-	e = new(env)
-	ap = NewAsyncProcessor(e, files)
+	e := new(env)
+	ap := NewAsyncProcessor(e, files)
 
 	t.Run("ap.getFiles returns ap.Files", func(t *testing.T) {
 		got := ap.getFiles()
@@ -495,7 +503,7 @@ func TestGetFiles(t *testing.T) {
 }
 
 func TestSetFiles(t *testing.T) {
-	e = new(env)
+	e := new(env)
 
 	t.Run("ap.setFiles should return a list of files", func(t *testing.T) {
 		e.logger, hook = setupLogs()
@@ -550,6 +558,85 @@ func TestSetFiles(t *testing.T) {
 
 		assertCorrectString(t, gotLogMsg, wantLogMsg)
 	})
+	t.Run("ap.setFiles should skip a line that does not parse", func(t *testing.T) {
+		e.logger, hook = setupLogs()
+
+		afs, want := createAferoTest(t, 2, true)
+		ap := NewAsyncProcessor(e, []file{})
+
+		e.afs = afs
+		e.sourceFile = fmt.Sprintf(testSourceFile, getWorkDir())
+
+		sf, err := afs.OpenFile(e.sourceFile, os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = sf.WriteString(testSmbName + "|" + testStagingPath + "\n")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sf.Close()
+
+		ap.setFiles()
+
+		assert.Len(t, ap.getFiles(), len(want))
+		assert.Equal(t, exitSkipped, ap.exitCode())
+
+		ap.(*asyncProcessor).collect(statusMoved)
+		r := ap.getResults()[len(want)]
+		assertCorrectString(t, r.SmbName, testSmbName)
+		assertCorrectString(t, r.Status, statusFailed)
+		assertCorrectString(t, r.Reason, reasonParseErr)
+	})
+	t.Run("ap.setFiles should report a file whose stagingPath does not exist as skipped", func(t *testing.T) {
+		e.logger, hook = setupLogs()
+
+		afs, want := createAferoTest(t, 2, true)
+		ap := NewAsyncProcessor(e, []file{})
+
+		e.afs = afs
+		e.sourceFile = fmt.Sprintf(testSourceFile, getWorkDir())
+
+		err := afs.Remove(want[1].stagingPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ap.setFiles()
+
+		assert.Len(t, ap.getFiles(), 1)
+		assert.Equal(t, exitOK, ap.exitCode())
+
+		gotLogMsg := hook.Entries[len(hook.Entries)-2].Message
+		wantLogMsg := fmt.Sprintf(fNotListedLog, want[1].smbName, want[1].id, reasonNotExist)
+		assertCorrectString(t, gotLogMsg, wantLogMsg)
+
+		ap.(*asyncProcessor).collect(statusMoved)
+		r := ap.getResults()[1]
+		assertCorrectString(t, r.ID, want[1].id)
+		assertCorrectString(t, r.Status, statusSkipped)
+		assertCorrectString(t, r.Reason, reasonNotExist)
+	})
+	t.Run("ap.setFiles should report a file whose stagingPath cannot be checked as failed", func(t *testing.T) {
+		e.logger, hook = setupLogs()
+
+		afs, want := createAferoTest(t, 1, true)
+		ap := NewAsyncProcessor(e, []file{}).(*asyncProcessor)
+
+		e.afs = afs
+		e.sourceFile = fmt.Sprintf(testSourceFile, getWorkDir())
+
+		ap.unlist(want[0], fs.ErrPermission)
+
+		assert.Equal(t, exitSkipped, ap.exitCode())
+		assert.ErrorIs(t, ap.unlisted[0].err, ErrStat)
+
+		ap.collect(statusMoved)
+		assertCorrectString(t, ap.getResults()[0].Status, statusFailed)
+		assertCorrectString(t, ap.getResults()[0].Reason, reasonStatErr)
+	})
 	t.Run("ap.setFiles should fatal if sourcefile does not exist", func(t *testing.T) {
 		fakeExit := func(int) {
 			panic(osPanicTrue)
@@ -579,8 +666,8 @@ func TestSetFiles(t *testing.T) {
 
 func TestSetEnv(t *testing.T) {
 	files := []file{}
-	e = new(env)
-	ap = NewAsyncProcessor(e, files)
+	e := new(env)
+	ap := NewAsyncProcessor(e, files)
 
 	t.Run("ap.setEnv should set env", func(t *testing.T) {
 		exePath := "/"
@@ -589,8 +676,8 @@ func TestSetEnv(t *testing.T) {
 			logger:     testLogger,
 			exePath:    exePath,
 			fsys:       fsys,
-			afs:        afs,
-			sysIP:      sysIP,
+			afs:        afero.NewMemMapFs(),
+			sysIPs:     []net.IP{sysIP},
 			sourceFile: sourceFile,
 			datasetID:  datasetID,
 			limit:      limit,
@@ -606,13 +693,13 @@ func TestSetEnv(t *testing.T) {
 
 func TestSetDatasetID(t *testing.T) {
 	files := []file{}
-	e = new(env)
-	e.afs = afs
+	e := new(env)
+	e.gbr = testGBR
 	ap := NewAsyncProcessor(e, files)
 
 	t.Run("verify it returns the right dataset id", func(t *testing.T) {
 		e.logger, _ = setupLogs()
-		e.setDatasetID(testDatasetID)
+		assert.NoError(t, e.setDatasetID(testDatasetID))
 
 		got := ap.getEnv().datasetID
 		want := testDatasetID
@@ -623,7 +710,7 @@ func TestSetDatasetID(t *testing.T) {
 	t.Run("verify it logs the right dataset id", func(t *testing.T) {
 		e.logger, hook = setupLogs()
 
-		e.setDatasetID(testDatasetID)
+		assert.NoError(t, e.setDatasetID(testDatasetID))
 
 		gotLogMsg := hook.LastEntry().Message
 		wantLogMsg := fmt.Sprintf(datasetLog, testDatasetID)
@@ -631,109 +718,63 @@ func TestSetDatasetID(t *testing.T) {
 		assertCorrectString(t, gotLogMsg, wantLogMsg)
 	})
 
-	t.Run("verify that it exits if the datasetid is not the right format", func(t *testing.T) {
-		fakeExit := func(int) {
-			panic(osPanicTrue)
-		}
-
-		patch := monkey.Patch(os.Exit, fakeExit)
-		defer patch.Unpatch()
-
+	t.Run("verify that it errors if the datasetid is not the right format", func(t *testing.T) {
 		e.logger, hook = setupLogs()
 
-		panicFunc := func() { e.setDatasetID(testNotADataset) }
-
-		assert.PanicsWithValue(t, osPanicTrue, panicFunc, osPanicFalse)
-
-		gotLogMsg := hook.LastEntry().Message
-		err := fmt.Sprintf(datasetRegexLog, testNotADataset, regexDatasetMatch)
-		wantLogMsg := err
-
-		assertCorrectString(t, gotLogMsg, wantLogMsg)
+		err := e.setDatasetID(testNotADataset)
+		assert.ErrorIs(t, err, ErrDataset)
+		assert.ErrorContains(t, err, fmt.Sprintf(datasetRegexLog, testNotADataset, regexDatasetMatch))
 	})
 
-	t.Run("verify that it exits if the regex fails", func(t *testing.T) {
-		fakeExit := func(int) {
-			panic(osPanicTrue)
-		}
-
-		patch := monkey.Patch(os.Exit, fakeExit)
-		defer patch.Unpatch()
-
+	t.Run("verify that it errors if the regex fails", func(t *testing.T) {
 		fakeRegexMatch := func(string, string) (bool, error) {
 			err := errors.New(testRegexMatchErr)
 			return false, err
 		}
 
-		patch2 := monkey.Patch(regexp.MatchString, fakeRegexMatch)
-		defer patch2.Unpatch()
+		patch := monkey.Patch(regexp.MatchString, fakeRegexMatch)
+		defer patch.Unpatch()
 
 		e.logger, hook = setupLogs()
-		panicFunc := func() { e.setDatasetID(testNotADataset) }
 
-		assert.PanicsWithValue(t, osPanicTrue, panicFunc, osPanicFalse)
-
-		gotLogMsg := hook.LastEntry().Message
-		err := testRegexMatchErr
-		wantLogMsg := err
-
-		assertCorrectString(t, gotLogMsg, wantLogMsg)
+		err := e.setDatasetID(testNotADataset)
+		assert.EqualError(t, err, testRegexMatchErr)
 	})
-	t.Run("verify that it exits if the dataset doesn't match asyncprocessed", func(t *testing.T) {
-		fakeExit := func(int) {
-			panic(osPanicTrue)
-		}
-
-		patch := monkey.Patch(os.Exit, fakeExit)
-		defer patch.Unpatch()
-
+	t.Run("verify that it errors if the dataset doesn't match asyncprocessed", func(t *testing.T) {
 		e.logger, hook = setupLogs()
-		panicFunc := func() { e.setDatasetID(testID) }
-
-		assert.PanicsWithValue(t, osPanicTrue, panicFunc, osPanicFalse)
-
-		gotLogMsg := hook.LastEntry().Message
-		wantLogMsg := fmt.Sprintf(compareDatasetIDNotMatchLog, testID, testDatasetID)
 
-		assertCorrectString(t, gotLogMsg, wantLogMsg)
+		err := e.setDatasetID(testID)
+		assert.ErrorIs(t, err, ErrDataset)
+		assert.ErrorContains(t, err, fmt.Sprintf(compareDatasetIDNotMatchLog, testID, testDatasetID))
 	})
 }
 
 func TestCompareDatasetId(t *testing.T) {
 	files := []file{}
-	e = new(env)
+	e := new(env)
+	e.gbr = testGBR
 	NewAsyncProcessor(e, files)
-	t.Run("Should return true if datasetid & asyncdelds check match & log it", func(t *testing.T) {
+	t.Run("Should return nil if datasetid & asyncdelds check match & log it", func(t *testing.T) {
 		e.logger, hook = setupLogs()
-		e.compareDatasetID(testDatasetID)
+		assert.NoError(t, e.compareDatasetID(testDatasetID))
 
 		gotLogMsg := hook.LastEntry().Message
 		wantLogMsg := fmt.Sprintf(compareDatasetIDMatchLog, testDatasetID, testDatasetID)
 
 		assertCorrectString(t, gotLogMsg, wantLogMsg)
 	})
-	t.Run("Should return false if datasetid & asyncdel metadata check do not match & log it", func(t *testing.T) {
-		fakeExit := func(int) {
-			panic(osPanicTrue)
-		}
-
-		patch := monkey.Patch(os.Exit, fakeExit)
-		defer patch.Unpatch()
-
+	t.Run("Should return ErrDataset if datasetid & asyncdel metadata check do not match", func(t *testing.T) {
 		e.logger, hook = setupLogs()
-		panicFunc := func() { e.compareDatasetID(testID) }
-		assert.PanicsWithValue(t, osPanicTrue, panicFunc, osPanicFalse)
-
-		gotLogMsg := hook.LastEntry().Message
-		wantLogMsg := fmt.Sprintf(compareDatasetIDNotMatchLog, testID, testDatasetID)
 
-		assertCorrectString(t, gotLogMsg, wantLogMsg)
+		err := e.compareDatasetID(testID)
+		assert.ErrorIs(t, err, ErrDataset)
+		assert.ErrorContains(t, err, fmt.Sprintf(compareDatasetIDNotMatchLog, testID, testDatasetID))
 	})
 }
 
 func TestSetTimeLimit(t *testing.T) {
 	files := []file{}
-	e = new(env)
+	e := new(env)
 	NewAsyncProcessor(e, files)
 	t.Run("zero days", func(t *testing.T) {
 		e.logger, hook = setupLogs()
@@ -775,7 +816,7 @@ func TestSetTimeLimit(t *testing.T) {
 
 func TestSetDryRun(t *testing.T) {
 	files := []file{}
-	e = new(env)
+	e := new(env)
 	NewAsyncProcessor(e, files)
 	t.Run("default dry run", func(t *testing.T) {
 		e.logger, hook = setupLogs()
@@ -787,6 +828,7 @@ func TestSetDryRun(t *testing.T) {
 		typ := reflect.TypeOf(e.afs)
 		rofs := new(afero.ReadOnlyFs)
 		assert.Equal(t, typ, reflect.TypeOf(rofs))
+		assert.Equal(t, reflect.TypeOf(new(afero.OsFs)), reflect.TypeOf(e.outFs))
 
 		gotLogMsg := hook.LastEntry().Message
 		wantLogMsg := dryRunTrueLog
@@ -815,7 +857,7 @@ func TestSetDryRun(t *testing.T) {
 
 func TestSetTestRun(t *testing.T) {
 	files := []file{}
-	e = new(env)
+	e := new(env)
 	NewAsyncProcessor(e, files)
 	t.Run("test run", func(t *testing.T) {
 		e.logger, hook = setupLogs()
@@ -845,26 +887,638 @@ func TestSetTestRun(t *testing.T) {
 	})
 }
 
-func TestSetSysIP(t *testing.T) {
-	e = new(env)
-	files = []file{}
+func TestSetWorkers(t *testing.T) {
+	e := new(env)
+
+	t.Run("should set e.workers & log it", func(t *testing.T) {
+		e.logger, hook = setupLogs()
+
+		e.setWorkers(4)
+
+		assert.Equal(t, 4, e.workers)
+
+		gotLogMsg := hook.LastEntry().Message
+		wantLogMsg := fmt.Sprintf(workersLog, 4)
+		assertCorrectString(t, gotLogMsg, wantLogMsg)
+	})
+
+	t.Run("should warn & set e.workers to 1 if less than 1", func(t *testing.T) {
+		e.logger, hook = setupLogs()
+
+		e.setWorkers(0)
+
+		assert.Equal(t, 1, e.workers)
+
+		gotLogMsg := hook.Entries[0].Message
+		wantLogMsg := fmt.Sprintf(workersInvalidLog, 0)
+		assertCorrectString(t, gotLogMsg, wantLogMsg)
+	})
+}
+
+func TestSetMountWorkers(t *testing.T) {
+	e := new(env)
+
+	t.Run("should set e.mountWorkers & log it", func(t *testing.T) {
+		e.logger, hook = setupLogs()
+
+		e.setMountWorkers(2)
+
+		assert.Equal(t, 2, e.mountWorkers)
+
+		gotLogMsg := hook.LastEntry().Message
+		wantLogMsg := fmt.Sprintf(mountWorkersLog, 2)
+		assertCorrectString(t, gotLogMsg, wantLogMsg)
+	})
+
+	t.Run("should warn & set e.mountWorkers to 1 if less than 1", func(t *testing.T) {
+		e.logger, hook = setupLogs()
+
+		e.setMountWorkers(-1)
+
+		assert.Equal(t, 1, e.mountWorkers)
+
+		gotLogMsg := hook.Entries[0].Message
+		wantLogMsg := fmt.Sprintf(mountWorkersInvalidLog, -1)
+		assertCorrectString(t, gotLogMsg, wantLogMsg)
+	})
+}
+
+func TestSetHashRate(t *testing.T) {
+	e := new(env)
+
+	t.Run("should set e.readLimiter & log it", func(t *testing.T) {
+		e.logger, hook = setupLogs()
+
+		e.setHashRate(100)
+
+		assert.Equal(t, int64(100*mebibyte), e.readLimiter.rate)
+
+		gotLogMsg := hook.LastEntry().Message
+		wantLogMsg := fmt.Sprintf(hashRateLog, 100)
+		assertCorrectString(t, gotLogMsg, wantLogMsg)
+	})
+
+	t.Run("should not limit reads if 0", func(t *testing.T) {
+		e.logger, hook = setupLogs()
+
+		e.setHashRate(0)
+
+		assert.Nil(t, e.readLimiter)
+
+		gotLogMsg := hook.LastEntry().Message
+		wantLogMsg := hashRateUnlimitedLog
+		assertCorrectString(t, gotLogMsg, wantLogMsg)
+	})
+}
+
+func TestSetHashAlgo(t *testing.T) {
+	e := new(env)
+
+	t.Run("should set e.hashAlgo & log it", func(t *testing.T) {
+		for _, algo := range hashNames() {
+			e.logger, hook = setupLogs()
+
+			e.setHashAlgo(algo)
+
+			assertCorrectString(t, e.hashAlgo, algo)
+
+			gotLogMsg := hook.LastEntry().Message
+			wantLogMsg := fmt.Sprintf(hashAlgoLog, algo)
+			assertCorrectString(t, gotLogMsg, wantLogMsg)
+		}
+	})
+
+	t.Run("should fatal on an unsupported algorithm", func(t *testing.T) {
+		fakeExit := func(int) {
+			panic(osPanicTrue)
+		}
+
+		patch := monkey.Patch(os.Exit, fakeExit)
+		defer patch.Unpatch()
+
+		e.logger, hook = setupLogs()
+
+		panicFunc := func() { e.setHashAlgo("sha1") }
+		assert.PanicsWithValue(t, osPanicTrue, panicFunc, osPanicFalse)
+
+		gotLogMsg := hook.LastEntry().Message
+		wantLogMsg := fmt.Sprintf(hashAlgoInvalidLog, "sha1", hashNames())
+		assertCorrectString(t, gotLogMsg, wantLogMsg)
+	})
+}
+
+func TestSetParanoid(t *testing.T) {
+	e := new(env)
+
+	t.Run("paranoid", func(t *testing.T) {
+		e.logger, hook = setupLogs()
+
+		e.setParanoid(true)
+		assert.True(t, e.paranoid)
+
+		gotLogMsg := hook.LastEntry().Message
+		wantLogMsg := paranoidTrueLog
+		assertCorrectString(t, gotLogMsg, wantLogMsg)
+	})
+
+	t.Run("nonparanoid", func(t *testing.T) {
+		e.logger, hook = setupLogs()
+
+		e.setParanoid(false)
+		assert.False(t, e.paranoid)
+
+		gotLogMsg := hook.LastEntry().Message
+		wantLogMsg := paranoidFalseLog
+		assertCorrectString(t, gotLogMsg, wantLogMsg)
+	})
+}
+
+func TestSetMapping(t *testing.T) {
+	e := new(env)
+	e.afs = afero.NewMemMapFs()
+
+	t.Run("should use the default rules if no file is set", func(t *testing.T) {
+		e.logger, hook = setupLogs()
+
+		e.setMapping("")
+		assert.Equal(t, defaultMappingRules, e.mappingRules)
+
+		gotLogMsg := hook.LastEntry().Message
+		wantLogMsg := mappingDefaultLog
+		assertCorrectString(t, gotLogMsg, wantLogMsg)
+	})
+
+	t.Run("should load rules from file", func(t *testing.T) {
+		e.logger, hook = setupLogs()
+
+		err := afero.WriteFile(e.afs, testName,
+			[]byte(`[{"prefix": "/data1/staging/", "replacement": "/data1/staging.processed/"}]`), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		e.setMapping(testName)
+		assert.Len(t, e.mappingRules, 1)
+
+		gotLogMsg := hook.LastEntry().Message
+		wantLogMsg := fmt.Sprintf(mappingLog, 1, testName)
+		assertCorrectString(t, gotLogMsg, wantLogMsg)
+	})
+
+	t.Run("should fatal on invalid rules", func(t *testing.T) {
+		fakeExit := func(int) {
+			panic(osPanicTrue)
+		}
+
+		patch := monkey.Patch(os.Exit, fakeExit)
+		defer patch.Unpatch()
+
+		e.logger, hook = setupLogs()
+
+		err := afero.WriteFile(e.afs, testName, []byte(`[]`), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		panicFunc := func() { e.setMapping(testName) }
+		assert.PanicsWithValue(t, osPanicTrue, panicFunc, osPanicFalse)
+
+		gotLogMsg := hook.LastEntry().Message
+		wantLogMsg := errMappingEmpty
+		assertCorrectString(t, gotLogMsg, wantLogMsg)
+	})
+}
+
+func TestSetCollision(t *testing.T) {
+	e := new(env)
+
+	t.Run("should set a supported policy", func(t *testing.T) {
+		for _, policy := range collisionPolicies {
+			e.logger, hook = setupLogs()
+
+			e.setCollision(policy)
+			assertCorrectString(t, e.collision, policy)
+
+			gotLogMsg := hook.LastEntry().Message
+			wantLogMsg := fmt.Sprintf(collisionLog, policy)
+			assertCorrectString(t, gotLogMsg, wantLogMsg)
+		}
+	})
+
+	t.Run("should fatal on an unsupported policy", func(t *testing.T) {
+		fakeExit := func(int) {
+			panic(osPanicTrue)
+		}
+
+		patch := monkey.Patch(os.Exit, fakeExit)
+		defer patch.Unpatch()
+
+		e.logger, hook = setupLogs()
+
+		panicFunc := func() { e.setCollision(testName) }
+		assert.PanicsWithValue(t, osPanicTrue, panicFunc, osPanicFalse)
+
+		gotLogMsg := hook.LastEntry().Message
+		wantLogMsg := fmt.Sprintf(collisionInvalidLog, testName, collisionPolicies)
+		assertCorrectString(t, gotLogMsg, wantLogMsg)
+	})
+}
+
+func TestSetPlanFile(t *testing.T) {
+	e := new(env)
+
+	t.Run("should set the plan file", func(t *testing.T) {
+		e.logger, hook = setupLogs()
+
+		e.setPlanFile(testPlanFile)
+		assertCorrectString(t, e.planFile, testPlanFile)
+
+		gotLogMsg := hook.LastEntry().Message
+		wantLogMsg := fmt.Sprintf(planFileLog, testPlanFile)
+		assertCorrectString(t, gotLogMsg, wantLogMsg)
+	})
+
+	t.Run("should fatal without a plan file", func(t *testing.T) {
+		fakeExit := func(int) {
+			panic(osPanicTrue)
+		}
+
+		patch := monkey.Patch(os.Exit, fakeExit)
+		defer patch.Unpatch()
+
+		e.logger, hook = setupLogs()
+
+		panicFunc := func() { e.setPlanFile("") }
+		assert.PanicsWithValue(t, osPanicTrue, panicFunc, osPanicFalse)
+
+		gotLogMsg := hook.LastEntry().Message
+		wantLogMsg := planFileMissingLog
+		assertCorrectString(t, gotLogMsg, wantLogMsg)
+	})
+}
+
+func TestSetRestoreSource(t *testing.T) {
+	fakeExit := func(int) {
+		panic(osPanicTrue)
+	}
+
+	sourceTests := []struct {
+		name    string
+		plan    string
+		journal string
+	}{
+		{name: "plan", plan: testPlanFile},
+		{name: "journal", journal: testJournalFile},
+	}
+
+	for _, tt := range sourceTests {
+		t.Run("should restore from a "+tt.name, func(t *testing.T) {
+			e := new(env)
+			e.logger, hook = setupLogs()
+
+			e.setRestoreSource(tt.plan, tt.journal)
+			assertCorrectString(t, e.planFile, tt.plan)
+			assertCorrectString(t, e.journalFile, tt.journal)
+
+			gotLogMsg := hook.LastEntry().Message
+			wantLogMsg := fmt.Sprintf(restoreSourceLog, tt.plan+tt.journal)
+			assertCorrectString(t, gotLogMsg, wantLogMsg)
+		})
+	}
+
+	fatalTests := []struct {
+		name    string
+		plan    string
+		journal string
+	}{
+		{name: "neither"},
+		{name: "both", plan: testPlanFile, journal: testJournalFile},
+	}
+
+	for _, tt := range fatalTests {
+		t.Run("should fatal with "+tt.name, func(t *testing.T) {
+			patch := monkey.Patch(os.Exit, fakeExit)
+			defer patch.Unpatch()
+
+			e := new(env)
+			e.logger, hook = setupLogs()
+
+			panicFunc := func() { e.setRestoreSource(tt.plan, tt.journal) }
+			assert.PanicsWithValue(t, osPanicTrue, panicFunc, osPanicFalse)
+
+			gotLogMsg := hook.LastEntry().Message
+			wantLogMsg := restoreNoSourceLog
+			assertCorrectString(t, gotLogMsg, wantLogMsg)
+		})
+	}
+}
+
+func TestParseCommand(t *testing.T) {
+	args := os.Args
+	defer func() { os.Args = args }()
+
+	commandTests := []struct {
+		name     string
+		args     []string
+		wantCmd  string
+		wantArgs []string
+	}{
+		{
+			name:     "no command",
+			args:     []string{testName, "-dryrun"},
+			wantCmd:  "",
+			wantArgs: []string{testName, "-dryrun"},
+		},
+		{
+			name:     "no args",
+			args:     []string{testName},
+			wantCmd:  "",
+			wantArgs: []string{testName},
+		},
+		{
+			name:     "plan",
+			args:     []string{testName, planCmd, "-plan=" + testPlanFile},
+			wantCmd:  planCmd,
+			wantArgs: []string{testName, "-plan=" + testPlanFile},
+		},
+		{
+			name:     "apply",
+			args:     []string{testName, applyCmd, "-plan=" + testPlanFile},
+			wantCmd:  applyCmd,
+			wantArgs: []string{testName, "-plan=" + testPlanFile},
+		},
+		{
+			name:     "restore",
+			args:     []string{testName, restoreCmd, "-journal=" + testJournalFile},
+			wantCmd:  restoreCmd,
+			wantArgs: []string{testName, "-journal=" + testJournalFile},
+		},
+		{
+			name:     "unknown command",
+			args:     []string{testName, testContent},
+			wantCmd:  "",
+			wantArgs: []string{testName, testContent},
+		},
+	}
+
+	for _, tt := range commandTests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.Args = append([]string{}, tt.args...)
+
+			assertCorrectString(t, parseCommand(), tt.wantCmd)
+			assert.Equal(t, tt.wantArgs, os.Args)
+		})
+	}
+
+	assert.Equal(t, []string{applyCmd, cleanseCmd, planCmd, restoreCmd, splitCmd}, commandNames())
+}
+
+func TestSetJournal(t *testing.T) {
+	fakeExit := func(int) {
+		panic(osPanicTrue)
+	}
+
+	t.Run("should warn without a journal", func(t *testing.T) {
+		e := new(env)
+		e.logger, hook = setupLogs()
+
+		e.setJournal("", false)
+		assert.Nil(t, e.journal)
+
+		gotLogMsg := hook.LastEntry().Message
+		wantLogMsg := journalNoneLog
+		assertCorrectString(t, gotLogMsg, wantLogMsg)
+	})
+
+	t.Run("should fatal on resume without a journal", func(t *testing.T) {
+		patch := monkey.Patch(os.Exit, fakeExit)
+		defer patch.Unpatch()
+
+		e := new(env)
+		e.logger, hook = setupLogs()
+
+		panicFunc := func() { e.setJournal("", true) }
+		assert.PanicsWithValue(t, osPanicTrue, panicFunc, osPanicFalse)
+
+		gotLogMsg := hook.LastEntry().Message
+		wantLogMsg := resumeNoJournalLog
+		assertCorrectString(t, gotLogMsg, wantLogMsg)
+	})
+
+	t.Run("should not journal a dryrun", func(t *testing.T) {
+		e := new(env)
+		e.logger, hook = setupLogs()
+		e.afs = afero.NewMemMapFs()
+		e.dryrun = true
+
+		e.setJournal(testJournalFile, false)
+		assert.Nil(t, e.journal)
+
+		gotLogMsg := hook.LastEntry().Message
+		wantLogMsg := fmt.Sprintf(journalDryRunLog, testJournalFile)
+		assertCorrectString(t, gotLogMsg, wantLogMsg)
+	})
+
+	t.Run("should warn that a dryrun does not resume", func(t *testing.T) {
+		e := new(env)
+		e.logger, hook = setupLogs()
+		e.afs = afero.NewMemMapFs()
+		e.dryrun = true
+
+		e.setJournal(testJournalFile, true)
+		assert.Nil(t, e.journal)
+		assert.Nil(t, e.resumed)
+
+		gotLogMsg := hook.LastEntry().Message
+		wantLogMsg := fmt.Sprintf(resumeDryRunLog, testJournalFile)
+		assertCorrectString(t, gotLogMsg, wantLogMsg)
+		assert.Equal(t, logrus.WarnLevel, hook.LastEntry().Level)
+	})
 
-	t.Run("Should set e.sysIP", func(t *testing.T) {
+	t.Run("should open the journal & read it on resume", func(t *testing.T) {
+		e := new(env)
+		e.logger, hook = setupLogs()
+		e.afs = afero.NewMemMapFs()
+
+		err := afero.WriteFile(e.afs, testJournalFile,
+			[]byte(`{"id":"`+testFileID+`","state":"moved"}`+"\n"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		e.setJournal(testJournalFile, true)
+		assert.NotNil(t, e.journal)
+		assert.Len(t, e.resumed, 1)
+
+		gotLogMsg := hook.Entries[0].Message
+		wantLogMsg := fmt.Sprintf(resumeLog, 1, testJournalFile)
+		assertCorrectString(t, gotLogMsg, wantLogMsg)
+
+		gotLogMsg = hook.LastEntry().Message
+		wantLogMsg = fmt.Sprintf(journalLog, testJournalFile)
+		assertCorrectString(t, gotLogMsg, wantLogMsg)
+	})
+
+	t.Run("should resume with the journal's hash algorithm", func(t *testing.T) {
+		e := new(env)
+		e.logger, hook = setupLogs()
+		e.afs = afero.NewMemMapFs()
+		e.hashAlgo = hashSHA256
+
+		err := afero.WriteFile(e.afs, testJournalFile,
+			[]byte(`{"id":"`+testFileID+`","state":"moved","hash":"00","algo":"`+hashMD5+`"}`+"\n"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		e.setJournal(testJournalFile, true)
+		assertCorrectString(t, e.hashName(), hashMD5)
+
+		gotLogMsg := hook.Entries[1].Message
+		wantLogMsg := fmt.Sprintf(resumeAlgoLog, testJournalFile, hashMD5, hashSHA256, hashMD5)
+		assertCorrectString(t, gotLogMsg, wantLogMsg)
+	})
+
+	t.Run("should fatal on resume from a journal that mixes hash algorithms", func(t *testing.T) {
+		patch := monkey.Patch(os.Exit, fakeExit)
+		defer patch.Unpatch()
+
+		e := new(env)
+		e.logger, hook = setupLogs()
+		e.afs = afero.NewMemMapFs()
+
+		err := afero.WriteFile(e.afs, testJournalFile,
+			[]byte(`{"id":"a","state":"moved","hash":"00","algo":"`+hashMD5+`"}`+"\n"+
+				`{"id":"b","state":"moved","hash":"00","algo":"`+hashSHA512+`"}`+"\n"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		panicFunc := func() { e.setJournal(testJournalFile, true) }
+		assert.PanicsWithValue(t, osPanicTrue, panicFunc, osPanicFalse)
+
+		gotLogMsg := hook.LastEntry().Message
+		wantLogMsg := fmt.Sprintf(resumeMixedAlgosLog, testJournalFile, []string{hashMD5, hashSHA512})
+		assertCorrectString(t, gotLogMsg, wantLogMsg)
+	})
+}
+
+func TestSetSysIPs(t *testing.T) {
+	t.Run("Should set e.sysIPs to the hostname's IPs first", func(t *testing.T) {
+		e := new(env)
 		e.logger, hook = setupLogs()
 		hostname, _ := os.Hostname()
 		ips, _ := net.LookupIP(hostname)
 
-		e.setSysIP()
+		assert.NoError(t, e.setSysIPs(""))
+
+		assert.Equal(t, ips, e.sysIPs[:len(ips)])
 
-		got := e.sysIP
-		want := ips[0]
-		assert.Equal(t, got, want)
+		gotLogMsg := hook.LastEntry().Message
+		wantLogMsg := fmt.Sprintf(sysIPsLog, e.sysIPs)
+		assertCorrectString(t, gotLogMsg, wantLogMsg)
+	})
+
+	t.Run("Should add interface IPs the hostname does not resolve to", func(t *testing.T) {
+		fakeLookupIP := func(string) ([]net.IP, error) {
+			return []net.IP{net.ParseIP(testIP)}, nil
+		}
+		fakeInterfaceAddrs := func() ([]net.Addr, error) {
+			return []net.Addr{
+				&net.IPNet{IP: net.ParseIP(testIP)},
+				&net.IPNet{IP: net.ParseIP("10.0.0.5")},
+			}, nil
+		}
+
+		patch := monkey.Patch(net.LookupIP, fakeLookupIP)
+		defer patch.Unpatch()
+
+		patch2 := monkey.Patch(net.InterfaceAddrs, fakeInterfaceAddrs)
+		defer patch2.Unpatch()
+
+		e := new(env)
+		e.logger, _ = setupLogs()
+
+		assert.NoError(t, e.setSysIPs(""))
+		assert.Equal(t, []net.IP{net.ParseIP(testIP), net.ParseIP("10.0.0.5")}, e.sysIPs)
+	})
+
+	t.Run("Should use interface IPs if the hostname does not resolve", func(t *testing.T) {
+		fakeLookupIP := func(string) ([]net.IP, error) {
+			return nil, errors.New(testLookupIPErr)
+		}
+		fakeInterfaceAddrs := func() ([]net.Addr, error) {
+			return []net.Addr{&net.IPNet{IP: net.ParseIP(testIP)}}, nil
+		}
+
+		patch := monkey.Patch(net.LookupIP, fakeLookupIP)
+		defer patch.Unpatch()
+
+		patch2 := monkey.Patch(net.InterfaceAddrs, fakeInterfaceAddrs)
+		defer patch2.Unpatch()
+
+		e := new(env)
+		e.logger, hook = setupLogs()
+
+		assert.NoError(t, e.setSysIPs(""))
+		assert.Equal(t, []net.IP{net.ParseIP(testIP)}, e.sysIPs)
+
+		assert.Equal(t, logrus.WarnLevel, hook.Entries[1].Level)
+		assert.Contains(t, hook.Entries[1].Message, testLookupIPErr)
+	})
+
+	t.Run("Should return ErrLookupIP if neither lookup works", func(t *testing.T) {
+		fakeLookupIP := func(string) ([]net.IP, error) {
+			return nil, errors.New(testLookupIPErr)
+		}
+		fakeInterfaceAddrs := func() ([]net.Addr, error) {
+			return nil, errors.New(testName)
+		}
+
+		patch := monkey.Patch(net.LookupIP, fakeLookupIP)
+		defer patch.Unpatch()
+
+		patch2 := monkey.Patch(net.InterfaceAddrs, fakeInterfaceAddrs)
+		defer patch2.Unpatch()
+
+		e := new(env)
+		e.logger, _ = setupLogs()
+
+		err := e.setSysIPs("")
+		assert.ErrorIs(t, err, ErrLookupIP)
+		assert.ErrorContains(t, err, testLookupIPErr)
+		assert.ErrorContains(t, err, testName)
+		assert.Empty(t, e.sysIPs)
+	})
+
+	t.Run("Should set e.sysIPs to -fan-ip", func(t *testing.T) {
+		e := new(env)
+		e.logger, hook = setupLogs()
+
+		assert.NoError(t, e.setSysIPs(testIP+", 10.0.0.5"))
+
+		want := []net.IP{net.ParseIP(testIP), net.ParseIP("10.0.0.5")}
+		assert.Equal(t, want, e.sysIPs)
+
+		gotLogMsg := hook.LastEntry().Message
+		wantLogMsg := fmt.Sprintf(sysIPsFanIPLog, want)
+		assertCorrectString(t, gotLogMsg, wantLogMsg)
+	})
+
+	t.Run("Should return ErrLookupIP on an invalid -fan-ip", func(t *testing.T) {
+		e := new(env)
+		e.logger, hook = setupLogs()
+
+		err := e.setSysIPs(testIP + "," + testName)
+		assert.ErrorIs(t, err, ErrLookupIP)
+		assert.ErrorContains(t, err, fmt.Sprintf(sysIPsInvalidLog, testName))
+		assert.Nil(t, e.sysIPs)
 	})
 }
 
 func TestSetPWD(t *testing.T) {
 	files := []file{}
-	e = new(env)
+	e := new(env)
 	NewAsyncProcessor(e, files)
 	t.Run("setPWD should shift execution to root from current path", func(t *testing.T) {
 		e.logger, _ = setupLogs()
@@ -944,36 +1598,27 @@ func TestSetPWD(t *testing.T) {
 // TestVerifyEnvDataset
 
 func TestVerifyDataset(t *testing.T) {
-	t.Run("it should return true if env.datasetID matches asyncProcessed & log it", func(t *testing.T) {
-		e = new(env)
+	t.Run("it should return nil if env.datasetID matches asyncProcessed & log it", func(t *testing.T) {
+		e := new(env)
 		e.logger, hook = setupLogs()
 		e.datasetID = testDatasetID
-		assert.True(t, e.verifyDataset())
+		e.gbr = testGBR
+		assert.NoError(t, e.verifyDataset())
 
 		gotLogMsg := hook.LastEntry().Message
 		wantLogMsg := fmt.Sprintf(eMatchAsyncProcessedDSTrueLog, e.datasetID, testDatasetID)
 
 		assertCorrectString(t, gotLogMsg, wantLogMsg)
 	})
-	t.Run("returns false if env.DsID does not match asyncProcessed & log it", func(t *testing.T) {
-		fakeExit := func(int) {
-			panic(osPanicTrue)
-		}
-
-		patch := monkey.Patch(os.Exit, fakeExit)
-		defer patch.Unpatch()
-
-		e = new(env)
+	t.Run("returns ErrDataset if env.DsID does not match asyncProcessed", func(t *testing.T) {
+		e := new(env)
 		e.logger, hook = setupLogs()
 		e.datasetID = testWrongDataset
+		e.gbr = testGBR
 
-		panicFunc := func() { e.verifyDataset() }
-		assert.PanicsWithValue(t, osPanicTrue, panicFunc, osPanicFalse)
-
-		gotLogMsg := hook.LastEntry().Message
-		wantLogMsg := fmt.Sprintf(eMatchAsyncProcessedDSFalseLog, e.datasetID, testDatasetID)
-
-		assertCorrectString(t, gotLogMsg, wantLogMsg)
+		err := e.verifyDataset()
+		assert.ErrorIs(t, err, ErrDataset)
+		assert.ErrorContains(t, err, fmt.Sprintf(eMatchAsyncProcessedDSFalseLog, e.datasetID, testDatasetID))
 	})
 }
 
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+)
+
+const (
+	printMappingLog = "%v -> %v\n"
+
+	errNoMappingRule    = "no mapping rule matches %v"
+	errMappingNoop      = "mapping rule %v maps %v to itself"
+	errMappingEmpty     = "no mapping rules set"
+	errMappingRuleKind  = "set exactly one of prefix or regex"
+	errMappingRuleEmpty = "replacement is empty"
+	errMappingRule      = "mapping rule %v is invalid: %w"
+)
+
+// mappingRule maps a stagingPath to its processed path. A rule either swaps
+// a leading Prefix for Replacement, or replaces the first match of Regex with
+// Replacement, which may refer to capture groups, e.g. ${1}. Prefixes should
+// end in a / so that data1/staging/ does not also match data1/staging2/
+type mappingRule struct {
+	Prefix      string `json:"prefix,omitempty"`
+	Regex       string `json:"regex,omitempty"`
+	Replacement string `json:"replacement"`
+
+	re *regexp.Regexp
+}
+
+// defaultMappingRules are the rules used when -mapping is not set. As
+// process_node_async_processed_list.sh did, mb/FAN moves to mb/FAN.processed
+// & dataN/staging to dataN/staging.processed, with or without a leading /
+var defaultMappingRules = []mappingRule{
+	regexRule(`^(/?mb/FAN)/`, "${1}.processed/"),
+	regexRule(`^(/?[^/]+/staging)/`, "${1}.processed/"),
+}
+
+func regexRule(expr, replacement string) mappingRule {
+	return mappingRule{Regex: expr, Replacement: replacement, re: regexp.MustCompile(expr)}
+}
+
+// parseMappingRules reads a JSON array of mapping rules, e.g.
+//
+//	[{"prefix": "/data1/staging/", "replacement": "/data1/staging.processed/"},
+//	 {"regex": "^(/?mb/FAN)/", "replacement": "${1}.processed/"}]
+func parseMappingRules(data []byte) ([]mappingRule, error) {
+	var rules []mappingRule
+
+	err := json.Unmarshal(data, &rules)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(rules) == 0 {
+		return nil, errors.New(errMappingEmpty)
+	}
+
+	for i := range rules {
+		err = rules[i].compile()
+		if err != nil {
+			return nil, fmt.Errorf(errMappingRule, i, err)
+		}
+	}
+
+	return rules, nil
+}
+
+func (r *mappingRule) compile() error {
+	if (r.Prefix == "") == (r.Regex == "") {
+		return errors.New(errMappingRuleKind)
+	}
+
+	if r.Replacement == "" {
+		return errors.New(errMappingRuleEmpty)
+	}
+
+	if r.Regex == "" {
+		return nil
+	}
+
+	re, err := regexp.Compile(r.Regex)
+	if err != nil {
+		return err
+	}
+
+	r.re = re
+
+	return nil
+}
+
+// apply returns pth mapped by r & whether r matches pth at all
+func (r *mappingRule) apply(pth string) (string, bool) {
+	if r.re == nil {
+		if !strings.HasPrefix(pth, r.Prefix) {
+			return "", false
+		}
+
+		return r.Replacement + strings.TrimPrefix(pth, r.Prefix), true
+	}
+
+	loc := r.re.FindStringSubmatchIndex(pth)
+	if loc == nil {
+		return "", false
+	}
+
+	dst := r.re.ExpandString(nil, r.Replacement, pth, loc)
+
+	return pth[:loc[0]] + string(dst) + pth[loc[1]:], true
+}
+
+// newPath returns where f.stagingPath moves to: its planned path if it was
+// loaded from a plan, else under the first of e's mapping rules that matches
+// it, or the default rules if e has none
+func newPath(f file, e *env) (string, error) {
+	if f.planned != nil {
+		return f.planned.NewPath, nil
+	}
+
+	rules := e.mappingRules
+	if rules == nil {
+		rules = defaultMappingRules
+	}
+
+	for i := range rules {
+		dst, ok := rules[i].apply(f.stagingPath)
+		if !ok {
+			continue
+		}
+
+		if dst == f.stagingPath {
+			return "", fmt.Errorf(errMappingNoop, i, f.stagingPath)
+		}
+
+		return dst, nil
+	}
+
+	return "", fmt.Errorf(errNoMappingRule, f.stagingPath)
+}
+
+// printMapping writes where each file in e.sourceFile would move to, or why
+// it would not, without verifying or moving anything
+func (e *env) printMapping(w io.Writer) {
+	for _, line := range parseSourceFile(e) {
+		f, err := parseLine(line, e)
+		if err != nil {
+			fmt.Fprintf(w, printMappingLog, line, err)
+			continue
+		}
+
+		dst, err := newPath(f, e)
+		if err != nil {
+			fmt.Fprintf(w, printMappingLog, f.stagingPath, err)
+			continue
+		}
+
+		fmt.Fprintf(w, printMappingLog, f.stagingPath, dst)
+	}
+}
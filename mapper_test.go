@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewPath(t *testing.T) {
+	_, files := createFSTest(t, 10)
+
+	t.Run("should return path of xxx.processed", func(t *testing.T) {
+		for _, f := range files {
+			oldDir, fn := path.Split(f.stagingPath)
+			parts := strings.Split(oldDir, string(os.PathSeparator))
+			lastParts := parts[2:]
+			firstParts := parts[:2]
+
+			got, err := newPath(f, new(env))
+			assert.Nil(t, err)
+
+			fp := strings.Join(firstParts, string(os.PathSeparator))
+			lp := strings.Join(lastParts, string(os.PathSeparator))
+			want := fp + ".processed" + string(os.PathSeparator) + lp + fn
+			assertCorrectString(t, got, want)
+		}
+	})
+
+	t.Run("should map with the default rules", func(t *testing.T) {
+		mappingTests := []struct {
+			name string
+			pth  string
+			want string
+		}{
+			{
+				name: "relative mb/FAN",
+				pth:  "mb/FAN/download/" + testName,
+				want: "mb/FAN.processed/download/" + testName,
+			},
+			{
+				name: "absolute mb/FAN",
+				pth:  "/mb/FAN/" + testName,
+				want: "/mb/FAN.processed/" + testName,
+			},
+			{
+				name: "relative staging",
+				pth:  testPath,
+				want: "data1/staging.processed/" + testName,
+			},
+			{
+				name: "absolute staging",
+				pth:  "/data3/staging/download/" + testName,
+				want: "/data3/staging.processed/download/" + testName,
+			},
+		}
+
+		for _, tt := range mappingTests {
+			t.Run(tt.name, func(t *testing.T) {
+				got, err := newPath(file{stagingPath: tt.pth}, new(env))
+				assert.Nil(t, err)
+				assertCorrectString(t, got, tt.want)
+			})
+		}
+	})
+
+	t.Run("should use the first matching rule", func(t *testing.T) {
+		e := new(env)
+		e.mappingRules = []mappingRule{
+			{Prefix: "/data1/staging/", Replacement: "/data9/archive/"},
+			regexRule(`^/([^/]+)/staging/`, "/${1}/done/"),
+		}
+
+		got, err := newPath(file{stagingPath: "/data1/staging/" + testName}, e)
+		assert.Nil(t, err)
+		assertCorrectString(t, got, "/data9/archive/"+testName)
+
+		got, err = newPath(file{stagingPath: "/data2/staging/" + testName}, e)
+		assert.Nil(t, err)
+		assertCorrectString(t, got, "/data2/done/"+testName)
+	})
+
+	t.Run("should error if no rule matches", func(t *testing.T) {
+		_, err := newPath(file{stagingPath: "/tmp/" + testName}, new(env))
+		assert.EqualError(t, err, fmt.Sprintf(errNoMappingRule, "/tmp/"+testName))
+	})
+
+	t.Run("should error if a rule maps a path to itself", func(t *testing.T) {
+		e := new(env)
+		e.mappingRules = []mappingRule{{Prefix: "/data1/", Replacement: "/data1/"}}
+
+		_, err := newPath(file{stagingPath: "/data1/" + testName}, e)
+		assert.EqualError(t, err, fmt.Sprintf(errMappingNoop, 0, "/data1/"+testName))
+	})
+}
+
+func TestParseMappingRules(t *testing.T) {
+	t.Run("should parse prefix & regex rules", func(t *testing.T) {
+		data := []byte(`[
+			{"prefix": "/data1/staging/", "replacement": "/data1/staging.processed/"},
+			{"regex": "^(/?mb/FAN)/", "replacement": "${1}.processed/"}
+		]`)
+
+		rules, err := parseMappingRules(data)
+		assert.Nil(t, err)
+		assert.Len(t, rules, 2)
+		assert.Nil(t, rules[0].re)
+		assert.NotNil(t, rules[1].re)
+	})
+
+	t.Run("should reject invalid rules", func(t *testing.T) {
+		invalidTests := []struct {
+			name string
+			data string
+			want string
+		}{
+			{
+				name: "empty",
+				data: `[]`,
+				want: errMappingEmpty,
+			},
+			{
+				name: "prefix & regex",
+				data: `[{"prefix": "/a/", "regex": "^/a/", "replacement": "/b/"}]`,
+				want: fmt.Sprintf("mapping rule 0 is invalid: %v", errMappingRuleKind),
+			},
+			{
+				name: "neither prefix nor regex",
+				data: `[{"replacement": "/b/"}]`,
+				want: fmt.Sprintf("mapping rule 0 is invalid: %v", errMappingRuleKind),
+			},
+			{
+				name: "no replacement",
+				data: `[{"prefix": "/a/"}]`,
+				want: fmt.Sprintf("mapping rule 0 is invalid: %v", errMappingRuleEmpty),
+			},
+			{
+				name: "bad regex",
+				data: `[{"regex": "(", "replacement": "/b/"}]`,
+				want: "mapping rule 0 is invalid: error parsing regexp: missing closing ): `(`",
+			},
+		}
+
+		for _, tt := range invalidTests {
+			t.Run(tt.name, func(t *testing.T) {
+				_, err := parseMappingRules([]byte(tt.data))
+				assert.EqualError(t, err, tt.want)
+			})
+		}
+	})
+
+	t.Run("should reject malformed json", func(t *testing.T) {
+		_, err := parseMappingRules([]byte(`{`))
+		assert.NotNil(t, err)
+	})
+}
+
+func TestPrintMapping(t *testing.T) {
+	afs, files := createAferoTest(t, 5, true)
+	e := new(env)
+	e.afs = afs
+	e.logger, _ = setupLogs()
+	e.sourceFile = fmt.Sprintf(testSourceFile, getWorkDir())
+
+	t.Run("should print where each file would move to", func(t *testing.T) {
+		var out bytes.Buffer
+
+		e.printMapping(&out)
+
+		var want string
+		for _, f := range files {
+			want += fmt.Sprintf(printMappingLog, f.stagingPath, mustNewPath(t, f))
+		}
+
+		assertCorrectString(t, out.String(), want)
+
+		for _, f := range files {
+			_, err := afs.Stat(f.stagingPath)
+			assert.Nil(t, err)
+		}
+	})
+
+	t.Run("should print why a file would not move", func(t *testing.T) {
+		var out bytes.Buffer
+
+		e.mappingRules = []mappingRule{{Prefix: "/nowhere/", Replacement: "/somewhere/"}}
+		defer func() { e.mappingRules = nil }()
+
+		e.printMapping(&out)
+
+		lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+		assert.Len(t, lines, len(files))
+
+		for i, f := range files {
+			want := fmt.Sprintf(printMappingLog, f.stagingPath, fmt.Sprintf(errNoMappingRule, f.stagingPath))
+			assertCorrectString(t, lines[i]+"\n", want)
+		}
+	})
+}
+
+// mustNewPath returns newPath for f under the default mapping rules
+func mustNewPath(t *testing.T, f file) string {
+	t.Helper()
+
+	dst, err := newPath(f, new(env))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return dst
+}
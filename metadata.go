@@ -1,9 +1,7 @@
 package main
 
 import (
-	"errors"
 	"fmt"
-	"os/exec"
 	"regexp"
 	"strings"
 
@@ -14,51 +12,54 @@ const (
 	gbrAsyncProcessedDSErrLog   = "gbr could not verify AsyncProcessedDataset"
 	gbrGetAsyncProcessedDSLog   = "gbr pool got output:%v"
 	gbrParseAsyncProcessedDSLog = "gbr verified asyncProcessedDataset as %v"
+	gbrShortIDLineLog           = "gbr pool ID line %q is too short to hold a datasetID"
+
+	// datasetIDLen is the length of a datasetID, which ends gbr's ID line
+	datasetIDLen = 32
+
+	errGbrCmdWrap = "%w: %v: %v"
 )
 
 // Getters
 
-func getAsyncProcessedDSID(logger *logrus.Logger) string {
-	cmd := exec.Command("/usr/bin/gbr", "pool", "ls", "-d")
-
-	cmdOut, err := cmd.CombinedOutput()
+// getAsyncProcessedDSID returns the async processed dataset from e.gbr. If
+// gbr fails or its output has no dataset the error wraps ErrGbrUnavailable
+func getAsyncProcessedDSID(e *env) (string, error) {
+	out, err := e.gbr.PoolList()
 	if err != nil {
-		asyncProcessedDSIDErrLog(err, logger)
+		return "", asyncProcessedDSIDErr(err)
 	}
 
-	out := string(cmdOut)
 	out = cleanGbrOut(out)
-	logger.Info(fmt.Sprintf(gbrGetAsyncProcessedDSLog, out))
-	out = parseAsyncProcessedDSID(out, logger)
+	e.logger.Info(fmt.Sprintf(gbrGetAsyncProcessedDSLog, out))
 
-	return out
+	return parseAsyncProcessedDSID(out, e.logger)
 }
 
 // Parsers
 
-func parseAsyncProcessedDSID(cmdOut string, logger *logrus.Logger) (asyncDelDS string) {
+func parseAsyncProcessedDSID(cmdOut string, logger *logrus.Logger) (string, error) {
 	lines := strings.Split(string(cmdOut), ";")
 	for _, line := range lines {
 		if strings.Contains(line, "ID") {
-			asyncDelDS = line[len(line)-32:]
+			if len(line) < datasetIDLen {
+				return "", fmt.Errorf(errWrapMsg, ErrGbrOutput, fmt.Sprintf(gbrShortIDLineLog, line))
+			}
+
+			asyncDelDS := line[len(line)-datasetIDLen:]
 			logger.Info(fmt.Sprintf(gbrParseAsyncProcessedDSLog, asyncDelDS))
 
-			return
+			return asyncDelDS, nil
 		}
 	}
-	// We want it to crash out on not finding the asyncProcessedDS
-	logger.Fatal(gbrAsyncProcessedDSErrLog)
 
-	return
+	return "", fmt.Errorf(errWrapMsg, ErrGbrUnavailable, gbrAsyncProcessedDSErrLog)
 }
 
 // Errors
 
-func asyncProcessedDSIDErrLog(err error, logger *logrus.Logger) {
-	// We want it to crash out on not finding the asyncProcessedDS
-	err = errors.New(cleanGbrOut(err.Error()))
-	logger.Error(err)
-	logger.Fatal(gbrAsyncProcessedDSErrLog)
+func asyncProcessedDSIDErr(err error) error {
+	return fmt.Errorf(errGbrCmdWrap, ErrGbrUnavailable, gbrAsyncProcessedDSErrLog, cleanGbrOut(err.Error()))
 }
 
 // Cleaners
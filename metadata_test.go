@@ -3,10 +3,8 @@ package main
 import (
 	"errors"
 	"fmt"
-	"os"
 	"testing"
 
-	"bou.ke/monkey"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -28,9 +26,13 @@ const (
 
 func TestGetAsyncProcessedDSID(t *testing.T) {
 	t.Run("should return asyncprocessed dataset", func(t *testing.T) {
-		testLogger, hook = setupLogs()
+		e := new(env)
+		e.logger, hook = setupLogs()
+		e.gbr = newFakeGBRClient(testDatasetID)
+
+		got, err := getAsyncProcessedDSID(e)
+		assert.NoError(t, err)
 
-		got := getAsyncProcessedDSID(testLogger)
 		want := testDatasetID
 		assertCorrectString(t, got, want)
 
@@ -42,6 +44,19 @@ func TestGetAsyncProcessedDSID(t *testing.T) {
 		wantLogMsg = fmt.Sprintf(gbrParseAsyncProcessedDSLog, testDatasetID)
 		assertCorrectString(t, gotLogMsg, wantLogMsg)
 	})
+
+	t.Run("should wrap gbr errors in ErrGbrUnavailable", func(t *testing.T) {
+		gbr := newFakeGBRClient(testDatasetID)
+		gbr.err = errors.New(testGbrFileIDErrOut)
+
+		e := new(env)
+		e.logger, hook = setupLogs()
+		e.gbr = gbr
+
+		_, err := getAsyncProcessedDSID(e)
+		assert.ErrorIs(t, err, ErrGbrUnavailable)
+		assert.ErrorContains(t, err, testGbrFileIDErrOutLog)
+	})
 }
 
 // Parsers
@@ -49,7 +64,9 @@ func TestGetAsyncProcessedDSID(t *testing.T) {
 func TestParseAsyncProcessedDSID(t *testing.T) {
 	t.Run("should parse output and return AsyncProcessedDSID", func(t *testing.T) {
 		testLogger, hook = setupLogs()
-		got := parseAsyncProcessedDSID(testGbrPoolOutLog, testLogger)
+		got, err := parseAsyncProcessedDSID(testGbrPoolOutLog, testLogger)
+		assert.NoError(t, err)
+
 		want := testDatasetID
 		assertCorrectString(t, got, want)
 
@@ -58,47 +75,31 @@ func TestParseAsyncProcessedDSID(t *testing.T) {
 		assertCorrectString(t, gotLogMsg, wantLogMsg)
 	})
 
-	t.Run("should parse output and fatal out if no asyncdelDS match", func(t *testing.T) {
-		fakeExit := func(int) {
-			panic(osPanicTrue)
-		}
+	t.Run("should return ErrGbrOutput if the ID line is too short", func(t *testing.T) {
+		testLogger, _ = setupLogs()
 
-		patch := monkey.Patch(os.Exit, fakeExit)
-		defer patch.Unpatch()
+		_, err := parseAsyncProcessedDSID(" - ID: 41545AB0;", testLogger)
+		assert.ErrorIs(t, err, ErrGbrOutput)
+		assert.ErrorContains(t, err, fmt.Sprintf(gbrShortIDLineLog, " - ID: 41545AB0"))
+	})
 
+	t.Run("should return ErrGbrUnavailable if no asyncdelDS match", func(t *testing.T) {
 		testLogger, hook = setupLogs()
-		panicFunc := func() { parseAsyncProcessedDSID("", testLogger) }
-
-		assert.PanicsWithValue(t, osPanicTrue, panicFunc, osPanicFalse)
 
-		gotLogMsg := hook.LastEntry().Message
-		wantLogMsg := gbrAsyncProcessedDSErrLog
-		assertCorrectString(t, gotLogMsg, wantLogMsg)
+		_, err := parseAsyncProcessedDSID("", testLogger)
+		assert.ErrorIs(t, err, ErrGbrUnavailable)
+		assert.ErrorContains(t, err, gbrAsyncProcessedDSErrLog)
 	})
 }
 
 // Errors
 
-func TestAsyncProcessedDSIDErrLog(t *testing.T) {
-	t.Run("should log cmd error and fatal", func(t *testing.T) {
-		fakeExit := func(int) {
-			panic(osPanicTrue)
-		}
-
-		patch := monkey.Patch(os.Exit, fakeExit)
-		defer patch.Unpatch()
-
-		testLogger, hook = setupLogs()
-		panicFunc := func() { asyncProcessedDSIDErrLog(errors.New(osPanicTrue), testLogger) }
-
-		assert.PanicsWithValue(t, osPanicTrue, panicFunc, osPanicFalse)
-
-		gotLogMsgs := hook.Entries
-		wantLogMsg := osPanicTrue
-		assertCorrectString(t, gotLogMsgs[0].Message, wantLogMsg)
-
-		wantLogMsg = gbrAsyncProcessedDSErrLog
-		assertCorrectString(t, gotLogMsgs[1].Message, wantLogMsg)
+func TestAsyncProcessedDSIDErr(t *testing.T) {
+	t.Run("should wrap the cleaned cmd error in ErrGbrUnavailable", func(t *testing.T) {
+		err := asyncProcessedDSIDErr(errors.New(testGbrPoolOut))
+		assert.ErrorIs(t, err, ErrGbrUnavailable)
+		assert.ErrorContains(t, err, gbrAsyncProcessedDSErrLog)
+		assert.ErrorContains(t, err, cleanGbrOut(testGbrPoolOut))
 	})
 }
 
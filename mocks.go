@@ -1,5 +1,14 @@
 package main
 
+import (
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"sync"
+)
+
 // mockAsyncProcessor
 
 type mockAsyncProcessor struct {
@@ -24,3 +33,157 @@ func (m mockAsyncProcessor) setFiles() {
 
 func (m mockAsyncProcessor) processFiles() {
 }
+
+func (m mockAsyncProcessor) planFiles() {
+}
+
+func (m mockAsyncProcessor) loadPlan() {
+}
+
+func (m mockAsyncProcessor) loadRestore() {
+}
+
+func (m mockAsyncProcessor) restoreFiles() {
+}
+
+func (m mockAsyncProcessor) getResults() []result {
+	return nil
+}
+
+func (m mockAsyncProcessor) printSummary(_ io.Writer) {
+}
+
+func (m mockAsyncProcessor) writeReport() {
+}
+
+func (m mockAsyncProcessor) exitCode() int {
+	return exitOK
+}
+
+// fakeGBRClient answers gbr queries from memory. files maps each file id to
+// its gbr file ls -i id -d output; an unknown id gives no output, as gbr does.
+// If err is set every query returns it, while the next fails queries return
+// errFakeGBR. calls counts the queries made
+type fakeGBRClient struct {
+	mu    sync.Mutex
+	pool  string
+	files map[string]string
+	err   error
+	fails int
+	calls int
+}
+
+var (
+	errFakeGBR = errors.New("gbr failed")
+	// fakeStagingRoot matches the node staging roots gbr leaves out of a fan
+	// uri without a fan volume
+	fakeStagingRoot = regexp.MustCompile(`^/?(mb/FAN|data[0-9]+/staging)/`)
+)
+
+const (
+	fakeGbrPoolOut = "====== + Pools  in datalake 'nmr' ======\n\n" +
+		"- pool01 ( disk pool, primary )\n" +
+		" == General ==\n" +
+		"   - description:\n" +
+		"   - creation date:             Tue Jan 18 23:12:53 EST 2022\n" +
+		"   - primary:                   true\n" +
+		"   - ID:                        %v\n" +
+		"   - parent datalake:           nmr (ID: 0E544860788911ECBD0700155D014E0D)\n"
+	fakeGbrNoHold  = "Enabled=false OwnerID=null MatterID=null"
+	fakeGbrHold    = "Enabled=true OwnerID=%v MatterID=%v"
+	fakeGbrFanURI  = "ftp://user@%v:2121/%v"
+	fakeGbrFileOut = "1 - %v (file id: %v)\n" +
+		"    version:            0\n" +
+		"    type:               file\n" +
+		"    parent id:          %v\n" +
+		"    fan URI:            %v\n" +
+		"    pool id:            %v\n" +
+		"    legal hold:         " + fakeGbrNoHold + "\n" +
+		"    file hash:\n"
+)
+
+// newFakeGBRClient returns a fakeGBRClient whose pool is datasetID
+func newFakeGBRClient(datasetID string) *fakeGBRClient {
+	return &fakeGBRClient{
+		pool:  fmt.Sprintf(fakeGbrPoolOut, datasetID),
+		files: map[string]string{},
+	}
+}
+
+// addFile makes f.id a file named f.smbName in f.datasetID, with a fan uri
+// that cleanse would map to f.stagingPath on f.fanIP
+func (c *fakeGBRClient) addFile(f file) {
+	c.setFile(f.id, fmt.Sprintf(fakeGbrFileOut, f.smbName, f.id, f.datasetID, fakeFanURI(f), f.datasetID))
+}
+
+// fakeFanURI is a fan uri without a fan volume, as gbr gives it, so only the
+// path below f.stagingPath's staging root, e.g. download/x for
+// data1/staging/download/x
+func fakeFanURI(f file) string {
+	return fmt.Sprintf(fakeGbrFanURI, f.fanIP, fakeStagingRoot.ReplaceAllString(f.stagingPath, ""))
+}
+
+// holdFile puts id, which must have been added, under legal hold
+func (c *fakeGBRClient) holdFile(id string, ownerID string, matterID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.files[id] = strings.Replace(c.files[id], fakeGbrNoHold,
+		fmt.Sprintf(fakeGbrHold, ownerID, matterID), 1)
+}
+
+// setFile makes out the output for id
+func (c *fakeGBRClient) setFile(id string, out string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.files[id] = out
+}
+
+func (c *fakeGBRClient) PoolList() (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	err := c.fail()
+	if err != nil {
+		return "", err
+	}
+
+	return c.pool, nil
+}
+
+func (c *fakeGBRClient) FileByID(id string) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	err := c.fail()
+	if err != nil {
+		return "", err
+	}
+
+	return c.files[id], nil
+}
+
+// fail counts a query & returns the error it should fail with, if any
+func (c *fakeGBRClient) fail() error {
+	c.calls++
+
+	if c.err != nil {
+		return c.err
+	}
+
+	if c.fails > 0 {
+		c.fails--
+		return errFakeGBR
+	}
+
+	return nil
+}
+
+// getCalls returns how many queries have been made
+func (c *fakeGBRClient) getCalls() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.calls
+}
@@ -1,12 +1,15 @@
 package main
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
 	"os"
 	"path"
-	"strings"
+	"syscall"
 
-	"github.com/sirupsen/logrus"
 	"github.com/spf13/afero"
 )
 
@@ -14,14 +17,44 @@ const (
 	fMoveFileLog        = "%v: (file.id:%v) oldPath:%v, newPath:%v"
 	fMoveDryRunTrueLog  = "%v: (file.id:%v) Dryrun skipping execute move"
 	fMoveDryRunFalseLog = "%v: (file.id:%v) Nondryrun executing move"
+	fMoveCrossDeviceLog = "%v: (file.id:%v) oldPath:%v & newPath:%v are on different devices; copying"
+	fMoveCopiedLog      = "%v: (file.id:%v) copied, synced & verified newPath:%v; removed oldPath:%v"
+
+	errCopyHashMismatch = "copy of %v to %v has hash:%x which does not match f.oldHash:%x"
+)
+
+// moveKind records how file.move got a file to its new path
+type moveKind int
+
+const (
+	// moveNone means the file was not moved, e.g. on dryrun
+	moveNone moveKind = iota
+	// moveRename means the file was renamed in place; same device & inode
+	moveRename
+	// moveCopy means the data may have been copied, so it must be re-hashed
+	moveCopy
 )
 
-func (f *file) move() {
-	e = ap.getEnv()
+// move moves f to its newPath. It reports false, with f.reason set, if the
+// collision policy leaves f where it is, erroring with ErrCollision if the
+// policy fails f. Any other error wraps ErrMove & leaves f at its stagingPath
+func (f *file) move(e *env) (bool, error) {
 	logger := e.logger
 	afs := e.afs
 	oldLocation := f.stagingPath
-	newLocation := newPath(*f)
+
+	newLocation, err := newPath(*f, e)
+	if err != nil {
+		return false, fmt.Errorf(errWrap, ErrMove, err)
+	}
+
+	dst := newLocation
+
+	newLocation, ok := f.resolveCollision(newLocation, e)
+	if !ok {
+		return false, f.collisionErr(dst)
+	}
+
 	logger.Info(fmt.Sprintf(fMoveFileLog, f.smbName, f.id, oldLocation, newLocation))
 
 	if e.dryrun {
@@ -31,37 +64,181 @@ func (f *file) move() {
 
 		dir, _ := path.Split(newLocation)
 
-		_, err := afs.Stat(dir)
+		_, err = afs.Stat(dir)
 		if err != nil {
 			logger.Warn(err)
-			wrapAferoMkdirAll(afs, dir, logger)
+
+			err = wrapAferoMkdirAll(afs, dir)
+			if err != nil {
+				return false, err
+			}
+		}
+
+		before, err := afs.Stat(oldLocation)
+		if err != nil {
+			return false, fmt.Errorf(errWrap, ErrMove, err)
 		}
 
+		f.journal(stateMoving, oldLocation, newLocation, e)
+
 		err = afs.Rename(oldLocation, newLocation)
+		if errors.Is(err, syscall.EXDEV) {
+			logger.Warn(fmt.Sprintf(fMoveCrossDeviceLog, f.smbName, f.id, oldLocation, newLocation))
+
+			err = f.copyMove(oldLocation, newLocation, before, e)
+			if err != nil {
+				return false, fmt.Errorf(errWrap, ErrMove, err)
+			}
+
+			f.stagingPath = newLocation
+			f.moveKind = moveCopy
+			logger.Info(fmt.Sprintf(fMoveCopiedLog, f.smbName, f.id, newLocation, oldLocation))
+			f.journal(stateMoved, oldLocation, newLocation, e)
+
+			return true, nil
+		}
+
 		if err != nil {
-			logger.Fatal(err)
+			return false, fmt.Errorf(errWrap, ErrMove, err)
 		}
 
 		f.stagingPath = newLocation
+		f.moveKind = moveCopy
+
+		after, err := afs.Stat(newLocation)
+		if err == nil && sameInode(before, after) {
+			f.moveKind = moveRename
+		}
+
+		f.journal(stateMoved, oldLocation, newLocation, e)
 	}
+
+	return true, nil
 }
 
-func newPath(f file) string {
-	oldDir, fn := path.Split(f.stagingPath)
-	parts := strings.Split(oldDir, string(os.PathSeparator))
-	lastParts := parts[2:]
-	firstParts := parts[:2]
-	fp := strings.Join(firstParts, string(os.PathSeparator))
-	lp := strings.Join(lastParts, string(os.PathSeparator))
+// copyMove moves src to dst where a rename cannot, e.g. across devices. It
+// copies src into f.copyTempPath(dst), fsyncs it & checks its hash against
+// f.oldHash, keeps src's mode & mtime (which verifyCreateTime relies on) &
+// renames it into place. Only then is src removed, so any error leaves src
+// untouched & no partial file at dst
+func (f *file) copyMove(src, dst string, info fs.FileInfo, e *env) (err error) {
+	afs := e.afs
+
+	in, err := afs.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	dir, _ := path.Split(dst)
+	tmpName := f.copyTempPath(dst)
+
+	// A temp file left by a crash is truncated
+	tmp, err := afs.OpenFile(tmpName, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err != nil {
+			_ = afs.Remove(tmpName)
+		}
+	}()
+
+	buf := make([]byte, hashBufferSize)
+
+	_, err = io.CopyBuffer(tmp, &limitedReader{r: in, limiter: e.readLimiter}, buf)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+
+	err = tmp.Sync()
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+
+	sum, err := hashFile(tmpName, e)
+	if err != nil {
+		return err
+	}
+
+	if len(f.oldHash) == 0 || !bytes.Equal(sum, f.oldHash) {
+		return fmt.Errorf(errCopyHashMismatch, src, dst, sum, f.oldHash)
+	}
+
+	err = afs.Chmod(tmpName, info.Mode())
+	if err != nil {
+		return err
+	}
+
+	err = afs.Chtimes(tmpName, info.ModTime(), info.ModTime())
+	if err != nil {
+		return err
+	}
+
+	err = afs.Rename(tmpName, dst)
+	if err != nil {
+		return err
+	}
+
+	syncDir(afs, dir)
+
+	return afs.Remove(src)
+}
+
+// copyTempPath is the temp file beside dst that copyMove copies f into. It is
+// named from f.id so that a resume can find one left by a crash
+func (f *file) copyTempPath(dst string) string {
+	dir, fn := path.Split(dst)
+
+	return path.Join(dir, "."+fn+".tmp-"+f.id)
+}
+
+// syncDir fsyncs dir so that a rename into it survives a crash. Filesystems
+// that cannot sync directories are ignored
+func syncDir(afs afero.Fs, dir string) {
+	d, err := afs.Open(dir)
+	if err != nil {
+		return
+	}
+	defer d.Close()
+
+	_ = d.Sync()
+}
+
+// sameInode reports whether a & b are the same device & inode. It is false
+// if either filesystem does not expose them, e.g. afero.MemMapFs
+func sameInode(a, b fs.FileInfo) bool {
+	if a == nil || b == nil {
+		return false
+	}
+
+	aStat, ok := a.Sys().(*syscall.Stat_t)
+	if !ok {
+		return false
+	}
+
+	bStat, ok := b.Sys().(*syscall.Stat_t)
+	if !ok {
+		return false
+	}
 
-	return fp + ".processed" + string(os.PathSeparator) + lp + fn
+	return aStat.Dev == bStat.Dev && aStat.Ino == bStat.Ino
 }
 
-func wrapAferoMkdirAll(afsys afero.Fs, path string, logger *logrus.Logger) bool {
+// wrapAferoMkdirAll makes path & any parents. An error wraps ErrMove
+func wrapAferoMkdirAll(afsys afero.Fs, path string) error {
 	err := afsys.MkdirAll(path, 0755)
 	if err != nil && !os.IsExist(err) {
-		logger.Fatal(err)
+		return fmt.Errorf(errWrap, ErrMove, err)
 	}
 
-	return true
+	return nil
 }
@@ -1,19 +1,17 @@
 package main
 
 import (
-	"errors"
 	"fmt"
-	"log"
 	"math/rand"
 	"net"
 	"os"
 	"path"
 	"strconv"
 	"strings"
+	"syscall"
 	"testing"
 	"time"
 
-	"bou.ke/monkey"
 	"github.com/spf13/afero"
 	"github.com/stretchr/testify/assert"
 )
@@ -25,40 +23,20 @@ const (
 	testAppFsMkdirAllErr = "operation not permitted"
 )
 
-func TestNewPath(t *testing.T) {
-	fsys, files = createFSTest(t, 10)
-
-	t.Run("should return path of xxx.processed", func(t *testing.T) {
-		for _, f := range files {
-			oldDir, fn := path.Split(f.stagingPath)
-			parts := strings.Split(oldDir, string(os.PathSeparator))
-			lastParts := parts[2:]
-			firstParts := parts[:2]
-
-			got := newPath(f) //#nosec - testing code can be insecure
-			fp := strings.Join(firstParts, string(os.PathSeparator))
-			lp := strings.Join(lastParts, string(os.PathSeparator))
-			want := fp + ".processed" + string(os.PathSeparator) + lp + fn
-			assertCorrectString(t, got, want)
-		}
-	})
-}
-
 func TestMoveFile(t *testing.T) {
 	afs, files := createAferoTest(t, 10, false)
-	e = new(env)
+	e := new(env)
 	e.afs = afs
-	ap = NewAsyncProcessor(e, files)
 
 	t.Run("should move file to new path & log it", func(t *testing.T) {
 		for _, f := range files {
 			oldPath := f.stagingPath
-			newPath := newPath(f) //#nosec - testing code can be insecure
+			newPath := mustNewPath(t, f)
 
 			e.logger, hook = setupLogs()
 			e.dryrun = false
 
-			f.move()
+			f.move(e)
 
 			assert.NotEqual(t, oldPath, newPath)
 
@@ -93,10 +71,10 @@ func TestMoveFile(t *testing.T) {
 			e.afs = afs
 			e.logger, hook = setupLogs()
 
-			newPath := newPath(f) //#nosec - testing code can be insecure
+			newPath := mustNewPath(t, f)
 			dir, _ := path.Split(newPath)
 
-			f.move()
+			f.move(e)
 
 			gotLogMsg := hook.LastEntry().Message
 			wantLogMsg := fmt.Sprintf(testFsysDoesNotExistErr, dir[:len(dir)-1])
@@ -105,6 +83,24 @@ func TestMoveFile(t *testing.T) {
 		}
 	})
 
+	t.Run("should return ErrMove if the folder cannot be created", func(t *testing.T) {
+		f := files[0]
+		memFs := afero.NewMemMapFs()
+
+		err := afero.WriteFile(memFs, f.stagingPath, []byte{}, 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		e.afs = afero.NewReadOnlyFs(memFs)
+		e.logger, _ = setupLogs()
+
+		moved, err := f.move(e)
+		assert.False(t, moved)
+		assert.ErrorIs(t, err, ErrMove)
+		assertCorrectString(t, f.stagingPath, files[0].stagingPath)
+	})
+
 	t.Run("should check for dryrun & log not executing move", func(t *testing.T) {
 		for _, f := range files {
 			fs := afero.NewMemMapFs()
@@ -119,7 +115,7 @@ func TestMoveFile(t *testing.T) {
 			e.logger, hook = setupLogs()
 			e.dryrun = true
 
-			f.move()
+			f.move(e)
 
 			gotLogMsg := hook.LastEntry().Message
 			wantLogMsg := fmt.Sprintf(fMoveDryRunTrueLog, f.smbName, f.id)
@@ -142,7 +138,7 @@ func TestMoveFile(t *testing.T) {
 			e.logger, hook = setupLogs()
 			e.dryrun = false
 
-			f.move()
+			f.move(e)
 
 			gotLogMsg := hook.Entries[1].Message
 			wantLogMsg := fmt.Sprintf(fMoveDryRunFalseLog, f.smbName, f.id)
@@ -152,73 +148,279 @@ func TestMoveFile(t *testing.T) {
 	})
 }
 
-func TestWrapAferoMkdirAll(t *testing.T) {
-	t.Run("wrapAferoMkdirAll should return & log the path", func(t *testing.T) {
-		var appFs = afero.NewMemMapFs()
+func TestMoveKind(t *testing.T) {
+	t.Run("should record moveNone on dryrun", func(t *testing.T) {
+		afs, files := createAferoTest(t, 1, false)
+		e := new(env)
+		e.afs = afs
+		e.logger, _ = setupLogs()
+		e.dryrun = true
 
-		path := tempdir1 + tempdir2
-		testLogger, hook = setupLogs()
-		ok := wrapAferoMkdirAll(appFs, path, testLogger)
+		files[0].move(e)
+
+		assert.Equal(t, moveNone, files[0].moveKind)
+	})
 
-		err := appFs.RemoveAll(tempdir1)
+	t.Run("should record moveCopy if the fs has no inodes", func(t *testing.T) {
+		afs, files := createAferoTest(t, 1, false)
+		e := new(env)
+		e.afs = afs
+		e.logger, _ = setupLogs()
+
+		files[0].move(e)
+
+		assert.Equal(t, moveCopy, files[0].moveKind)
+	})
+
+	t.Run("should record moveRename on an in place rename", func(t *testing.T) {
+		e := new(env)
+		e.afs = afero.NewBasePathFs(afero.NewOsFs(), t.TempDir())
+		e.logger, _ = setupLogs()
+
+		f := file{smbName: testName, id: testFileID, stagingPath: testPath}
+
+		err := e.afs.MkdirAll(path.Dir(f.stagingPath), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = afero.WriteFile(e.afs, f.stagingPath, []byte(testContent), 0644)
 		if err != nil {
 			t.Fatal(err)
 		}
 
-		assert.True(t, ok)
+		f.move(e)
+
+		assert.Equal(t, moveRename, f.moveKind)
+		assertCorrectString(t, f.stagingPath, mustNewPath(t, file{stagingPath: testPath}))
 	})
+}
+
+// crossDeviceFs fails renames between directories with EXDEV, as if each
+// directory were on its own device
+type crossDeviceFs struct {
+	afero.Fs
+}
+
+func (c crossDeviceFs) Rename(oldname, newname string) error {
+	dir := func(name string) string { return strings.TrimPrefix(path.Dir(name), "/") }
+
+	if dir(oldname) != dir(newname) {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: syscall.EXDEV}
+	}
+
+	return c.Fs.Rename(oldname, newname)
+}
+
+func TestMoveCrossDevice(t *testing.T) {
+	setup := func(t *testing.T) (*env, *file, time.Time) {
+		e := new(env)
+		e.afs = crossDeviceFs{afero.NewBasePathFs(afero.NewOsFs(), t.TempDir())}
+		e.logger, hook = setupLogs()
 
-	t.Run("wrapAferoMkdirAll should panic & log the error on err", func(t *testing.T) {
-		fakeExit := func(int) {
-			panic(osPanicTrue)
+		f := &file{smbName: testName, id: testFileID, stagingPath: testPath}
+
+		err := e.afs.MkdirAll(path.Dir(f.stagingPath), 0755)
+		if err != nil {
+			t.Fatal(err)
 		}
 
-		patch := monkey.Patch(os.Exit, fakeExit)
-		defer patch.Unpatch()
+		err = afero.WriteFile(e.afs, f.stagingPath, []byte(testContent), 0640)
+		if err != nil {
+			t.Fatal(err)
+		}
 
-		path := tempdir1 + tempdir2
-		// Make the fs readonly to force error
-		var appFs = afero.NewReadOnlyFs(afero.NewMemMapFs())
+		mtime := time.Date(2022, 1, 18, 23, 12, 53, 0, time.UTC)
 
-		testLogger, hook = setupLogs()
+		err = e.afs.Chtimes(f.stagingPath, mtime, mtime)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = f.hasher(e)
+		if err != nil {
+			t.Fatal(err)
+		}
 
-		panicFunc := func() { wrapAferoMkdirAll(appFs, path, testLogger) }
-		assert.PanicsWithValue(t, osPanicTrue, panicFunc, osPanicFalse)
+		f.oldHash = f.hash
+		f.oldStagingPath = f.stagingPath
 
-		gotLogMsg := hook.LastEntry().Message
-		wantLogMsg := testAppFsMkdirAllErr
+		return e, f, mtime
+	}
+
+	t.Run("should copy, verify & remove the source", func(t *testing.T) {
+		e, f, mtime := setup(t)
+		oldPath := f.stagingPath
+		want := mustNewPath(t, *f)
 
+		f.move(e)
+
+		assertCorrectString(t, f.stagingPath, want)
+		assert.Equal(t, moveCopy, f.moveKind)
+
+		_, err := e.afs.Stat(oldPath)
+		assert.True(t, os.IsNotExist(err))
+
+		got, err := afero.ReadFile(e.afs, want)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assertCorrectString(t, string(got), testContent)
+
+		info, err := e.afs.Stat(want)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assert.True(t, info.ModTime().Equal(mtime))
+		assert.Equal(t, os.FileMode(0640), info.Mode().Perm())
+
+		entries, err := afero.ReadDir(e.afs, path.Dir(want))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assert.Len(t, entries, 1)
+
+		gotLogMsg := hook.LastEntry().Message
+		wantLogMsg := fmt.Sprintf(fMoveCopiedLog, f.smbName, f.id, want, oldPath)
 		assertCorrectString(t, gotLogMsg, wantLogMsg)
 	})
-}
 
-func createAferoTest(t *testing.T, numFiles int, createTestFile bool) (afero.Fs, []file) {
-	// createTestFile
-	var outSourceFile afero.File
+	t.Run("should return ErrMove & keep the source if the copy does not verify", func(t *testing.T) {
+		e, f, _ := setup(t)
+		oldPath := f.stagingPath
+		dst := mustNewPath(t, *f)
+		f.oldHash = []byte(testContent)
 
-	// Create gbrList file
-	var list string
+		moved, err := f.move(e)
+		assert.False(t, moved)
+		assert.ErrorIs(t, err, ErrMove)
+		assertCorrectString(t, f.stagingPath, oldPath)
 
-	var err error
+		got, err := afero.ReadFile(e.afs, oldPath)
+		if err != nil {
+			t.Fatal(err)
+		}
 
-	dir := getWorkDir()
+		assertCorrectString(t, string(got), testContent)
 
-	list = fmt.Sprintf(gbrList, dir)
+		entries, err := afero.ReadDir(e.afs, path.Dir(dst))
+		if err != nil {
+			t.Fatal(err)
+		}
 
-	if _, err := os.Stat(list); errors.Is(err, os.ErrNotExist) {
-		fmt.Printf("Info: gbrList:%v does not exist; skipping truncate", list)
-	} else {
-		if err := os.Truncate(list, 0); err != nil {
-			t.Errorf("Failed to truncate: %v", err)
+		assert.Empty(t, entries)
+	})
+
+	t.Run("should overwrite a temp file left by a crash", func(t *testing.T) {
+		e, f, _ := setup(t)
+		dst := mustNewPath(t, *f)
+		tmp := f.copyTempPath(dst)
+
+		assertCorrectString(t, tmp, path.Join(path.Dir(dst), "."+path.Base(dst)+".tmp-"+testFileID))
+
+		err := e.afs.MkdirAll(path.Dir(dst), 0755)
+		if err != nil {
+			t.Fatal(err)
 		}
-	}
 
-	out, err := os.OpenFile(list, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
-		t.Fatal(err)
+		err = afero.WriteFile(e.afs, tmp, []byte(testLongerContent), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		moved, err := f.move(e)
+		assert.NoError(t, err)
+		assert.True(t, moved)
+
+		got, err := afero.ReadFile(e.afs, dst)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assertCorrectString(t, string(got), testContent)
+
+		_, err = e.afs.Stat(tmp)
+		assert.True(t, os.IsNotExist(err))
+	})
+}
+
+func TestSameInode(t *testing.T) {
+	osFs := afero.NewBasePathFs(afero.NewOsFs(), t.TempDir())
+
+	for _, name := range []string{testName, testContent} {
+		err := afero.WriteFile(osFs, name, []byte(testContent), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
 	}
 
-	defer out.Close()
+	t.Run("should be true for the same file", func(t *testing.T) {
+		a, _ := osFs.Stat(testName)
+		b, _ := osFs.Stat(testName)
+
+		assert.True(t, sameInode(a, b))
+	})
+
+	t.Run("should be false for different files", func(t *testing.T) {
+		a, _ := osFs.Stat(testName)
+		b, _ := osFs.Stat(testContent)
+
+		assert.False(t, sameInode(a, b))
+	})
+
+	t.Run("should be false if the fs has no inodes", func(t *testing.T) {
+		memFs := afero.NewMemMapFs()
+
+		err := afero.WriteFile(memFs, testName, []byte(testContent), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		a, _ := memFs.Stat(testName)
+
+		assert.False(t, sameInode(a, a))
+		assert.False(t, sameInode(nil, a))
+	})
+}
+
+func TestWrapAferoMkdirAll(t *testing.T) {
+	t.Run("wrapAferoMkdirAll should return & log the path", func(t *testing.T) {
+		var appFs = afero.NewMemMapFs()
+
+		path := tempdir1 + tempdir2
+		testLogger, hook = setupLogs()
+		assert.NoError(t, wrapAferoMkdirAll(appFs, path))
+
+		_, err := appFs.Stat(path)
+		assert.NoError(t, err)
+
+		err = appFs.RemoveAll(tempdir1)
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("wrapAferoMkdirAll should return ErrMove on err", func(t *testing.T) {
+		path := tempdir1 + tempdir2
+		// Make the fs readonly to force error
+		var appFs = afero.NewReadOnlyFs(afero.NewMemMapFs())
+
+		err := wrapAferoMkdirAll(appFs, path)
+		assert.ErrorIs(t, err, ErrMove)
+		assert.ErrorContains(t, err, testAppFsMkdirAllErr)
+	})
+}
+
+func createAferoTest(t *testing.T, numFiles int, createTestFile bool) (afero.Fs, []file) {
+	// createTestFile
+	var outSourceFile afero.File
+
+	var err error
+
+	dir := getWorkDir()
 
 	// Create AferoFs
 	fs := afero.NewMemMapFs()
@@ -239,7 +441,7 @@ func createAferoTest(t *testing.T, numFiles int, createTestFile bool) (afero.Fs,
 
 	dirs = append(dirs, "mb/FAN/download/")
 	for i := 1; i < 4; i++ {
-		dirs = append(dirs, "datav"+strconv.Itoa(i)+"/staging/download/")
+		dirs = append(dirs, "data"+strconv.Itoa(i)+"/staging/download/")
 	}
 
 	for _, d := range dirs {
@@ -292,12 +494,7 @@ func createAferoTest(t *testing.T, numFiles int, createTestFile bool) (afero.Fs,
 
 		files = append(files, f)
 
-		_, err = out.WriteString(fmt.Sprintf("%v,%v\n", f.id, f.smbName))
-		if err != nil {
-			log.Fatal(err)
-		}
-
-		assert.Nil(t, err)
+		testGBR.addFile(f)
 
 		if createTestFile {
 			_, err = outSourceFile.WriteString(
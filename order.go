@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"sync"
+)
+
+const (
+	orderLog         = "order: %v"
+	orderInvalidLog  = "order: %v is not a supported order; use one of %v"
+	maxFilesLog      = "maxfiles: processing at most %v files"
+	maxFilesNoneLog  = "maxfiles: No limit set; processing all files"
+	maxBytesLog      = "maxbytes: processing at most %v bytes"
+	maxBytesNoneLog  = "maxbytes: No limit set; processing all bytes"
+	limitInvalidLog  = "%v: %v is not a valid limit; setting to no limit"
+	orderedLog       = "setFiles: ordered %v files by %v"
+	fLimitDroppedLog = "%v (file.id:%v) file.size:%v is past -max-files or -max-bytes; not processing file"
+
+	reasonLimit = "past -max-files or -max-bytes"
+
+	orderSizeDesc  = "size-desc"
+	orderSizeAsc   = "size-asc"
+	orderCtimeAsc  = "ctime-asc"
+	orderCtimeDesc = "ctime-desc"
+	orderInput     = "input"
+)
+
+var orders = []string{orderSizeDesc, orderSizeAsc, orderCtimeAsc, orderCtimeDesc, orderInput}
+
+func (e *env) setOrder(order string) {
+	logger := e.logger
+
+	if !slices.Contains(orders, order) {
+		logger.Fatal(fmt.Sprintf(orderInvalidLog, order, orders))
+	}
+
+	e.order = order
+
+	logger.Info(fmt.Sprintf(orderLog, order))
+}
+
+// setLimits sets the most files & bytes to process, where 0 is no limit
+func (e *env) setLimits(maxFiles int, maxBytes int64) {
+	logger := e.logger
+
+	if maxFiles < 0 {
+		logger.Warn(fmt.Sprintf(limitInvalidLog, maxFilesArgTxt, maxFiles))
+
+		maxFiles = 0
+	}
+
+	if maxBytes < 0 {
+		logger.Warn(fmt.Sprintf(limitInvalidLog, maxBytesArgTxt, maxBytes))
+
+		maxBytes = 0
+	}
+
+	e.maxFiles = maxFiles
+	e.maxBytes = maxBytes
+
+	if maxFiles == 0 {
+		logger.Info(maxFilesNoneLog)
+	} else {
+		logger.Info(fmt.Sprintf(maxFilesLog, maxFiles))
+	}
+
+	if maxBytes == 0 {
+		logger.Info(maxBytesNoneLog)
+	} else {
+		logger.Info(fmt.Sprintf(maxBytesLog, maxBytes))
+	}
+}
+
+// orderFiles sorts ap.files by e.order. The limits are applied as files
+// pass verify, see limiter
+func (ap *asyncProcessor) orderFiles() {
+	e := ap.env
+
+	if sortFiles(ap.files, e.order) {
+		e.logger.Info(fmt.Sprintf(orderedLog, len(ap.files), e.order))
+	}
+}
+
+// limiter admits files as they pass verify, so that files which are skipped,
+// held or already done do not count, until the next would go past maxFiles
+// or maxBytes. Once one file is refused so is every file after it. A nil
+// limiter admits every file
+type limiter struct {
+	mu       sync.Mutex
+	maxFiles int
+	maxBytes int64
+	files    int
+	bytes    int64
+	full     bool
+}
+
+// newLimiter returns a limiter for maxFiles & maxBytes, where 0 is no limit,
+// or nil if there is no limit at all
+func newLimiter(maxFiles int, maxBytes int64) *limiter {
+	if maxFiles == 0 && maxBytes == 0 {
+		return nil
+	}
+
+	return &limiter{maxFiles: maxFiles, maxBytes: maxBytes}
+}
+
+// admit reports whether a file of size fits in what is left of the limits,
+// counting it if so
+func (l *limiter) admit(size int64) bool {
+	if l == nil {
+		return true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.full ||
+		(l.maxFiles > 0 && l.files == l.maxFiles) ||
+		(l.maxBytes > 0 && l.bytes+size > l.maxBytes) {
+		l.full = true
+		return false
+	}
+
+	l.files++
+	l.bytes += size
+
+	return true
+}
+
+// withinLimits reports whether e.limits admits f, which has passed verify.
+// If not f is left where it is with f.reason set
+func (f *file) withinLimits(e *env) bool {
+	if e.limits.admit(f.size) {
+		return true
+	}
+
+	e.logger.Info(fmt.Sprintf(fLimitDroppedLog, f.smbName, f.id, f.size))
+	f.reason = reasonLimit
+
+	return false
+}
+
+// sortFiles sorts files by order, keeping files that tie in input order. It
+// reports false if order leaves files in input order
+func sortFiles(files []file, order string) bool {
+	var less func(a, b *file) bool
+
+	switch order {
+	case orderSizeDesc:
+		less = func(a, b *file) bool { return a.size > b.size }
+	case orderSizeAsc:
+		less = func(a, b *file) bool { return a.size < b.size }
+	case orderCtimeAsc:
+		less = func(a, b *file) bool { return a.createTime.Before(b.createTime) }
+	case orderCtimeDesc:
+		less = func(a, b *file) bool { return a.createTime.After(b.createTime) }
+	default:
+		return false
+	}
+
+	sort.SliceStable(files, func(i, j int) bool { return less(&files[i], &files[j]) })
+
+	return true
+}
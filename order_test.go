@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"bou.ke/monkey"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOrderFiles(t *testing.T) {
+	now := time.Now()
+
+	// ids are in size-desc order & createTimes in ctime-asc order
+	testFiles := func() []file {
+		return []file{
+			{id: "b", size: 200, createTime: now.Add(-3 * time.Hour)},
+			{id: "d", size: 50, createTime: now.Add(-1 * time.Hour)},
+			{id: "a", size: 300, createTime: now.Add(-4 * time.Hour)},
+			{id: "c", size: 100, createTime: now.Add(-2 * time.Hour)},
+		}
+	}
+
+	ids := func(files []file) (ids []string) {
+		for _, f := range files {
+			ids = append(ids, f.id)
+		}
+
+		return ids
+	}
+
+	tests := []struct {
+		order string
+		want  []string
+	}{
+		{order: orderInput, want: []string{"b", "d", "a", "c"}},
+		{order: orderSizeDesc, want: []string{"a", "b", "c", "d"}},
+		{order: orderSizeAsc, want: []string{"d", "c", "b", "a"}},
+		{order: orderCtimeAsc, want: []string{"a", "b", "c", "d"}},
+		{order: orderCtimeDesc, want: []string{"d", "c", "b", "a"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.order, func(t *testing.T) {
+			e := new(env)
+			e.logger, hook = setupLogs()
+			e.order = tt.order
+			e.maxFiles = 1
+
+			ap := &asyncProcessor{env: e, files: testFiles()}
+			ap.orderFiles()
+
+			assert.Equal(t, tt.want, ids(ap.files))
+		})
+	}
+}
+
+func TestLimiter(t *testing.T) {
+	// sizes are in size-desc order
+	sizes := []int64{300, 200, 100, 50}
+
+	tests := []struct {
+		maxFiles int
+		maxBytes int64
+		want     []bool
+	}{
+		{maxFiles: 2, want: []bool{true, true, false, false}},
+		{maxBytes: 550, want: []bool{true, true, false, false}},
+		{maxBytes: 600, want: []bool{true, true, true, false}},
+		{maxFiles: 1, maxBytes: 600, want: []bool{true, false, false, false}},
+		{maxFiles: 10, maxBytes: 1000, want: []bool{true, true, true, true}},
+		{maxBytes: 100, want: []bool{false, false, false, false}},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("max-files=%v max-bytes=%v", tt.maxFiles, tt.maxBytes), func(t *testing.T) {
+			l := newLimiter(tt.maxFiles, tt.maxBytes)
+
+			var got []bool
+
+			for _, size := range sizes {
+				got = append(got, l.admit(size))
+			}
+
+			assert.Equal(t, tt.want, got)
+		})
+	}
+
+	t.Run("no limits should admit every file", func(t *testing.T) {
+		l := newLimiter(0, 0)
+		assert.Nil(t, l)
+		assert.True(t, l.admit(mebibyte))
+	})
+}
+
+func TestProcessFilesLimits(t *testing.T) {
+	t.Run("only files that pass verify should count towards the limits", func(t *testing.T) {
+		afs, files := createAferoTest(t, 3, false)
+		hostname, _ := os.Hostname()
+		ips, _ := net.LookupIP(hostname)
+		e := new(env)
+
+		e.logger, hook = setupLogs()
+		e.afs = afs
+		e.fsys = afero.NewIOFS(afs)
+		e.sysIPs = []net.IP{ips[0]}
+		e.datasetID = testDatasetID
+		e.gbr = testGBR
+		e.maxFiles = 1
+
+		files[0].fanIP = net.ParseIP("0.0.0.0")
+
+		ap := NewAsyncProcessor(e, files)
+		ap.processFiles()
+
+		counts := map[string]int{}
+
+		for _, r := range ap.getResults() {
+			counts[r.Status]++
+		}
+
+		assert.Equal(t, map[string]int{statusSkipped: 1, statusMoved: 1, statusLimited: 1}, counts)
+		assertCorrectString(t, ap.getResults()[0].Reason, reasonIPMismatch)
+
+		var out bytes.Buffer
+
+		ap.printSummary(&out)
+		assert.Contains(t, out.String(), statusLimited)
+		assert.Contains(t, out.String(), reasonLimit)
+	})
+}
+
+func TestSetOrder(t *testing.T) {
+	for _, order := range orders {
+		t.Run("should set "+order, func(t *testing.T) {
+			e := new(env)
+			e.logger, hook = setupLogs()
+
+			e.setOrder(order)
+			assertCorrectString(t, e.order, order)
+
+			gotLogMsg := hook.LastEntry().Message
+			wantLogMsg := fmt.Sprintf(orderLog, order)
+			assertCorrectString(t, gotLogMsg, wantLogMsg)
+		})
+	}
+
+	t.Run("should fatal on an unknown order", func(t *testing.T) {
+		patch := monkey.Patch(os.Exit, func(int) { panic(osPanicTrue) })
+		defer patch.Unpatch()
+
+		e := new(env)
+		e.logger, hook = setupLogs()
+
+		panicFunc := func() { e.setOrder(testName) }
+		assert.PanicsWithValue(t, osPanicTrue, panicFunc, osPanicFalse)
+
+		gotLogMsg := hook.LastEntry().Message
+		wantLogMsg := fmt.Sprintf(orderInvalidLog, testName, orders)
+		assertCorrectString(t, gotLogMsg, wantLogMsg)
+	})
+}
+
+func TestSetLimits(t *testing.T) {
+	t.Run("should set limits", func(t *testing.T) {
+		e := new(env)
+		e.logger, hook = setupLogs()
+
+		e.setLimits(10, mebibyte)
+		assert.Equal(t, 10, e.maxFiles)
+		assert.Equal(t, int64(mebibyte), e.maxBytes)
+
+		gotLogMsg := hook.LastEntry().Message
+		wantLogMsg := fmt.Sprintf(maxBytesLog, mebibyte)
+		assertCorrectString(t, gotLogMsg, wantLogMsg)
+	})
+
+	t.Run("should set negative limits to no limit", func(t *testing.T) {
+		e := new(env)
+		e.logger, hook = setupLogs()
+
+		e.setLimits(-1, -1)
+		assert.Zero(t, e.maxFiles)
+		assert.Zero(t, e.maxBytes)
+
+		var gotLogMsgs []string
+
+		for _, entry := range hook.AllEntries() {
+			gotLogMsgs = append(gotLogMsgs, entry.Message)
+		}
+
+		assert.Contains(t, gotLogMsgs, fmt.Sprintf(limitInvalidLog, maxFilesArgTxt, -1))
+		assert.Contains(t, gotLogMsgs, fmt.Sprintf(limitInvalidLog, maxBytesArgTxt, -1))
+		assert.Contains(t, gotLogMsgs, maxFilesNoneLog)
+		assertCorrectString(t, hook.LastEntry().Message, maxBytesNoneLog)
+	})
+}
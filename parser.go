@@ -18,11 +18,16 @@ const (
 	idLog          = "%v; file.id: %v"
 	fanIPLog       = "%v; file.fanIP: %v"
 
+	errFieldCount = "%w: line has %v fields; want at least %v"
+	errCreateTime = "%w: file.id:%v createTime: %w"
+
 	easternTime = "America/New_York"
+	// numFields is the number of | separated fields in a sourcefile line
+	numFields = 6
 )
 
 func parseSourceFile(e *env) []string {
-	afs = e.afs
+	afs := e.afs
 	sf := e.sourceFile
 	logger := e.logger
 
@@ -56,10 +61,16 @@ func parseSourceFile(e *env) []string {
 	return lines
 }
 
-func parseLine(line string, e *env) file {
+// parseLine returns the file described by line. A malformed line returns an
+// error wrapping ErrParse
+func parseLine(line string, e *env) (file, error) {
 	var dateTime time.Time
 
 	fileMetadata := strings.SplitAfter(line, "|")
+	if len(fileMetadata) < numFields {
+		return file{}, fmt.Errorf(errFieldCount, ErrParse, len(fileMetadata), numFields)
+	}
+
 	// len-1 because the last split is empty
 	for i := 0; i < len(fileMetadata)-1; i++ {
 		fileMetadata[i] = fileMetadata[i][0 : len(fileMetadata[i])-1]
@@ -84,12 +95,12 @@ func parseLine(line string, e *env) file {
 		loc, err := time.LoadLocation(easternTime)
 
 		if err != nil {
-			e.logger.Fatal(err)
+			return file{}, err
 		}
 
 		dateTime, err = time.ParseInLocation(time.UnixDate, dateTimeString, loc)
 		if err != nil {
-			e.logger.Fatal(err)
+			return file{}, fmt.Errorf(errCreateTime, ErrParse, id, err)
 		}
 	} else {
 		dateTime = time.Unix(dateTimeInt, 0)
@@ -115,5 +126,5 @@ func parseLine(line string, e *env) file {
 		id:          id,
 		fanIP:       fanIP}
 
-	return file
+	return file, nil
 }
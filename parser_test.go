@@ -49,9 +49,7 @@ var (
 )
 
 func TestParseFile(t *testing.T) {
-	e = new(env)
-	files = []file{}
-	ap = NewAsyncProcessor(e, files)
+	e := new(env)
 
 	t.Run("test parseFile", func(t *testing.T) {
 		parsingTests := []struct {
@@ -137,14 +135,13 @@ func TestParseFile(t *testing.T) {
 }
 
 func TestParseLine(t *testing.T) {
-	e = new(env)
-	files = []file{}
-	ap = NewAsyncProcessor(e, files)
+	e := new(env)
 
 	t.Run("verify ParseLine", func(t *testing.T) {
 		e.logger, hook = setupLogs()
 		onelineParsed := oneline
-		workingFile := parseLine(onelineParsed, e)
+		workingFile, err := parseLine(onelineParsed, e)
+		assert.NoError(t, err)
 
 		parsingTests := []struct {
 			name string
@@ -204,68 +201,53 @@ func TestParseLine(t *testing.T) {
 		strconvParseIntErr := fmt.Sprintf(testDateNotIntErr, testOldDate)
 
 		e.logger, hook = setupLogs()
-		parseLine(onelineOldDate, e)
+
+		_, err := parseLine(onelineOldDate, e)
+		assert.NoError(t, err)
 
 		gotLogMsg := hook.Entries[2].Message
-		err := strconvParseIntErr
-		wantLogMsg := err
+		wantLogMsg := strconvParseIntErr
 
 		assertCorrectString(t, gotLogMsg, wantLogMsg)
 	})
 
-	t.Run("it should panic if time.LoadLocation fails", func(t *testing.T) {
-		fakeExit := func(int) {
-			panic(osPanicTrue)
-		}
-
-		patch := monkey.Patch(os.Exit, fakeExit)
-		defer patch.Unpatch()
-
+	t.Run("it should return the err if time.LoadLocation fails", func(t *testing.T) {
 		fakeLoadLoc := func(string) (*time.Location, error) {
 			err := errors.New(testTimeLoadLocError)
 			return nil, err
 		}
 
-		patch2 := monkey.Patch(time.LoadLocation, fakeLoadLoc)
-		defer patch2.Unpatch()
+		patch := monkey.Patch(time.LoadLocation, fakeLoadLoc)
+		defer patch.Unpatch()
 
 		e.logger, hook = setupLogs()
-		panicFunc := func() { parseLine(onelineOldDate, e) }
-
-		assert.PanicsWithValue(t, osPanicTrue, panicFunc, osPanicFalse)
 
-		gotLogMsg := hook.LastEntry().Message
-		err := testTimeLoadLocError
-		wantLogMsg := err
-
-		assertCorrectString(t, gotLogMsg, wantLogMsg)
+		_, err := parseLine(onelineOldDate, e)
+		assert.EqualError(t, err, testTimeLoadLocError)
+		assert.Equal(t, classAbort, classify(err))
 	})
 
-	t.Run("it should panic if time.ParseInLocation fails", func(t *testing.T) {
-		fakeExit := func(int) {
-			panic(osPanicTrue)
-		}
-
-		patch := monkey.Patch(os.Exit, fakeExit)
-		defer patch.Unpatch()
-
+	t.Run("it should return ErrParse if time.ParseInLocation fails", func(t *testing.T) {
 		fakeParseInLoc := func(string, string, *time.Location) (time.Time, error) {
 			err := errors.New(testTimeParseInLocErr)
 			return time.Time{}, err
 		}
 
-		patch2 := monkey.Patch(time.ParseInLocation, fakeParseInLoc)
-		defer patch2.Unpatch()
+		patch := monkey.Patch(time.ParseInLocation, fakeParseInLoc)
+		defer patch.Unpatch()
 
 		e.logger, hook = setupLogs()
-		panicFunc := func() { parseLine(onelineOldDate, e) }
 
-		assert.PanicsWithValue(t, osPanicTrue, panicFunc, osPanicFalse)
+		_, err := parseLine(onelineOldDate, e)
+		assert.ErrorIs(t, err, ErrParse)
+		assert.ErrorContains(t, err, testTimeParseInLocErr)
+	})
 
-		gotLogMsg := hook.LastEntry().Message
-		err := testTimeParseInLocErr
-		wantLogMsg := err
+	t.Run("it should return ErrParse if the line has too few fields", func(t *testing.T) {
+		e.logger, hook = setupLogs()
 
-		assertCorrectString(t, gotLogMsg, wantLogMsg)
+		_, err := parseLine(testSmbName+"|"+testStagingPath, e)
+		assert.ErrorIs(t, err, ErrParse)
+		assert.Empty(t, hook.Entries)
 	})
 }
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+const (
+	planWrittenLog    = "plan: wrote %v entries & %v skipped files to %v"
+	planLoadedLog     = "plan: loaded %v entries from %v created at %v"
+	planEntryStatLog  = "%v (file.id:%v) planned file.stagingPath:%v: %v; skipping file"
+	fPlannedLog       = "%v (file.id:%v) planned move from:%v to:%v"
+	fPlanSkippedLog   = "%v (file.id:%v) not planned with f.reason:%v"
+	fPlanDriftLog     = "%v (file.id:%v) file.stagingPath:%v %v since planning; skipping file"
+	fPlanUnchangedLog = "%v (file.id:%v) file.stagingPath:%v is unchanged since planning"
+
+	planDriftSize = "size changed from %v to %v"
+	planDriftTime = "modTime changed from %v to %v"
+	planDriftHash = "hash changed from %v to %x"
+
+	reasonHashErr   = "stagingPath could not be hashed"
+	reasonPlanDrift = "stagingPath has changed since planning"
+)
+
+// plan is what plan writes for review & apply executes. Entries are the files
+// that will move, Skipped the files that will not & why
+type plan struct {
+	Created    time.Time   `json:"created"`
+	SourceFile string      `json:"sourceFile"`
+	DatasetID  string      `json:"datasetId"`
+	HashAlgo   string      `json:"hashAlgo"`
+	Entries    []planEntry `json:"entries"`
+	Skipped    []planSkip  `json:"skipped"`
+}
+
+// planEntry is a file as verified & hashed at plan time. Collision is how plan
+// resolved a NewPath that already existed, if one did
+type planEntry struct {
+	ID         string    `json:"id"`
+	SmbName    string    `json:"smbName"`
+	FanIP      string    `json:"fanIp"`
+	OldPath    string    `json:"oldPath"`
+	NewPath    string    `json:"newPath"`
+	Size       int64     `json:"size"`
+	CreateTime time.Time `json:"createTime"`
+	ModTime    time.Time `json:"modTime"`
+	Hash       string    `json:"hash"`
+	Collision  string    `json:"collision,omitempty"`
+}
+
+// planSkip is a file that plan will not move
+type planSkip struct {
+	ID      string `json:"id"`
+	SmbName string `json:"smbName"`
+	OldPath string `json:"oldPath"`
+	Reason  string `json:"reason"`
+}
+
+// planFiles verifies & hashes ap.files & writes the plan to e.planFile
+// without moving anything
+func (ap *asyncProcessor) planFiles() {
+	e := ap.env
+
+	ap.forEachFile(func(f *file) error { return f.plan(e) })
+	ap.collect(statusPlanned)
+
+	p := plan{
+		Created:    time.Now().UTC(),
+		SourceFile: e.sourceFile,
+		DatasetID:  e.datasetID,
+		HashAlgo:   e.hashName(),
+		Entries:    []planEntry{},
+		Skipped:    []planSkip{},
+	}
+
+	for _, f := range ap.files {
+		if f.planned == nil {
+			p.Skipped = append(p.Skipped, planSkip{
+				ID:      f.id,
+				SmbName: f.smbName,
+				OldPath: f.stagingPath,
+				Reason:  f.reason,
+			})
+
+			continue
+		}
+
+		p.Entries = append(p.Entries, *f.planned)
+	}
+
+	data, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		e.logger.Fatal(err)
+	}
+
+	err = afero.WriteFile(e.afs, e.planFile, data, 0644)
+	if err != nil {
+		e.logger.Fatal(err)
+	}
+
+	e.logger.Info(fmt.Sprintf(planWrittenLog, len(p.Entries), len(p.Skipped), e.planFile))
+}
+
+// plan verifies & hashes f & works out where it would move to, recording
+// the result in f.planned, or f.reason if it would not move
+func (f *file) plan(e *env) error {
+	stop := stopwatch(&f.timings.verify)
+	ok, err := f.verify(e)
+
+	stop()
+
+	if err != nil {
+		return err
+	}
+
+	if !ok {
+		e.logger.Warn(fmt.Sprintf(fPlanSkippedLog, f.smbName, f.id, f.reason))
+		return nil
+	}
+
+	if !f.withinLimits(e) {
+		return nil
+	}
+
+	stop = stopwatch(&f.timings.preHash)
+	err = f.hasher(e)
+
+	stop()
+
+	if err != nil {
+		f.reason = reasonHashErr
+		e.logger.Warn(fmt.Sprintf(fPlanSkippedLog, f.smbName, f.id, f.reason))
+
+		return nil
+	}
+
+	f.oldHash = f.hash
+
+	dst, err := newPath(*f, e)
+	if err != nil {
+		e.logger.Fatal(err)
+	}
+
+	newPath := dst
+
+	dst, ok = f.resolveCollision(dst, e)
+	if !ok {
+		e.logger.Warn(fmt.Sprintf(fPlanSkippedLog, f.smbName, f.id, f.reason))
+		return f.collisionErr(newPath)
+	}
+
+	f.planned = &planEntry{
+		ID:         f.id,
+		SmbName:    f.smbName,
+		FanIP:      f.fanIP.String(),
+		OldPath:    f.stagingPath,
+		NewPath:    dst,
+		Size:       f.fileInfo.Size(),
+		CreateTime: f.createTime,
+		ModTime:    f.fileInfo.ModTime(),
+		Hash:       hex.EncodeToString(f.hash),
+	}
+
+	if f.collision != collisionNone {
+		f.planned.Collision = f.collision.String()
+	}
+
+	e.logger.Info(fmt.Sprintf(fPlannedLog, f.smbName, f.id, f.stagingPath, dst))
+
+	return nil
+}
+
+// loadPlan reads e.planFile & sets ap.files to its entries. The plan's
+// dataset & hash algorithm replace any set by flags
+func (ap *asyncProcessor) loadPlan() {
+	e := ap.env
+	logger := e.logger
+
+	data, err := afero.ReadFile(e.afs, e.planFile)
+	if err != nil {
+		logger.Fatal(err)
+	}
+
+	var p plan
+
+	err = json.Unmarshal(data, &p)
+	if err != nil {
+		logger.Fatal(err)
+	}
+
+	e.must(e.setDatasetID(p.DatasetID))
+	e.setHashAlgo(p.HashAlgo)
+
+	for i := range p.Entries {
+		entry := p.Entries[i]
+
+		f := file{
+			id:          entry.ID,
+			smbName:     entry.SmbName,
+			createTime:  entry.CreateTime,
+			size:        entry.Size,
+			datasetID:   p.DatasetID,
+			fanIP:       net.ParseIP(entry.FanIP),
+			stagingPath: entry.OldPath,
+			planned:     &entry,
+		}
+
+		f.resumeFrom(e)
+
+		f.fileInfo, err = e.afs.Stat(f.stagingPath)
+		if err != nil {
+			logger.Error(fmt.Sprintf(planEntryStatLog, f.smbName, f.id, f.stagingPath, err))
+			continue
+		}
+
+		ap.files = append(ap.files, f)
+	}
+
+	logger.Info(fmt.Sprintf(planLoadedLog, len(p.Entries), e.planFile, p.Created))
+}
+
+// verifyPlan reports whether f is the same size, modTime & hash as when it
+// was planned. Files that were not loaded from a plan always pass
+func (f *file) verifyPlan(e *env) bool {
+	if f.planned == nil {
+		return true
+	}
+
+	var drift string
+
+	switch {
+	case f.fileInfo.Size() != f.planned.Size:
+		drift = fmt.Sprintf(planDriftSize, f.planned.Size, f.fileInfo.Size())
+	case !f.fileInfo.ModTime().Equal(f.planned.ModTime):
+		drift = fmt.Sprintf(planDriftTime, f.planned.ModTime, f.fileInfo.ModTime())
+	case hex.EncodeToString(f.hash) != f.planned.Hash:
+		drift = fmt.Sprintf(planDriftHash, f.planned.Hash, f.hash)
+	}
+
+	if drift != "" {
+		e.logger.Warn(fmt.Sprintf(fPlanDriftLog, f.smbName, f.id, f.stagingPath, drift))
+		f.reason = reasonPlanDrift
+
+		return false
+	}
+
+	e.logger.Info(fmt.Sprintf(fPlanUnchangedLog, f.smbName, f.id, f.stagingPath))
+
+	return true
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+const testPlanFile = "plan.json"
+
+func TestPlanFiles(t *testing.T) {
+	setup := func(t *testing.T, numFiles int) (*env, afero.Fs, []file) {
+		afs, files := createAferoTest(t, numFiles, false)
+		hostname, _ := os.Hostname()
+		ips, _ := net.LookupIP(hostname)
+		e := new(env)
+
+		e.logger, hook = setupLogs()
+		e.afs = afs
+		e.fsys = afero.NewIOFS(afs)
+		e.sysIPs = []net.IP{ips[0]}
+		e.datasetID = testDatasetID
+		e.gbr = testGBR
+		e.planFile = testPlanFile
+
+		return e, afs, files
+	}
+
+	readPlan := func(t *testing.T, afs afero.Fs) plan {
+		t.Helper()
+
+		data, err := afero.ReadFile(afs, testPlanFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var p plan
+
+		err = json.Unmarshal(data, &p)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return p
+	}
+
+	t.Run("plan should write each file without moving it", func(t *testing.T) {
+		e, afs, files := setup(t, 5)
+		ap := NewAsyncProcessor(e, files)
+
+		ap.planFiles()
+
+		p := readPlan(t, afs)
+		assertCorrectString(t, p.DatasetID, testDatasetID)
+		assertCorrectString(t, p.HashAlgo, hashSHA256)
+		assert.Len(t, p.Entries, len(files))
+		assert.Empty(t, p.Skipped)
+
+		for i, entry := range p.Entries {
+			f := files[i]
+
+			content, err := afero.ReadFile(afs, f.stagingPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			sum, err := hashFile(f.stagingPath, e)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			assertCorrectString(t, entry.ID, f.id)
+			assertCorrectString(t, entry.OldPath, f.stagingPath)
+			assertCorrectString(t, entry.NewPath, mustNewPath(t, f))
+			assert.Equal(t, int64(len(content)), entry.Size)
+			assert.True(t, entry.ModTime.Equal(f.fileInfo.ModTime()))
+			assertCorrectString(t, entry.Hash, hex.EncodeToString(sum))
+
+			_, err = afs.Stat(entry.NewPath)
+			assert.Error(t, err)
+		}
+
+		gotLogMsg := hook.LastEntry().Message
+		wantLogMsg := fmt.Sprintf(planWrittenLog, len(files), 0, testPlanFile)
+		assertCorrectString(t, gotLogMsg, wantLogMsg)
+	})
+
+	t.Run("plan should list the files it skips & why", func(t *testing.T) {
+		e, afs, files := setup(t, 2)
+		ap := NewAsyncProcessor(e, files)
+
+		err := afs.Remove(files[1].stagingPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ap.planFiles()
+
+		p := readPlan(t, afs)
+		assert.Len(t, p.Entries, 1)
+		assert.Len(t, p.Skipped, 1)
+		assertCorrectString(t, p.Skipped[0].ID, files[1].id)
+		assertCorrectString(t, p.Skipped[0].Reason, reasonNotExist)
+	})
+
+	t.Run("apply should move each file exactly as planned", func(t *testing.T) {
+		e, afs, files := setup(t, 5)
+		NewAsyncProcessor(e, files).planFiles()
+		p := readPlan(t, afs)
+
+		ap := NewAsyncProcessor(e, []file{})
+		ap.loadPlan()
+		ap.processFiles()
+
+		applied := ap.getFiles()
+		assert.Len(t, applied, len(p.Entries))
+
+		for i, entry := range p.Entries {
+			assert.True(t, applied[i].success)
+			assertCorrectString(t, applied[i].stagingPath, entry.NewPath)
+
+			_, err := afs.Stat(entry.NewPath)
+			assert.NoError(t, err)
+		}
+	})
+
+	t.Run("apply should journal hashes with the plan's algorithm, not -hash", func(t *testing.T) {
+		e, afs, files := setup(t, 2)
+		e.hashAlgo = hashMD5
+		NewAsyncProcessor(e, files).planFiles()
+
+		e.hashAlgo = hashSHA256
+
+		j, err := openJournal(afs, testJournalFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		e.journal = j
+
+		ap := NewAsyncProcessor(e, []file{})
+		ap.loadPlan()
+		ap.processFiles()
+		e.closeJournal()
+
+		records, err := readJournal(afs, testJournalFile)
+		assert.NoError(t, err)
+		assert.Len(t, records, len(files))
+
+		for _, rec := range records {
+			assertCorrectString(t, rec.State, statePostVerified)
+			assertCorrectString(t, rec.Algo, hashMD5)
+		}
+	})
+
+	t.Run("apply should fail a file whose planned newPath was created since planning", func(t *testing.T) {
+		for _, policy := range []string{collisionRename, collisionOverwrite} {
+			e, afs, files := setup(t, 1)
+			e.collision = policy
+			NewAsyncProcessor(e, files).planFiles()
+			p := readPlan(t, afs)
+
+			err := afero.WriteFile(afs, p.Entries[0].NewPath, []byte(testCollisionContent), 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ap := NewAsyncProcessor(e, []file{})
+			ap.loadPlan()
+			ap.processFiles()
+
+			applied := ap.getFiles()[0]
+			assert.ErrorIs(t, applied.err, ErrCollision, policy)
+			assertCorrectString(t, applied.reason, reasonCollisionPlanned)
+			assertCorrectString(t, applied.stagingPath, p.Entries[0].OldPath)
+			assertCorrectString(t, ap.getResults()[0].Status, statusFailed)
+
+			got, err := afero.ReadFile(afs, p.Entries[0].NewPath)
+			assert.NoError(t, err)
+			assertCorrectString(t, string(got), testCollisionContent)
+
+			_, err = afs.Stat(fmt.Sprintf(collisionSuffixFmt, p.Entries[0].NewPath, 1))
+			assert.ErrorIs(t, err, fs.ErrNotExist, policy)
+		}
+	})
+
+	t.Run("apply should overwrite a newPath the plan chose to overwrite", func(t *testing.T) {
+		e, afs, files := setup(t, 1)
+		e.collision = collisionOverwrite
+
+		dst := mustNewPath(t, files[0])
+
+		content, err := afero.ReadFile(afs, files[0].stagingPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = afero.WriteFile(afs, dst, content, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		NewAsyncProcessor(e, files).planFiles()
+		p := readPlan(t, afs)
+		assertCorrectString(t, p.Entries[0].Collision, collisionOverwritten.String())
+
+		ap := NewAsyncProcessor(e, []file{})
+		ap.loadPlan()
+		ap.processFiles()
+
+		applied := ap.getFiles()[0]
+		assert.True(t, applied.success, applied.reason)
+		assertCorrectString(t, applied.stagingPath, dst)
+	})
+
+	t.Run("apply should skip a file that changed since planning", func(t *testing.T) {
+		e, afs, files := setup(t, 2)
+		NewAsyncProcessor(e, files).planFiles()
+
+		// same size & modTime but different content
+		info, err := afs.Stat(files[0].stagingPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		mtime := info.ModTime()
+
+		content, err := afero.ReadFile(afs, files[0].stagingPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		content[0]++
+
+		err = afero.WriteFile(afs, files[0].stagingPath, content, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = afs.Chtimes(files[0].stagingPath, mtime, mtime)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ap := NewAsyncProcessor(e, []file{})
+		ap.loadPlan()
+		ap.processFiles()
+
+		applied := ap.getFiles()
+		assert.False(t, applied[0].success)
+		assertCorrectString(t, applied[0].reason, reasonPlanDrift)
+		assertCorrectString(t, applied[0].stagingPath, files[0].stagingPath)
+		assert.True(t, applied[1].success)
+	})
+
+	t.Run("apply should skip a planned file that no longer exists", func(t *testing.T) {
+		e, afs, files := setup(t, 2)
+		NewAsyncProcessor(e, files).planFiles()
+
+		err := afs.Remove(files[0].stagingPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ap := NewAsyncProcessor(e, []file{})
+		ap.loadPlan()
+
+		assert.Len(t, ap.getFiles(), 1)
+		assertCorrectString(t, ap.getFiles()[0].id, files[1].id)
+	})
+}
+
+func TestVerifyPlan(t *testing.T) {
+	e := new(env)
+	e.afs = afero.NewMemMapFs()
+
+	err := afero.WriteFile(e.afs, testPath, []byte(testContent), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fi, err := e.afs.Stat(testPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sum, err := hashFile(testPath, e)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newFile := func(entry planEntry) file {
+		return file{
+			smbName:     testName,
+			id:          testFileID,
+			stagingPath: testPath,
+			fileInfo:    fi,
+			hash:        sum,
+			planned:     &entry,
+		}
+	}
+
+	entry := planEntry{Size: fi.Size(), ModTime: fi.ModTime(), Hash: hex.EncodeToString(sum)}
+
+	t.Run("returns true for a file that is not planned", func(t *testing.T) {
+		e.logger, hook = setupLogs()
+		f := file{}
+
+		assert.True(t, f.verifyPlan(e))
+		assert.Empty(t, hook.Entries)
+	})
+
+	t.Run("returns true for an unchanged file", func(t *testing.T) {
+		e.logger, hook = setupLogs()
+		f := newFile(entry)
+
+		assert.True(t, f.verifyPlan(e))
+
+		gotLogMsg := hook.LastEntry().Message
+		wantLogMsg := fmt.Sprintf(fPlanUnchangedLog, f.smbName, f.id, f.stagingPath)
+		assertCorrectString(t, gotLogMsg, wantLogMsg)
+	})
+
+	t.Run("returns false if the size changed", func(t *testing.T) {
+		e.logger, hook = setupLogs()
+		changed := entry
+		changed.Size++
+		f := newFile(changed)
+
+		assert.False(t, f.verifyPlan(e))
+		assertCorrectString(t, f.reason, reasonPlanDrift)
+
+		gotLogMsg := hook.LastEntry().Message
+		wantLogMsg := fmt.Sprintf(fPlanDriftLog, f.smbName, f.id, f.stagingPath,
+			fmt.Sprintf(planDriftSize, changed.Size, fi.Size()))
+		assertCorrectString(t, gotLogMsg, wantLogMsg)
+	})
+
+	t.Run("returns false if the modTime changed", func(t *testing.T) {
+		e.logger, hook = setupLogs()
+		changed := entry
+		changed.ModTime = changed.ModTime.Add(-1)
+		f := newFile(changed)
+
+		assert.False(t, f.verifyPlan(e))
+		assertCorrectString(t, f.reason, reasonPlanDrift)
+	})
+
+	t.Run("returns false if the hash changed", func(t *testing.T) {
+		e.logger, hook = setupLogs()
+		changed := entry
+		changed.Hash = hex.EncodeToString([]byte(testContent))
+		f := newFile(changed)
+
+		assert.False(t, f.verifyPlan(e))
+		assertCorrectString(t, f.reason, reasonPlanDrift)
+
+		gotLogMsg := hook.LastEntry().Message
+		wantLogMsg := fmt.Sprintf(fPlanDriftLog, f.smbName, f.id, f.stagingPath,
+			fmt.Sprintf(planDriftHash, changed.Hash, sum))
+		assertCorrectString(t, gotLogMsg, wantLogMsg)
+	})
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+const (
+	reportLog        = "report: writing results to %v"
+	reportNoneLog    = "report: No report file set; only printing summary"
+	reportInvalidLog = "report: %v must end in one of %v"
+	reportWrittenLog = "report: %v results written to %v"
+
+	reportJSON = ".json"
+	reportCSV  = ".csv"
+)
+
+var (
+	reportFormats = []string{reportJSON, reportCSV}
+
+	// reportHeader is the first row of a CSV report & matches the JSON keys
+	reportHeader = []string{
+		"smbName", "id", "fanIP", "datasetID", "stagingPath", "newPath", "size",
+		"createTime", "preHash", "postHash", "status", "reason",
+		"verify", "preHashTime", "move", "postHashTime",
+		"holdOwnerID", "holdMatterID", "collision",
+	}
+)
+
+func (e *env) setReport(pth string) {
+	logger := e.logger
+
+	if pth == "" {
+		logger.Info(reportNoneLog)
+		return
+	}
+
+	ext := strings.ToLower(filepath.Ext(pth))
+	if ext != reportJSON && ext != reportCSV {
+		logger.Fatal(fmt.Sprintf(reportInvalidLog, pth, reportFormats))
+	}
+
+	e.reportFile = pth
+
+	logger.Info(fmt.Sprintf(reportLog, pth))
+}
+
+// writeReport writes ap's results to e.reportFile as JSON or CSV, going by
+// its extension. It is a no-op unless -report is set
+func (ap *asyncProcessor) writeReport() {
+	e := ap.env
+
+	if e.reportFile == "" {
+		return
+	}
+
+	var (
+		data []byte
+		err  error
+	)
+
+	if strings.ToLower(filepath.Ext(e.reportFile)) == reportCSV {
+		data, err = reportToCSV(ap.results)
+	} else {
+		data, err = json.MarshalIndent(ap.results, "", "  ")
+	}
+
+	if err != nil {
+		e.logger.Fatal(err)
+	}
+
+	// A dryrun still writes its report
+	afs := e.outFs
+	if afs == nil {
+		afs = e.afs
+	}
+
+	err = afero.WriteFile(afs, e.reportFile, data, 0644)
+	if err != nil {
+		e.logger.Fatal(err)
+	}
+
+	e.logger.Info(fmt.Sprintf(reportWrittenLog, len(ap.results), e.reportFile))
+}
+
+func reportToCSV(results []result) ([]byte, error) {
+	var buf bytes.Buffer
+
+	w := csv.NewWriter(&buf)
+
+	err := w.Write(reportHeader)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, r := range results {
+		err = w.Write([]string{
+			r.SmbName,
+			r.ID,
+			r.FanIP,
+			r.DatasetID,
+			r.StagingPath,
+			r.NewPath,
+			strconv.FormatInt(r.Size, 10),
+			r.CreateTime.Format(time.RFC3339),
+			r.PreHash,
+			r.PostHash,
+			r.Status,
+			r.Reason,
+			r.Verify.String(),
+			r.PreHashTime.String(),
+			r.Move.String(),
+			r.PostHashTime.String(),
+			r.HoldOwnerID,
+			r.HoldMatterID,
+			r.Collision,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	w.Flush()
+
+	return buf.Bytes(), w.Error()
+}
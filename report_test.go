@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"testing"
+
+	"bou.ke/monkey"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	testReportJSON = "report.json"
+	testReportCSV  = "report.csv"
+)
+
+func TestWriteReport(t *testing.T) {
+	setup := func(t *testing.T, report string, held bool) (afero.Fs, AsyncProcessor) {
+		afs, files := createAferoTest(t, 2, false)
+		hostname, _ := os.Hostname()
+		ips, _ := net.LookupIP(hostname)
+		e := new(env)
+
+		e.logger, hook = setupLogs()
+		e.afs = afs
+		e.fsys = afero.NewIOFS(afs)
+		e.sysIPs = []net.IP{ips[0]}
+		e.datasetID = testDatasetID
+		e.gbr = testGBR
+		e.reportFile = report
+
+		files[1].fanIP = net.ParseIP("0.0.0.0")
+
+		if held {
+			gbr := newFakeGBRClient(testDatasetID)
+			gbr.addFile(files[0])
+			gbr.holdFile(files[0].id, testHoldOwnerID, testHoldMatterID)
+
+			e.gbr = gbr
+		}
+
+		ap := NewAsyncProcessor(e, files)
+		ap.processFiles()
+
+		return afs, ap
+	}
+
+	t.Run("should write results as JSON", func(t *testing.T) {
+		afs, ap := setup(t, testReportJSON, false)
+		ap.writeReport()
+
+		data, err := afero.ReadFile(afs, testReportJSON)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want, err := json.Marshal(ap.getResults())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assert.JSONEq(t, string(want), string(data))
+
+		gotLogMsg := hook.LastEntry().Message
+		wantLogMsg := fmt.Sprintf(reportWrittenLog, 2, testReportJSON)
+		assertCorrectString(t, gotLogMsg, wantLogMsg)
+	})
+
+	t.Run("should write results as CSV", func(t *testing.T) {
+		afs, ap := setup(t, testReportCSV, false)
+		ap.writeReport()
+
+		data, err := afero.ReadFile(afs, testReportCSV)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rows, err := csv.NewReader(bytes.NewReader(data)).ReadAll()
+		assert.NoError(t, err)
+		assert.Len(t, rows, 3)
+		assert.Equal(t, reportHeader, rows[0])
+
+		results := ap.getResults()
+
+		for i, row := range rows[1:] {
+			assert.Len(t, row, len(reportHeader))
+			assertCorrectString(t, row[0], results[i].SmbName)
+			assertCorrectString(t, row[1], results[i].ID)
+			assertCorrectString(t, row[2], results[i].FanIP)
+			assertCorrectString(t, row[4], results[i].StagingPath)
+			assertCorrectString(t, row[5], results[i].NewPath)
+			assertCorrectString(t, row[10], results[i].Status)
+			assertCorrectString(t, row[11], results[i].Reason)
+		}
+
+		assertCorrectString(t, rows[2][10], statusSkipped)
+		assertCorrectString(t, rows[2][11], reasonIPMismatch)
+	})
+
+	t.Run("should list held files with their hold", func(t *testing.T) {
+		afs, ap := setup(t, testReportCSV, true)
+		ap.writeReport()
+
+		data, err := afero.ReadFile(afs, testReportCSV)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rows, err := csv.NewReader(bytes.NewReader(data)).ReadAll()
+		assert.NoError(t, err)
+		assert.Equal(t, []string{statusHeld, reasonLegalHold, testHoldOwnerID, testHoldMatterID, ""},
+			[]string{rows[1][10], rows[1][11], rows[1][16], rows[1][17], rows[1][18]})
+	})
+
+	t.Run("should write the report when -dryrun makes e.afs read only", func(t *testing.T) {
+		afs, ap := setup(t, testReportJSON, false)
+
+		e := ap.getEnv()
+		e.afs = afero.NewReadOnlyFs(afs)
+		e.outFs = afs
+
+		ap.writeReport()
+
+		_, err := afs.Stat(testReportJSON)
+		assert.NoError(t, err)
+
+		gotLogMsg := hook.LastEntry().Message
+		wantLogMsg := fmt.Sprintf(reportWrittenLog, 2, testReportJSON)
+		assertCorrectString(t, gotLogMsg, wantLogMsg)
+	})
+
+	t.Run("should write nothing without -report", func(t *testing.T) {
+		afs, ap := setup(t, "", false)
+		ap.writeReport()
+
+		for _, pth := range []string{testReportJSON, testReportCSV} {
+			_, err := afs.Stat(pth)
+			assert.Error(t, err)
+		}
+	})
+}
+
+func TestSetReport(t *testing.T) {
+	fakeExit := func(int) {
+		panic(osPanicTrue)
+	}
+
+	for _, pth := range []string{testReportJSON, testReportCSV, "REPORT.CSV"} {
+		t.Run("should set "+pth, func(t *testing.T) {
+			e := new(env)
+			e.logger, hook = setupLogs()
+
+			e.setReport(pth)
+			assertCorrectString(t, e.reportFile, pth)
+
+			gotLogMsg := hook.LastEntry().Message
+			wantLogMsg := fmt.Sprintf(reportLog, pth)
+			assertCorrectString(t, gotLogMsg, wantLogMsg)
+		})
+	}
+
+	t.Run("should not set an empty report", func(t *testing.T) {
+		e := new(env)
+		e.logger, hook = setupLogs()
+
+		e.setReport("")
+		assert.Empty(t, e.reportFile)
+
+		gotLogMsg := hook.LastEntry().Message
+		assertCorrectString(t, gotLogMsg, reportNoneLog)
+	})
+
+	t.Run("should fatal on an unknown extension", func(t *testing.T) {
+		patch := monkey.Patch(os.Exit, fakeExit)
+		defer patch.Unpatch()
+
+		e := new(env)
+		e.logger, hook = setupLogs()
+
+		panicFunc := func() { e.setReport(testName) }
+		assert.PanicsWithValue(t, osPanicTrue, panicFunc, osPanicFalse)
+
+		gotLogMsg := hook.LastEntry().Message
+		wantLogMsg := fmt.Sprintf(reportInvalidLog, testName, reportFormats)
+		assertCorrectString(t, gotLogMsg, wantLogMsg)
+	})
+}
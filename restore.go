@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"slices"
+	"sort"
+
+	"github.com/spf13/afero"
+)
+
+const (
+	restoreLoadedLog      = "restore: %v files to restore from %v"
+	restoreSourceLog      = "restore: reading moves from %v"
+	restoreNoSourceLog    = "restore: set one of -plan or -journal"
+	restoreMixedAlgosLog  = "restore: journal %v mixes hash algorithms %v"
+	fRestoreSkipLog       = "(file.id:%v) journal shows state:%v; nothing to restore"
+	fRestoreHashMatchLog  = "%v (file.id:%v) file.hash:%x matches hash at move time"
+	fRestoreHashNoMatch   = "%v (file.id:%v) file.hash:%x does not match hash at move time:%x; refusing to restore"
+	fRestoreNotMovedLog   = "%v (file.id:%v) f.move did not restore file with f.reason:%v; skipping file"
+	fRestoredLog          = "%v (file.id:%v) restored to file.stagingPath:%v"
+	fRestoreHashMismatch  = "%v (file.id:%v) restored file.hash:%x does not match f.oldHash:%x"
+	reasonRestoreMismatch = "hash does not match hash at move time"
+)
+
+// restoreFiles moves each of ap.files back to the stagingPath it was moved
+// from, as loaded by loadRestore
+func (ap *asyncProcessor) restoreFiles() {
+	e := ap.env
+
+	ap.forEachFile(func(f *file) error { return f.restore(e) })
+	ap.collect(statusRestored)
+}
+
+// loadRestore sets ap.files to the files moved by e.planFile or e.journalFile.
+// Each file's stagingPath is where it was moved to, f.oldHash its hash at move
+// time & its planned path where it was moved from. A file no longer where it
+// was moved to is unlisted, so it is still reported
+func (ap *asyncProcessor) loadRestore() {
+	e := ap.env
+	logger := e.logger
+
+	var (
+		entries []planEntry
+		algo    string
+		source  string
+	)
+
+	if e.planFile != "" {
+		source = e.planFile
+		entries, algo = readRestorePlan(e)
+	} else {
+		source = e.journalFile
+		entries, algo = readRestoreJournal(e)
+	}
+
+	if algo != "" {
+		e.setHashAlgo(algo)
+	}
+
+	for _, entry := range entries {
+		hash, err := hex.DecodeString(entry.Hash)
+		if err != nil {
+			logger.Fatal(err)
+		}
+
+		f := file{
+			id:          entry.ID,
+			smbName:     entry.SmbName,
+			stagingPath: entry.NewPath,
+			oldHash:     hash,
+			planned:     &planEntry{NewPath: entry.OldPath},
+		}
+
+		f.fileInfo, err = e.afs.Stat(f.stagingPath)
+		if err != nil {
+			ap.unlist(f, err)
+			continue
+		}
+
+		ap.files = append(ap.files, f)
+	}
+
+	logger.Info(fmt.Sprintf(restoreLoadedLog, len(ap.files), source))
+}
+
+func readRestorePlan(e *env) ([]planEntry, string) {
+	data, err := afero.ReadFile(e.afs, e.planFile)
+	if err != nil {
+		e.logger.Fatal(err)
+	}
+
+	var p plan
+
+	err = json.Unmarshal(data, &p)
+	if err != nil {
+		e.logger.Fatal(err)
+	}
+
+	return p.Entries, p.HashAlgo
+}
+
+// readRestoreJournal returns the files that the journal shows got as far as
+// moving, in the order they were last journaled
+func readRestoreJournal(e *env) ([]planEntry, string) {
+	records, err := readJournal(e.afs, e.journalFile)
+	if err != nil {
+		e.logger.Fatal(err)
+	}
+
+	var entries []planEntry
+
+	algos := map[string]bool{}
+
+	for _, rec := range sortedRecords(records) {
+		if rec.NewPath == "" || rec.Hash == "" {
+			e.logger.Info(fmt.Sprintf(fRestoreSkipLog, rec.ID, rec.State))
+			continue
+		}
+
+		entries = append(entries, planEntry{
+			ID:      rec.ID,
+			SmbName: rec.SmbName,
+			OldPath: rec.OldPath,
+			NewPath: rec.NewPath,
+			Hash:    rec.Hash,
+		})
+		algos[rec.Algo] = true
+	}
+
+	if len(algos) > 1 {
+		e.logger.Fatal(fmt.Sprintf(restoreMixedAlgosLog, e.journalFile, slices.Sorted(maps.Keys(algos))))
+	}
+
+	var algo string
+
+	for a := range algos {
+		algo = a
+	}
+
+	return entries, algo
+}
+
+// sortedRecords returns records in the order they were journaled
+func sortedRecords(records map[string]journalRecord) []journalRecord {
+	sorted := make([]journalRecord, 0, len(records))
+
+	for _, rec := range records {
+		sorted = append(sorted, rec)
+	}
+
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Time.Equal(sorted[j].Time) {
+			return sorted[i].ID < sorted[j].ID
+		}
+
+		return sorted[i].Time.Before(sorted[j].Time)
+	})
+
+	return sorted
+}
+
+// restore re-hashes f where it was moved to & moves it back to where it was
+// moved from, refusing if it no longer has the hash it had at move time
+func (f *file) restore(e *env) error {
+	stop := stopwatch(&f.timings.preHash)
+	err := f.hasher(e)
+
+	stop()
+
+	if err != nil {
+		e.logger.Warn(fmt.Sprintf(adHasherErrLog, f.smbName, f.id, err))
+		f.reason = reasonHashErr
+
+		return nil
+	}
+
+	if !f.compareHashes() {
+		e.logger.Error(fmt.Sprintf(fRestoreHashNoMatch, f.smbName, f.id, f.hash, f.oldHash))
+		f.reason = reasonRestoreMismatch
+
+		return nil
+	}
+
+	e.logger.Info(fmt.Sprintf(fRestoreHashMatchLog, f.smbName, f.id, f.hash))
+
+	f.oldStagingPath = f.stagingPath
+
+	stop = stopwatch(&f.timings.move)
+	moved, err := f.move(e)
+
+	stop()
+
+	if err != nil {
+		return err
+	}
+
+	if !moved {
+		e.logger.Warn(fmt.Sprintf(fRestoreNotMovedLog, f.smbName, f.id, f.reason))
+		return nil
+	}
+
+	if !f.skipPostHash(e) {
+		stop = stopwatch(&f.timings.postHash)
+		err = f.hasher(e)
+
+		stop()
+
+		if err != nil {
+			e.logger.Warn(fmt.Sprintf(adHasherErrLog, f.smbName, f.id, err))
+			f.reason = reasonHashErr
+
+			return nil
+		}
+	}
+
+	if !f.compareHashes() {
+		// Should never happen, as for the forward move
+		return fmt.Errorf(errWrapMsg, ErrHashMismatch,
+			fmt.Sprintf(fRestoreHashMismatch, f.smbName, f.id, f.hash, f.oldHash))
+	}
+
+	f.success = true
+	e.logger.Info(fmt.Sprintf(fRestoredLog, f.smbName, f.id, f.stagingPath))
+
+	return nil
+}
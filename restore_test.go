@@ -0,0 +1,204 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRestoreFiles(t *testing.T) {
+	setup := func(t *testing.T, numFiles int) (*env, afero.Fs, []file) {
+		afs, files := createAferoTest(t, numFiles, false)
+		hostname, _ := os.Hostname()
+		ips, _ := net.LookupIP(hostname)
+		e := new(env)
+
+		e.logger, hook = setupLogs()
+		e.afs = afs
+		e.fsys = afero.NewIOFS(afs)
+		e.sysIPs = []net.IP{ips[0]}
+		e.datasetID = testDatasetID
+		e.gbr = testGBR
+		e.planFile = testPlanFile
+
+		return e, afs, files
+	}
+
+	// applyPlan plans & applies files, returning the applied files
+	applyPlan := func(t *testing.T, e *env, files []file) []file {
+		t.Helper()
+
+		NewAsyncProcessor(e, files).planFiles()
+
+		ap := NewAsyncProcessor(e, []file{})
+		ap.loadPlan()
+		ap.processFiles()
+
+		for _, f := range ap.getFiles() {
+			if !f.success {
+				t.Fatal(f.reason)
+			}
+		}
+
+		return ap.getFiles()
+	}
+
+	restore := func(e *env) []file {
+		ap := NewAsyncProcessor(e, []file{})
+		ap.loadRestore()
+		ap.restoreFiles()
+
+		return ap.getFiles()
+	}
+
+	t.Run("should restore each file in a plan", func(t *testing.T) {
+		e, afs, files := setup(t, 3)
+		applied := applyPlan(t, e, files)
+
+		restored := restore(e)
+		assert.Len(t, restored, len(files))
+
+		for i, f := range restored {
+			assert.True(t, f.success, f.reason)
+			assertCorrectString(t, f.stagingPath, files[i].stagingPath)
+
+			_, err := afs.Stat(files[i].stagingPath)
+			assert.NoError(t, err)
+
+			_, err = afs.Stat(applied[i].stagingPath)
+			assert.Error(t, err)
+		}
+
+		var gotLogMsgs []string
+
+		for _, entry := range hook.AllEntries() {
+			gotLogMsgs = append(gotLogMsgs, entry.Message)
+		}
+
+		wantLogMsg := fmt.Sprintf(fRestoredLog, restored[2].smbName, restored[2].id, files[2].stagingPath)
+		assert.Contains(t, gotLogMsgs, wantLogMsg)
+	})
+
+	t.Run("should restore each moved file in a journal", func(t *testing.T) {
+		e, afs, files := setup(t, 2)
+		e.planFile = ""
+
+		j, err := openJournal(afs, testJournalFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i := range files {
+			files[i].datasetID = testDatasetID
+		}
+
+		e.journal = j
+		ap := NewAsyncProcessor(e, files)
+		ap.processFiles()
+		assert.NoError(t, j.close())
+
+		e.journal = nil
+		e.journalFile = testJournalFile
+
+		restored := restore(e)
+		assert.Len(t, restored, len(files))
+
+		smbNames := map[string]string{}
+
+		for _, f := range files {
+			smbNames[f.id] = f.smbName
+		}
+
+		for _, f := range restored {
+			assert.True(t, f.success, f.reason)
+			assertCorrectString(t, f.smbName, smbNames[f.id])
+
+			_, err := afs.Stat(f.stagingPath)
+			assert.NoError(t, err)
+		}
+
+		for _, f := range ap.getFiles() {
+			_, err := afs.Stat(f.stagingPath)
+			assert.Error(t, err)
+
+			_, err = afs.Stat(f.oldStagingPath)
+			assert.NoError(t, err)
+		}
+	})
+
+	t.Run("should refuse to restore a file whose hash changed", func(t *testing.T) {
+		e, afs, files := setup(t, 2)
+		applied := applyPlan(t, e, files)
+
+		content, err := afero.ReadFile(afs, applied[0].stagingPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		content[0]++
+
+		err = afero.WriteFile(afs, applied[0].stagingPath, content, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		restored := restore(e)
+		assert.False(t, restored[0].success)
+		assertCorrectString(t, restored[0].reason, reasonRestoreMismatch)
+		assertCorrectString(t, restored[0].stagingPath, applied[0].stagingPath)
+
+		_, err = afs.Stat(files[0].stagingPath)
+		assert.Error(t, err)
+
+		assert.True(t, restored[1].success)
+	})
+
+	t.Run("should not move anything on dryrun", func(t *testing.T) {
+		e, afs, files := setup(t, 2)
+		applied := applyPlan(t, e, files)
+		e.dryrun = true
+
+		for i, f := range restore(e) {
+			assert.True(t, f.success, f.reason)
+			assertCorrectString(t, f.stagingPath, applied[i].stagingPath)
+
+			_, err := afs.Stat(files[i].stagingPath)
+			assert.Error(t, err)
+		}
+	})
+
+	t.Run("should skip a file that is no longer where it was moved to", func(t *testing.T) {
+		e, afs, files := setup(t, 2)
+		applied := applyPlan(t, e, files)
+
+		err := afs.Remove(applied[0].stagingPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ap := NewAsyncProcessor(e, []file{})
+		ap.loadRestore()
+
+		assert.Len(t, ap.getFiles(), 1)
+		assertCorrectString(t, ap.getFiles()[0].id, files[1].id)
+
+		gotLogMsg := hook.Entries[len(hook.Entries)-2].Message
+		wantLogMsg := fmt.Sprintf(fNotListedLog, files[0].smbName, files[0].id, reasonNotExist)
+		assertCorrectString(t, gotLogMsg, wantLogMsg)
+
+		ap.restoreFiles()
+
+		results := ap.getResults()
+		assert.Len(t, results, 2)
+
+		got := results[1]
+		assertCorrectString(t, got.ID, files[0].id)
+		assertCorrectString(t, got.SmbName, files[0].smbName)
+		assertCorrectString(t, got.Status, statusSkipped)
+		assertCorrectString(t, got.Reason, reasonNotExist)
+	})
+}
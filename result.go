@@ -0,0 +1,246 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	// statusMoved is a file that was moved & verified at its new path
+	statusMoved = "moved"
+	// statusRestored is a file that restore moved back to where it came from
+	statusRestored = "restored"
+	// statusPlanned is a file that plan would move
+	statusPlanned = "planned"
+	// statusDryRun is a file that would have been moved but for -dryrun
+	statusDryRun = "dryrun"
+	// statusDone is a file the journal shows was completed by an earlier run
+	statusDone = "already done"
+	// statusSkipped is a file that failed a check & was left where it was
+	statusSkipped = "skipped"
+	// statusHeld is a file left where it was as it is under legal hold
+	statusHeld = "held"
+	// statusLimited is a file that passed verify but was left where it was as
+	// -max-files or -max-bytes had been reached
+	statusLimited = "not processed (limit)"
+	// statusFailed is a file whose processing returned an error
+	statusFailed = "failed"
+	// statusAborted is a file that was never started as the run aborted
+	statusAborted = "aborted"
+
+	summaryHeader     = "outcome\tfiles\tbytes\t"
+	summaryRow        = "%v\t%v\t%v\t\n"
+	summaryReasonHdr  = "reason\tfiles\t"
+	summaryReasonRow  = "%v\t%v\t\n"
+	summaryHeldHdr    = "held\tid\towner\tmatter\t"
+	summaryHeldRow    = "%v\t%v\t%v\t%v\t\n"
+	summaryThroughput = "moved %v bytes in %v (%.2f MiB/s)\n"
+	summaryNoFiles    = "no files processed\n"
+)
+
+// statuses is the order outcomes are listed in the summary
+var statuses = []string{
+	statusMoved,
+	statusRestored,
+	statusPlanned,
+	statusDryRun,
+	statusDone,
+	statusSkipped,
+	statusHeld,
+	statusLimited,
+	statusFailed,
+	statusAborted,
+}
+
+// result is the outcome of processing one file
+type result struct {
+	SmbName      string        `json:"smbName"`
+	ID           string        `json:"id"`
+	FanIP        string        `json:"fanIP"`
+	DatasetID    string        `json:"datasetID"`
+	StagingPath  string        `json:"stagingPath"`
+	NewPath      string        `json:"newPath"`
+	Size         int64         `json:"size"`
+	CreateTime   time.Time     `json:"createTime"`
+	PreHash      string        `json:"preHash"`
+	PostHash     string        `json:"postHash"`
+	Status       string        `json:"status"`
+	Reason       string        `json:"reason"`
+	Verify       time.Duration `json:"verify"`
+	PreHashTime  time.Duration `json:"preHashTime"`
+	Move         time.Duration `json:"move"`
+	PostHashTime time.Duration `json:"postHashTime"`
+	HoldOwnerID  string        `json:"holdOwnerID"`
+	HoldMatterID string        `json:"holdMatterID"`
+	Collision    string        `json:"collision"`
+}
+
+// collect records a result for each of ap.files, followed by each of
+// ap.unlisted. done is the status of a file that got all the way through
+func (ap *asyncProcessor) collect(done string) {
+	ap.results = make([]result, 0, len(ap.files)+len(ap.unlisted))
+
+	for i := range ap.files {
+		ap.results = append(ap.results, ap.files[i].result(done, ap.env))
+	}
+
+	for i := range ap.unlisted {
+		ap.results = append(ap.results, ap.unlisted[i].result(done, ap.env))
+	}
+}
+
+func (ap *asyncProcessor) getResults() []result {
+	return ap.results
+}
+
+// result returns the result of processing f. A file that was moved has its
+// oldStagingPath set, while a planned file only knows where it would go
+func (f *file) result(done string, e *env) result {
+	r := result{
+		SmbName:      f.smbName,
+		ID:           f.id,
+		DatasetID:    f.datasetID,
+		StagingPath:  f.stagingPath,
+		Size:         f.size,
+		CreateTime:   f.createTime,
+		Status:       f.status(done, e),
+		Reason:       f.reason,
+		PreHash:      hex.EncodeToString(f.oldHash),
+		PostHash:     hex.EncodeToString(f.hash),
+		Verify:       f.timings.verify,
+		PreHashTime:  f.timings.preHash,
+		Move:         f.timings.move,
+		PostHashTime: f.timings.postHash,
+		HoldOwnerID:  f.legalHold.ownerID,
+		HoldMatterID: f.legalHold.matterID,
+	}
+
+	if f.collision != collisionNone {
+		r.Collision = f.collision.String()
+	}
+
+	if f.fanIP != nil {
+		r.FanIP = f.fanIP.String()
+	}
+
+	if f.fileInfo != nil {
+		r.Size = f.fileInfo.Size()
+	}
+
+	switch {
+	case f.oldStagingPath != "" && f.oldStagingPath != f.stagingPath:
+		r.StagingPath = f.oldStagingPath
+		r.NewPath = f.stagingPath
+	case f.planned != nil:
+		r.NewPath = f.planned.NewPath
+	}
+
+	return r
+}
+
+// status returns which of statuses f ended up with
+func (f *file) status(done string, e *env) string {
+	switch {
+	case f.reason == reasonAborted:
+		return statusAborted
+	case f.err != nil:
+		return statusFailed
+	case done == statusPlanned && f.planned != nil:
+		return statusPlanned
+	case f.reason == reasonLegalHold:
+		return statusHeld
+	case f.reason == reasonLimit:
+		return statusLimited
+	case !f.success:
+		return statusSkipped
+	case f.resumed == statePostVerified:
+		return statusDone
+	case e.dryrun:
+		return statusDryRun
+	}
+
+	return done
+}
+
+// printSummary writes counts of ap's results by outcome & by reason, each
+// held file with its hold's owner & matter, & the bytes moved & the
+// throughput, to w
+func (ap *asyncProcessor) printSummary(w io.Writer) {
+	if len(ap.results) == 0 {
+		fmt.Fprint(w, summaryNoFiles)
+		return
+	}
+
+	counts := map[string]int{}
+	sizes := map[string]int64{}
+	reasons := map[string]int{}
+
+	var (
+		moved int64
+		held  []result
+	)
+
+	for _, r := range ap.results {
+		counts[r.Status]++
+		sizes[r.Status] += r.Size
+
+		if r.Reason != "" {
+			reasons[r.Reason]++
+		}
+
+		if r.Status == statusMoved || r.Status == statusRestored {
+			moved += r.Size
+		}
+
+		if r.Status == statusHeld {
+			held = append(held, r)
+		}
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+
+	fmt.Fprintln(tw, summaryHeader)
+
+	for _, status := range statuses {
+		if counts[status] > 0 {
+			fmt.Fprintf(tw, summaryRow, status, counts[status], sizes[status])
+		}
+	}
+
+	if len(reasons) > 0 {
+		fmt.Fprintln(tw)
+		fmt.Fprintln(tw, summaryReasonHdr)
+
+		for _, reason := range slices.Sorted(maps.Keys(reasons)) {
+			fmt.Fprintf(tw, summaryReasonRow, reason, reasons[reason])
+		}
+	}
+
+	if len(held) > 0 {
+		fmt.Fprintln(tw)
+		fmt.Fprintln(tw, summaryHeldHdr)
+
+		for _, r := range held {
+			fmt.Fprintf(tw, summaryHeldRow, r.SmbName, r.ID, r.HoldOwnerID, r.HoldMatterID)
+		}
+	}
+
+	fmt.Fprintln(tw)
+	tw.Flush()
+
+	fmt.Fprintf(w, summaryThroughput, moved, ap.elapsed.Round(time.Millisecond), throughput(moved, ap.elapsed))
+}
+
+// throughput returns n bytes over d in MiB/s
+func throughput(n int64, d time.Duration) float64 {
+	if d <= 0 {
+		return 0
+	}
+
+	return float64(n) / mebibyte / d.Seconds()
+}
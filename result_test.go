@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResults(t *testing.T) {
+	setup := func(t *testing.T, numFiles int) (*env, []file) {
+		afs, files := createAferoTest(t, numFiles, false)
+		hostname, _ := os.Hostname()
+		ips, _ := net.LookupIP(hostname)
+		e := new(env)
+
+		e.logger, hook = setupLogs()
+		e.afs = afs
+		e.fsys = afero.NewIOFS(afs)
+		e.sysIPs = []net.IP{ips[0]}
+		e.datasetID = testDatasetID
+		e.gbr = testGBR
+
+		return e, files
+	}
+
+	t.Run("should record a result for each processed file", func(t *testing.T) {
+		e, files := setup(t, 3)
+		files[1].fanIP = net.ParseIP("0.0.0.0")
+
+		var oldPaths []string
+
+		for _, f := range files {
+			oldPaths = append(oldPaths, f.stagingPath)
+		}
+
+		ap := NewAsyncProcessor(e, files)
+		ap.processFiles()
+
+		results := ap.getResults()
+		assert.Len(t, results, len(files))
+
+		for _, i := range []int{0, 2} {
+			r := results[i]
+			assertCorrectString(t, r.Status, statusMoved)
+			assertCorrectString(t, r.StagingPath, oldPaths[i])
+			assertCorrectString(t, r.NewPath, files[i].stagingPath)
+			assertCorrectString(t, r.PostHash, hex.EncodeToString(files[i].hash))
+			assert.Equal(t, r.PreHash, r.PostHash)
+			assert.Equal(t, files[i].size, r.Size)
+			assert.Empty(t, r.Reason)
+		}
+
+		assertCorrectString(t, results[1].Status, statusSkipped)
+		assertCorrectString(t, results[1].Reason, files[1].reason)
+		assert.Empty(t, results[1].NewPath)
+	})
+
+	t.Run("should record planned files as planned", func(t *testing.T) {
+		e, files := setup(t, 2)
+		e.planFile = testPlanFile
+
+		ap := NewAsyncProcessor(e, files)
+		ap.planFiles()
+
+		for i, r := range ap.getResults() {
+			assertCorrectString(t, r.Status, statusPlanned)
+			assertCorrectString(t, r.NewPath, mustNewPath(t, files[i]))
+		}
+	})
+
+	t.Run("should print counts by outcome & reason", func(t *testing.T) {
+		e, files := setup(t, 3)
+		files[1].fanIP = net.ParseIP("0.0.0.0")
+
+		ap := NewAsyncProcessor(e, files)
+		ap.processFiles()
+
+		var buf bytes.Buffer
+
+		ap.printSummary(&buf)
+		out := buf.String()
+
+		assert.Regexp(t, fmt.Sprintf(`(?m)^%v\s+2\s+%v`, statusMoved, files[0].size+files[2].size), out)
+		assert.Regexp(t, fmt.Sprintf(`(?m)^%v\s+1\s`, statusSkipped), out)
+		assert.Regexp(t, fmt.Sprintf(`(?m)^%v\s+1\s`, files[1].reason), out)
+		assert.Contains(t, out, fmt.Sprintf("moved %v bytes", files[0].size+files[2].size))
+	})
+
+	t.Run("should list held files with their owner & matter", func(t *testing.T) {
+		ap := &asyncProcessor{env: new(env), results: []result{
+			{SmbName: testSmbName, ID: testFileID, Status: statusMoved},
+			{SmbName: testName, ID: testDatasetID, Status: statusHeld, Reason: reasonLegalHold,
+				HoldOwnerID: testHoldOwnerID, HoldMatterID: testHoldMatterID},
+		}}
+
+		var buf bytes.Buffer
+
+		ap.printSummary(&buf)
+		out := buf.String()
+
+		assert.Regexp(t, `(?m)^held\s+id\s+owner\s+matter\s*$`, out)
+		assert.Regexp(t, fmt.Sprintf(`(?m)^%v\s+%v\s+%v\s+%v\s*$`,
+			regexp.QuoteMeta(testName), testDatasetID, testHoldOwnerID, testHoldMatterID), out)
+		assert.NotRegexp(t, fmt.Sprintf(`(?m)^%v\s+%v`, regexp.QuoteMeta(testSmbName), testFileID), out)
+	})
+
+	t.Run("should not list held files when there are none", func(t *testing.T) {
+		ap := &asyncProcessor{env: new(env), results: []result{
+			{SmbName: testSmbName, ID: testFileID, Status: statusMoved},
+		}}
+
+		var buf bytes.Buffer
+
+		ap.printSummary(&buf)
+
+		assert.NotRegexp(t, `(?m)^held\s+id\s`, buf.String())
+	})
+
+	t.Run("should say when there are no files", func(t *testing.T) {
+		var buf bytes.Buffer
+
+		ap := &asyncProcessor{env: new(env)}
+		ap.printSummary(&buf)
+
+		assertCorrectString(t, buf.String(), summaryNoFiles)
+	})
+}
+
+func TestFileStatus(t *testing.T) {
+	tests := []struct {
+		name   string
+		f      file
+		dryrun bool
+		done   string
+		want   string
+	}{
+		{"moved", file{success: true}, false, statusMoved, statusMoved},
+		{"restored", file{success: true}, false, statusRestored, statusRestored},
+		{"dryrun", file{success: true}, true, statusMoved, statusDryRun},
+		{"resumed", file{success: true, resumed: statePostVerified}, false, statusMoved, statusDone},
+		{"planned", file{planned: &planEntry{}}, false, statusPlanned, statusPlanned},
+		{"applied but skipped", file{planned: &planEntry{}}, false, statusMoved, statusSkipped},
+		{"skipped", file{reason: reasonSizeMismatch}, false, statusMoved, statusSkipped},
+		{"held", file{reason: reasonLegalHold}, false, statusMoved, statusHeld},
+		{"failed", file{err: ErrMove, reason: reasonMoveErr}, false, statusMoved, statusFailed},
+		{"aborted", file{reason: reasonAborted}, false, statusMoved, statusAborted},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			e := &env{dryrun: tc.dryrun}
+			assertCorrectString(t, tc.f.status(tc.done, e), tc.want)
+		})
+	}
+}
+
+func TestThroughput(t *testing.T) {
+	assert.InDelta(t, 2.0, throughput(4*mebibyte, 2*time.Second), 0.001)
+	assert.Zero(t, throughput(mebibyte, 0))
+}
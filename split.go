@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/spf13/afero"
+)
+
+const (
+	inventoryLog        = "inventory: %v"
+	inventoryMissingLog = "inventory: No inventory file set; use -inventory"
+	inventoryLoadedLog  = "inventory: %v nodes loaded from %v"
+	splitNodeLog        = "split: %v-%v (%v) %v files written to %v"
+	splitUnknownIPLog   = "split: fanIP:%v is not in the inventory; %v files not split"
+	splitUnknownLog     = "split: %v files with unknown fanIPs written to %v"
+	splitParseErrLog    = "sourcefile line %v: %v; skipping line"
+
+	errInventoryLine  = "inventory line %v: %v"
+	errInventoryIP    = "%v is not an IP"
+	errInventoryDupIP = "%v is already node %v-%v"
+
+	// inventoryFields is the number of fields in a node inventory line:
+	// site,node,ip
+	inventoryFields = 3
+	// splitUnknownFile is written to -outdir with each unknown fanIP & how
+	// many files it has
+	splitUnknownFile = "unknown_fanips.out"
+	splitFileExt     = ".out"
+)
+
+// node is a node in the node inventory
+type node struct {
+	site string
+	name string
+	ip   net.IP
+}
+
+// runSplit partitions the cleansed -sourcefile by fanIP into a file per node
+// in -inventory, written to -outdir as <ip>.out, along with a report of the
+// fanIPs not in the inventory
+func runSplit(e *env, _ AsyncProcessor) int {
+	e.logger.Info(fmt.Sprintf(commandLog, splitCmd))
+
+	e.must(e.setSourceFile(e.exePath, sourceFile))
+	e.setInventory(inventoryFile)
+	e.must(e.setOutDir(outDir))
+
+	return e.split()
+}
+
+func (e *env) setInventory(pth string) {
+	logger := e.logger
+
+	if pth == "" {
+		logger.Fatal(inventoryMissingLog)
+	}
+
+	e.inventoryFile = pth
+
+	logger.Info(fmt.Sprintf(inventoryLog, pth))
+}
+
+// split writes the lines of e.sourceFile for each node in e.inventoryFile to
+// e.outDir. It returns exitSkipped if any line is unparseable or has a fanIP
+// that is not in the inventory
+func (e *env) split() int {
+	logger := e.logger
+
+	data, err := afero.ReadFile(e.afs, e.inventoryFile)
+	if err != nil {
+		logger.Fatal(err)
+	}
+
+	nodes, err := parseInventory(bytes.NewReader(data))
+	if err != nil {
+		logger.Fatal(err)
+	}
+
+	logger.Info(fmt.Sprintf(inventoryLoadedLog, len(nodes), e.inventoryFile))
+
+	byIP := make(map[string][]string, len(nodes))
+	for _, n := range nodes {
+		byIP[n.ip.String()] = []string{}
+	}
+
+	unknown := map[string]int{}
+	code := exitOK
+
+	for i, line := range parseSourceFile(e) {
+		f, err := parseLine(line, e)
+		if err != nil {
+			logger.Error(fmt.Sprintf(splitParseErrLog, i+1, err))
+
+			code = exitSkipped
+
+			continue
+		}
+
+		ip := f.fanIP.String()
+		if _, ok := byIP[ip]; !ok {
+			unknown[ip]++
+			continue
+		}
+
+		byIP[ip] = append(byIP[ip], line)
+	}
+
+	err = e.afs.MkdirAll(e.outDir, 0755)
+	if err != nil {
+		logger.Fatal(err)
+	}
+
+	for _, n := range nodes {
+		ip := n.ip.String()
+		pth := path.Join(e.outDir, ip+splitFileExt)
+		e.must(e.writeLines(pth, byIP[ip]))
+
+		logger.Info(fmt.Sprintf(splitNodeLog, n.site, n.name, ip, len(byIP[ip]), pth))
+	}
+
+	var report []string
+
+	for _, ip := range slices.Sorted(maps.Keys(unknown)) {
+		logger.Warn(fmt.Sprintf(splitUnknownIPLog, ip, unknown[ip]))
+		report = append(report, fmt.Sprintf("%v|%v", ip, unknown[ip]))
+
+		code = exitSkipped
+	}
+
+	pth := path.Join(e.outDir, splitUnknownFile)
+	e.must(e.writeLines(pth, report))
+
+	logger.Info(fmt.Sprintf(splitUnknownLog, len(unknown), pth))
+
+	return code
+}
+
+// parseInventory reads site,node,ip lines from r. Blank lines, lines starting
+// with # & a header line whose ip is not an IP are ignored
+func parseInventory(r io.Reader) ([]node, error) {
+	reader := csv.NewReader(r)
+	reader.Comment = '#'
+	reader.FieldsPerRecord = inventoryFields
+	reader.TrimLeadingSpace = true
+
+	var nodes []node
+
+	seen := map[string]node{}
+
+	for first := true; ; first = false {
+		rec, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		line, _ := reader.FieldPos(2)
+
+		ip := net.ParseIP(strings.TrimSpace(rec[2]))
+		if ip == nil {
+			if first {
+				continue
+			}
+
+			return nil, fmt.Errorf(errInventoryLine, line, fmt.Sprintf(errInventoryIP, rec[2]))
+		}
+
+		if dup, ok := seen[ip.String()]; ok {
+			return nil, fmt.Errorf(errInventoryLine, line, fmt.Sprintf(errInventoryDupIP, ip, dup.site, dup.name))
+		}
+
+		n := node{site: rec[0], name: rec[1], ip: ip}
+		seen[ip.String()] = n
+		nodes = append(nodes, n)
+	}
+
+	return nodes, nil
+}
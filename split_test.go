@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"bou.ke/monkey"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	testInventoryFile  = "inventory.csv"
+	testSplitSource    = "sourcefile.out"
+	testSplitUnknownIP = "10.49.28.120"
+)
+
+func TestSplit(t *testing.T) {
+	setup := func(t *testing.T) (*env, afero.Fs) {
+		afs := afero.NewMemMapFs()
+
+		for _, name := range []string{testInventoryFile, testSplitSource} {
+			data, err := os.ReadFile(path.Join(testdataDir, "split", name))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = afero.WriteFile(afs, name, data, 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		e := new(env)
+		e.logger, hook = setupLogs()
+		e.afs = afs
+		e.sourceFile = testSplitSource
+		e.inventoryFile = testInventoryFile
+		e.outDir = testOutDir
+
+		return e, afs
+	}
+
+	readLines := func(t *testing.T, afs afero.Fs, name string) []string {
+		t.Helper()
+
+		data, err := afero.ReadFile(afs, path.Join(testOutDir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(data) == 0 {
+			return nil
+		}
+
+		return strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	}
+
+	t.Run("should write a file per node in order", func(t *testing.T) {
+		e, afs := setup(t)
+		assert.Equal(t, exitSkipped, e.split())
+
+		n11 := readLines(t, afs, "10.41.28.112.out")
+		assert.Len(t, n11, 2)
+		assert.True(t, strings.HasPrefix(n11[0], "05043fe1-"), n11[0])
+		assert.True(t, strings.HasPrefix(n11[1], "deadbeef-"), n11[1])
+
+		n12 := readLines(t, afs, "10.41.28.113.out")
+		assert.Len(t, n12, 1)
+		assert.True(t, strings.HasPrefix(n12[0], "aabbccdd-"), n12[0])
+
+		// a node with no files still gets a file
+		assert.Empty(t, readLines(t, afs, "10.49.28.112.out"))
+
+		for _, line := range append(n11, n12...) {
+			_, err := parseLine(line, e)
+			assert.NoError(t, err)
+		}
+	})
+
+	t.Run("should report fanIPs not in the inventory", func(t *testing.T) {
+		e, afs := setup(t)
+		e.split()
+
+		unknown := readLines(t, afs, splitUnknownFile)
+		assert.Equal(t, []string{testSplitUnknownIP + "|2"}, unknown)
+
+		var gotLogMsgs []string
+
+		for _, entry := range hook.AllEntries() {
+			gotLogMsgs = append(gotLogMsgs, entry.Message)
+		}
+
+		assert.Contains(t, gotLogMsgs, fmt.Sprintf(splitUnknownIPLog, testSplitUnknownIP, 2))
+	})
+
+	t.Run("should exit ok when every line is split", func(t *testing.T) {
+		e, afs := setup(t)
+
+		err := afero.WriteFile(afs, testSplitSource, []byte(
+			"a|data1/staging/a|1678748858|1|D5B58980A3E311EBBA0AB026285E5610|10.41.28.112|\n"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assert.Equal(t, exitOK, e.split())
+		assert.Empty(t, readLines(t, afs, splitUnknownFile))
+	})
+}
+
+func TestParseInventory(t *testing.T) {
+	t.Run("should read nodes skipping the header & comments", func(t *testing.T) {
+		nodes, err := parseInventory(strings.NewReader("site,node,ip\n# a comment\n\nsite1, n11, 10.41.28.112\n"))
+		assert.NoError(t, err)
+		assert.Equal(t, []node{{site: "site1", name: "n11", ip: net.ParseIP("10.41.28.112")}}, nodes)
+	})
+
+	errorTests := []struct {
+		name string
+		data string
+		want string
+	}{
+		{"a bad ip", "site1,n11,10.41.28.112\nsite1,n12,nope\n", fmt.Sprintf(errInventoryIP, "nope")},
+		{"a duplicate ip", "site1,n11,10.41.28.112\nsite1,n12,10.41.28.112\n",
+			fmt.Sprintf(errInventoryDupIP, "10.41.28.112", "site1", "n11")},
+		{"the wrong number of fields", "site1,n11\n", "wrong number of fields"},
+	}
+
+	for _, tt := range errorTests {
+		t.Run("should error on "+tt.name, func(t *testing.T) {
+			_, err := parseInventory(strings.NewReader(tt.data))
+			assert.ErrorContains(t, err, tt.want)
+		})
+	}
+}
+
+func TestSetInventory(t *testing.T) {
+	t.Run("should set inventory", func(t *testing.T) {
+		e := new(env)
+		e.logger, hook = setupLogs()
+
+		e.setInventory(testInventoryFile)
+		assertCorrectString(t, e.inventoryFile, testInventoryFile)
+
+		gotLogMsg := hook.LastEntry().Message
+		wantLogMsg := fmt.Sprintf(inventoryLog, testInventoryFile)
+		assertCorrectString(t, gotLogMsg, wantLogMsg)
+	})
+
+	t.Run("should fatal without inventory", func(t *testing.T) {
+		patch := monkey.Patch(os.Exit, func(int) { panic(osPanicTrue) })
+		defer patch.Unpatch()
+
+		e := new(env)
+		e.logger, hook = setupLogs()
+
+		panicFunc := func() { e.setInventory("") }
+		assert.PanicsWithValue(t, osPanicTrue, panicFunc, osPanicFalse)
+
+		gotLogMsg := hook.LastEntry().Message
+		assertCorrectString(t, gotLogMsg, inventoryMissingLog)
+	})
+}
@@ -1,18 +1,16 @@
 package main
 
 import (
-	"errors"
 	"fmt"
-	"io/fs"
-	"os/exec"
-	"reflect"
+	"path"
+	"slices"
 	"strings"
 	"time"
 )
 
 const (
-	fIPMatchTrueLog                 = "%v (file.id:%v) file.ip:%v matches comparison ip:%v"
-	fIPMatchFalseLog                = "%v (file.id:%v) file.ip:%v does not match comparison ip:%v; skipping file"
+	fIPMatchTrueLog                 = "%v (file.id:%v) file.ip:%v matches one of comparison ips:%v"
+	fIPMatchFalseLog                = "%v (file.id:%v) file.ip:%v does not match any comparison ip:%v; skipping file"
 	fCreateTimeAfterTimeLimitLog    = "%v (file.id:%v) file.createTime:%v is after timelimit:%v"
 	fCreateTimeBeforeTimeLimitLog   = "%v (file.id:%v) file.createTime:%v is before timelimit:%v; skipping file"
 	fDatasetMatchTrueLog            = "%v (file.id:%v) file.datasetID:%v matches Dataset:%v"
@@ -30,40 +28,70 @@ const (
 	fGbrFileNameByFileIDLog         = "%v (file.id:%v) gbr verified file.id:%v as matching MB filename:%v"
 	fGbrNoFileNameByFileIDLog       = "%v (file.id:%v) gbr could not find MB file.id:%v"
 	fGbrDatasetByFileIDLog          = "%v (file.id:%v) gbr verified & set file.id:%v to dataset:%v"
+	fGbrOutputLog                   = "%v (file.id:%v) gbr output could not be parsed: %v"
+	fLegalHoldFalseLog              = "%v (file.id:%v) is not under legal hold"
+	fLegalHoldTrueLog               = "%v (file.id:%v) is under legal hold OwnerID:%v MatterID:%v; skipping file"
+	fFanURIMatchTrueLog             = "%v (file.id:%v) gbr fan URI:%v matches file.stagingPath:%v & file.fanIP:%v"
+	fFanURIUnknownLog               = "%v (file.id:%v) gbr fan URI:%v does not map to a staging path; skipping file"
+	fFanURIPathFalseLog             = "%v (file.id:%v) gbr fan URI maps to:%v, not file.stagingPath:%v; skipping file"
+	fFanURIHostFalseLog             = "%v (file.id:%v) gbr fan URI host:%v does not match file.fanIP:%v; skipping file"
 	fVerifiedLog                    = "%v (file.id:%v) verified as ready to be migrated in preparation for removal!"
+	fIdentityMatchTrueLog           = "%v (file.id:%v) file.stagingPath:%v inode, size & modTime match pre-move file.fileInfo"
+	fIdentityMatchFalseLog          = "%v (file.id:%v) file.stagingPath:%v inode, size or modTime do not match pre-move file.fileInfo"
+	fMappingTrueLog                 = "%v (file.id:%v) file.stagingPath:%v maps to:%v"
+	fMappingFalseLog                = "%v (file.id:%v) %v; skipping file"
+
+	reasonIPMismatch         = "fanIP does not match sysIP"
+	reasonBeforeTimeLimit    = "createTime is before timelimit"
+	reasonGbrNotFound        = "gbr could not find file.id"
+	reasonDatasetMismatch    = "datasetID does not match"
+	reasonSmbNameMismatch    = "smbName does not match file.id name"
+	reasonNotExist           = "stagingPath does not exist"
+	reasonSizeMismatch       = "size does not match stagingPath"
+	reasonCreateTimeMismatch = "createTime does not match stagingPath modTime"
+	reasonNoMapping          = "stagingPath has no mapping rule"
+	reasonLegalHold          = "file is under legal hold"
+	reasonFanURIUnknown      = "fan URI does not map to a staging path"
+	reasonFanURIPathMismatch = "fan URI does not map to stagingPath"
+	reasonFanURIHostMismatch = "fan URI host does not match fanIP"
+
+	errGbrFileWrongID = "%w: gbr returned file.id:%v"
 )
 
 // verify all
 
-func (f *file) verify() bool {
-	e = ap.getEnv()
+// verify reports whether f passes every check, with f.reason set if not. An
+// error means a check could not be made
+func (f *file) verify(e *env) (bool, error) {
+	if !f.verifyEnvMatch(e) {
+		return false, nil
+	}
 
-	if !f.verifyEnvMatch() {
-		return false
+	if !f.verifyMapping(e) {
+		return false, nil
 	}
 
-	if !f.verifyGBMetadata() {
-		return false
+	ok, err := f.verifyGBMetadata(e)
+	if !ok || err != nil {
+		return false, err
 	}
 
-	if !f.verifyStat() {
-		return false
+	if !f.verifyStat(e) {
+		return false, nil
 	}
 
 	e.logger.Info(fmt.Sprintf(fVerifiedLog, f.smbName, f.id))
 
-	return true
+	return true, nil
 }
 
 // verify config metadata
-func (f *file) verifyEnvMatch() bool {
-	e = ap.getEnv()
-
-	if !f.verifyIP() {
+func (f *file) verifyEnvMatch(e *env) bool {
+	if !f.verifyIP(e) {
 		return false
 	}
 
-	if !f.verifyTimeLimit() {
+	if !f.verifyTimeLimit(e) {
 		return false
 	}
 
@@ -72,20 +100,34 @@ func (f *file) verifyEnvMatch() bool {
 	return true
 }
 
-func (f *file) verifyIP() bool {
-	e = ap.getEnv()
+func (f *file) verifyMapping(e *env) bool {
+	dst, err := newPath(*f, e)
+	if err != nil {
+		e.logger.Warn(fmt.Sprintf(fMappingFalseLog, f.smbName, f.id, err))
+		f.reason = reasonNoMapping
 
-	if reflect.DeepEqual(f.fanIP, e.sysIP) {
-		e.logger.Info(fmt.Sprintf(fIPMatchTrueLog, f.smbName, f.id, f.fanIP, e.sysIP))
+		return false
+	}
+
+	e.logger.Info(fmt.Sprintf(fMappingTrueLog, f.smbName, f.id, f.stagingPath, dst))
+
+	return true
+}
+
+// verifyIP checks f.fanIP is one of e.sysIPs
+func (f *file) verifyIP(e *env) bool {
+	match := slices.ContainsFunc(e.sysIPs, f.fanIP.Equal)
+	if match {
+		e.logger.Info(fmt.Sprintf(fIPMatchTrueLog, f.smbName, f.id, f.fanIP, e.sysIPs))
 	} else {
-		e.logger.Warn(fmt.Sprintf(fIPMatchFalseLog, f.smbName, f.id, f.fanIP, e.sysIP))
+		e.logger.Warn(fmt.Sprintf(fIPMatchFalseLog, f.smbName, f.id, f.fanIP, e.sysIPs))
+		f.reason = reasonIPMismatch
 	}
 
-	return reflect.DeepEqual(f.fanIP, e.sysIP)
+	return match
 }
 
-func (f *file) verifyTimeLimit() bool {
-	e = ap.getEnv()
+func (f *file) verifyTimeLimit(e *env) bool {
 	if f.createTime.After(e.limit) {
 		e.logger.Info(fmt.Sprintf(
 			fCreateTimeAfterTimeLimitLog,
@@ -100,141 +142,201 @@ func (f *file) verifyTimeLimit() bool {
 			f.id,
 			f.createTime.Round(time.Millisecond),
 			e.limit.Round(time.Millisecond)))
+
+		f.reason = reasonBeforeTimeLimit
 	}
 
 	return f.createTime.After(e.limit)
 }
 
-func (f *file) getGBMetadata() string {
-	e = ap.getEnv()
-	id := f.id
-	cmd := exec.Command("/usr/bin/gbr", "file", "ls", "-i", id, "-d")
-	cmdOut, err := cmd.CombinedOutput()
-
+// getGBMetadata returns e.gbr's details of f.id, or nil if gbr has no such
+// file. If gbr fails the error wraps ErrGbrUnavailable & if its output cannot
+// be parsed, ErrGbrOutput
+func (f *file) getGBMetadata(e *env) (*gbrFile, error) {
+	out, err := e.gbr.FileByID(f.id)
 	if err != nil {
-		f.getByIDErrLog(err)
+		return nil, f.getByIDErr(err, e)
 	}
 
-	out := string(cmdOut)
+	if strings.TrimSpace(out) == "" {
+		return nil, nil
+	}
+
+	rec, err := parseGbrFile(out)
+	if err == nil && rec.id != f.id {
+		err = fmt.Errorf(errGbrFileWrongID, ErrGbrOutput, rec.id)
+	}
+
+	if err != nil {
+		e.logger.Warn(fmt.Sprintf(fGbrOutputLog, f.smbName, f.id, err))
+		return nil, err
+	}
 
-	return cleanGbrOut(out)
+	return rec, nil
 }
 
 // Verify GB internal metadata
-func (f *file) verifyGBMetadata() bool {
-	out := f.getGBMetadata()
+func (f *file) verifyGBMetadata(e *env) (bool, error) {
+	rec, err := f.getGBMetadata(e)
+	if err != nil {
+		return false, err
+	}
+
 	// Gets file MBDS & compares with e.DS
-	if !f.verifyMBDatasetByFileID(out) {
-		return false
+	if !f.verifyMBDatasetByFileID(rec, e) {
+		return false, nil
+	}
+
+	if !f.verifyMBFileNameByFileID(rec, e) {
+		return false, nil
 	}
 
-	return f.verifyMBFileNameByFileID(out)
+	if !f.verifyLegalHold(rec, e) {
+		return false, nil
+	}
+
+	return f.verifyFanURI(rec, e), nil
 }
 
-func (f *file) verifyMBFileNameByFileID(out string) bool {
+func (f *file) verifyMBFileNameByFileID(rec *gbrFile, e *env) bool {
 	id := f.id
-	if out == "" {
+	if rec == nil {
 		e.logger.Warn(fmt.Sprintf(fGbrNoFileNameByFileIDLog, f.smbName, id, id))
+		f.reason = reasonGbrNotFound
+
 		return false
 	}
 
-	filename := f.parseMBFileNameByFileID(out)
+	e.logger.Info(fmt.Sprintf(fGbrFileNameByFileIDLog, f.smbName, id, id, rec.name))
 
-	return f.verifyFileIDName(filename)
+	return f.verifyFileIDName(rec.name, e)
 }
 
-func (f *file) verifyMBDatasetByFileID(out string) bool {
+func (f *file) verifyMBDatasetByFileID(rec *gbrFile, e *env) bool {
 	id := f.id
 
-	if out == "" {
+	if rec == nil {
 		e.logger.Warn(fmt.Sprintf(fGbrNoFileNameByFileIDLog, f.smbName, id, id))
+		f.reason = reasonGbrNotFound
+
 		return false
 	}
 
 	// set f.datasetID
-	f.setMBDatasetByFileID(out)
+	f.setMBDatasetByFileID(rec, e)
 
 	// get env datasetID
 	datasetID := e.datasetID
 
 	// Compare f.datasetID & env.datasetID
-	return f.verifyInDataset(datasetID)
+	return f.verifyInDataset(datasetID, e)
 }
 
-func (f *file) parseMBFileNameByFileID(cmdOut string) (filename string) {
-	e = ap.getEnv()
-	line := strings.Split(cmdOut, " ")
-	filename = line[2]
-	e.logger.Info(fmt.Sprintf(fGbrFileNameByFileIDLog, f.smbName, f.id, f.id, filename))
+// verifyLegalHold reports whether gbr shows f as free of any legal hold. A
+// held file must stay where it is, as a moved file is later purged
+func (f *file) verifyLegalHold(rec *gbrFile, e *env) bool {
+	f.legalHold = rec.legalHold
 
-	return
+	if rec.legalHold.enabled {
+		e.logger.Warn(fmt.Sprintf(
+			fLegalHoldTrueLog, f.smbName, f.id, rec.legalHold.ownerID, rec.legalHold.matterID))
+		f.reason = reasonLegalHold
+
+		return false
+	}
+
+	e.logger.Info(fmt.Sprintf(fLegalHoldFalseLog, f.smbName, f.id))
+
+	return true
 }
 
-func (f *file) setMBDatasetByFileID(cmdOut string) {
-	e = ap.getEnv()
-	lines := strings.Split(string(cmdOut), ";")
+// verifyFanURI reports whether gbr's fan uri for f rebuilds to f.stagingPath
+// & is on f.fanIP. A uri without a fan volume matches f.stagingPath under any
+// of fanStagingRoots. Either not matching means the sourcefile has drifted
+// from what gbr says
+func (f *file) verifyFanURI(rec *gbrFile, e *env) bool {
+	pths := fanStagingPaths(rec.fanURI)
+	if len(pths) == 0 {
+		e.logger.Warn(fmt.Sprintf(fFanURIUnknownLog, f.smbName, f.id, rec.fanURI))
+		f.reason = reasonFanURIUnknown
 
-	for _, line := range lines {
-		if strings.Contains(line, "parent id") {
-			parentDS := line[len(line)-32:]
-			f.datasetID = parentDS
-			e.logger.Info(fmt.Sprintf(fGbrDatasetByFileIDLog, f.smbName, f.id, f.id, parentDS))
+		return false
+	}
 
-			return
-		}
+	if !slices.Contains(pths, strings.TrimPrefix(path.Clean(f.stagingPath), "/")) {
+		e.logger.Warn(fmt.Sprintf(fFanURIPathFalseLog, f.smbName, f.id, strings.Join(pths, " or "), f.stagingPath))
+		f.reason = reasonFanURIPathMismatch
+
+		return false
 	}
-	// Should never happen as caught with previous checks
-	e.logger.Warn(fmt.Sprintf(fGbrNoFileNameByFileIDLog, f.smbName, f.id, f.id))
+
+	host := fanHost(rec.fanURI)
+	if !host.Equal(f.fanIP) {
+		e.logger.Warn(fmt.Sprintf(fFanURIHostFalseLog, f.smbName, f.id, host, f.fanIP))
+		f.reason = reasonFanURIHostMismatch
+
+		return false
+	}
+
+	e.logger.Info(fmt.Sprintf(fFanURIMatchTrueLog, f.smbName, f.id, rec.fanURI, f.stagingPath, f.fanIP))
+
+	return true
+}
+
+func (f *file) setMBDatasetByFileID(rec *gbrFile, e *env) {
+	f.datasetID = rec.parentID
+	e.logger.Info(fmt.Sprintf(fGbrDatasetByFileIDLog, f.smbName, f.id, f.id, rec.parentID))
 }
 
-func (f *file) getByIDErrLog(err error) {
-	e = ap.getEnv()
-	err = errors.New(cleanGbrOut(err.Error()))
-	e.logger.Warn(err)
+func (f *file) getByIDErr(err error, e *env) error {
 	e.logger.Warn(fmt.Sprintf(fGbrNoFileNameByFileIDLog, f.smbName, f.id, f.id))
+
+	return fmt.Errorf(errWrapMsg, ErrGbrUnavailable, cleanGbrOut(err.Error()))
 }
 
-func (f *file) verifyInDataset(datasetID string) bool {
-	e = ap.getEnv()
+func (f *file) verifyInDataset(datasetID string, e *env) bool {
 	if f.datasetID == datasetID {
 		e.logger.Info(fmt.Sprintf(fDatasetMatchTrueLog, f.smbName, f.id, f.datasetID, datasetID))
 	} else {
 		e.logger.Warn(fmt.Sprintf(fDatasetMatchFalseLog, f.smbName, f.id, f.datasetID, datasetID))
+		f.reason = reasonDatasetMismatch
 	}
 
 	return f.datasetID == datasetID
 }
 
-func (f *file) verifyFileIDName(fileName string) bool {
-	e = ap.getEnv()
+func (f *file) verifyFileIDName(fileName string, e *env) bool {
 	if f.smbName == fileName {
 		e.logger.Info(fmt.Sprintf(
 			fSmbNameMatchFileIDNameTrueLog, f.smbName, f.id, f.smbName, fileName))
 	} else {
 		e.logger.Warn(fmt.Sprintf(
 			fSmbNameMatchFileIDNameFalseLog, f.smbName, f.id, f.smbName, fileName))
+		f.reason = reasonSmbNameMismatch
 	}
 
 	return f.smbName == fileName
 }
 
-// Verify local FS metadata
-func (f *file) verifyStat() bool {
-	e = ap.getEnv()
-	fileInfo, err := fs.Stat(e.fsys, f.stagingPath)
+// verifyStat checks f's size & createTime against f.stagingPath, stat'd
+// through e.afs as e.fsys cannot open an absolute path
+func (f *file) verifyStat(e *env) bool {
+	fileInfo, err := e.afs.Stat(f.stagingPath)
 
 	if err != nil {
 		e.logger.Warn(fmt.Sprintf(fExistsFalseLog, f.smbName, f.id, f.stagingPath))
+		f.reason = reasonNotExist
+
 		return false
 	}
 
 	e.logger.Info(fmt.Sprintf(fExistsTrueLog, f.smbName, f.id, f.stagingPath))
 
-	if !f.verifyFileSize(fileInfo.Size()) {
+	if !f.verifyFileSize(fileInfo.Size(), e) {
 		return false
 	}
 
-	if !f.verifyCreateTime(fileInfo.ModTime()) {
+	if !f.verifyCreateTime(fileInfo.ModTime(), e) {
 		return false
 	}
 
@@ -243,20 +345,22 @@ func (f *file) verifyStat() bool {
 	return true
 }
 
-func (f *file) verifyFileSize(size int64) bool {
-	e = ap.getEnv()
-	if size != f.fileInfo.Size() {
-		e.logger.Warn(fmt.Sprintf(fSizeMatchFalseLog, f.smbName, f.id, f.size, f.fileInfo.Size()))
+// verifyFileSize checks the sourcefile's file.size against size, the size of
+// file.stagingPath on disk, as process_node_async_processed_list.sh did
+func (f *file) verifyFileSize(size int64, e *env) bool {
+	if size != f.size {
+		e.logger.Warn(fmt.Sprintf(fSizeMatchFalseLog, f.smbName, f.id, f.size, size))
+		f.reason = reasonSizeMismatch
+
 		return false
 	}
 
-	e.logger.Info(fmt.Sprintf(fSizeMatchTrueLog, f.smbName, f.id, f.size, f.fileInfo.Size()))
+	e.logger.Info(fmt.Sprintf(fSizeMatchTrueLog, f.smbName, f.id, f.size, size))
 
 	return true
 }
 
-func (f *file) verifyCreateTime(t time.Time) bool {
-	e = ap.getEnv()
+func (f *file) verifyCreateTime(t time.Time, e *env) bool {
 	if !t.Equal(f.createTime) {
 		e.logger.Warn(fmt.Sprintf(fCreateTimeMatchFalseLog,
 			f.smbName,
@@ -264,6 +368,8 @@ func (f *file) verifyCreateTime(t time.Time) bool {
 			f.createTime.Round(time.Millisecond),
 			t.Round(time.Millisecond)))
 
+		f.reason = reasonCreateTimeMismatch
+
 		return false
 	}
 
@@ -276,3 +382,20 @@ func (f *file) verifyCreateTime(t time.Time) bool {
 
 	return true
 }
+
+// Verify a renamed file is still the same file it was before the move
+func (f *file) verifyIdentity(e *env) bool {
+	info, err := e.afs.Stat(f.stagingPath)
+
+	if err != nil ||
+		!sameInode(f.fileInfo, info) ||
+		info.Size() != f.fileInfo.Size() ||
+		!info.ModTime().Equal(f.fileInfo.ModTime()) {
+		e.logger.Warn(fmt.Sprintf(fIdentityMatchFalseLog, f.smbName, f.id, f.stagingPath))
+		return false
+	}
+
+	e.logger.Info(fmt.Sprintf(fIdentityMatchTrueLog, f.smbName, f.id, f.stagingPath))
+
+	return true
+}
@@ -5,11 +5,9 @@ import (
 	"errors"
 	"fmt"
 	"io/fs"
-	"log"
 	"math/rand"
 	"net"
 	"os"
-	"path"
 	"path/filepath"
 	"strconv"
 	"strings"
@@ -17,7 +15,7 @@ import (
 	"testing/fstest"
 	"time"
 
-	"bou.ke/monkey"
+	"github.com/spf13/afero"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -77,19 +75,32 @@ const (
 	testLongerContent        = "longer than the test"
 	testWrongDataset         = "396862B0791111ECA62400155D014E11"
 	testFileIDInWrongDataset = "3E4FF671B44E11ED86FF00155D015E0D"
+	testHoldOwnerID          = "jdoe"
+	testHoldMatterID         = "M-42"
 	testShortPath            = "staging/05043fe1-00000006-2f8630d0-608630d0-67d25000-ab66ac56"
 
 	letterBytes = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
 	guidBytes   = "0123456789abcdef"
 	fileIDBytes = "0123456789ABCDEF"
-
-	gbrList = "%v/gbr.list"
 )
 
 var (
 	workDirs = []string{"/workspaces/process_async_ds/", "/usr/src/app/"}
+	// testGBR answers gbr queries in tests. createAferoTest & createFSTest
+	// add each file they create to it
+	testGBR = newTestGBR()
 )
 
+// newTestGBR returns a fakeGBRClient that knows testFileID & has
+// testFileIDInWrongDataset in testWrongDataset, but not testBadFileID
+func newTestGBR() *fakeGBRClient {
+	c := newFakeGBRClient(testDatasetID)
+	c.addFile(file{id: testFileID, smbName: testSmbName, datasetID: testDatasetID})
+	c.addFile(file{id: testFileIDInWrongDataset, smbName: testSmbName, datasetID: testWrongDataset})
+
+	return c
+}
+
 func TestRootFSMap(t *testing.T) {
 	ex, err := os.Executable()
 	if err != nil {
@@ -138,21 +149,22 @@ func TestVerify(t *testing.T) {
 
 	fsys, files = createFSTest(t, 10)
 
-	e = new(env)
-	e = &env{
-		fsys:  fsys,
-		limit: afterNow,
-		sysIP: ips[0],
+	e := &env{
+		fsys:   fsys,
+		afs:    afero.FromIOFS{FS: fsys},
+		limit:  afterNow,
+		sysIPs: []net.IP{ips[0]},
 		//pwd:       testEnv.pwd,
 		datasetID: testDatasetID,
+		gbr:       testGBR,
 	}
 
 	e.logger, hook = setupLogs()
-	ap = NewAsyncProcessor(e, files)
 
 	t.Run("Gen verify", func(t *testing.T) {
 		for _, f := range files {
-			ok := f.verify()
+			ok, err := f.verify(e)
+			assert.NoError(t, err)
 			assert.True(t, ok)
 
 			gotLogMsg := hook.LastEntry().Message
@@ -162,6 +174,59 @@ func TestVerify(t *testing.T) {
 	})
 }
 
+// TestVerifyGbrOutput runs gbr's recorded file ls -d output, whose fan URI
+// has no fan volume, through every check
+func TestVerifyGbrOutput(t *testing.T) {
+	const (
+		testGbrFanIP = "192.168.101.210"
+		testGbrPath  = "data1/staging/download/2023_02/1eeb7769-fdb1-4313-8d76-ec719ad7a44c/mnt/nas01/" +
+			testSmbName
+	)
+
+	createTime := time.Now().Add(-time.Hour)
+
+	fsys := fstest.MapFS{
+		testGbrPath: &fstest.MapFile{Data: []byte(testContent), ModTime: createTime},
+	}
+
+	fi, err := fs.Stat(fsys, testGbrPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gbr := newFakeGBRClient(testDatasetID)
+	gbr.setFile(testFileID, testGbrFileIDDetailOut)
+
+	e := &env{
+		fsys:         fsys,
+		afs:          afero.FromIOFS{FS: fsys},
+		limit:        createTime.Add(-time.Hour),
+		sysIPs:       []net.IP{net.ParseIP(testGbrFanIP)},
+		datasetID:    testDatasetID,
+		gbr:          gbr,
+		mappingRules: []mappingRule{{Prefix: "data1/staging/download/", Replacement: "data1/staging/download.processed/"}},
+	}
+	e.logger, hook = setupLogs()
+
+	f := file{
+		smbName:     testSmbName,
+		id:          testFileID,
+		stagingPath: testGbrPath,
+		createTime:  createTime,
+		size:        fi.Size(),
+		fanIP:       net.ParseIP(testGbrFanIP),
+		fileInfo:    fi,
+	}
+
+	ok, err := f.verify(e)
+	assert.NoError(t, err)
+	assert.True(t, ok, f.reason)
+
+	gotLogMsg := hook.LastEntry().Message
+	wantLogMsg := fmt.Sprintf(fVerifiedLog, f.smbName, f.id)
+	assertCorrectString(t, gotLogMsg, wantLogMsg)
+}
+
 // TestVerifyEnvSettings encompasses TestVerifyIP & TestVerifyTimeLimit
 func TestVerifyEnvMatch(t *testing.T) {
 	// setup server ip
@@ -172,18 +237,14 @@ func TestVerifyEnvMatch(t *testing.T) {
 
 	now = time.Now()
 
-	e = new(env)
-	files = []file{}
-	ap = NewAsyncProcessor(e, files)
+	var e *env
 
 	t.Run("returns true if config metadata matches", func(t *testing.T) {
 		limit = now.Add(-24 * time.Hour)
-		e = ap.getEnv()
 		e = &env{
-			sysIP: ips[0],
-			limit: limit,
+			sysIPs: []net.IP{ips[0]},
+			limit:  limit,
 		}
-		ap.setEnv(e)
 
 		f = file{
 			smbName:     testName,
@@ -194,18 +255,16 @@ func TestVerifyEnvMatch(t *testing.T) {
 		}
 		e.logger, hook = setupLogs()
 
-		assert.True(t, f.verifyEnvMatch())
+		assert.True(t, f.verifyEnvMatch(e))
 
 		gotLogMsg := hook.LastEntry().Message
 		wantLogMsg := fmt.Sprintf(fEnvMatchLog, f.smbName, f.id, f.stagingPath)
 		assertCorrectString(t, gotLogMsg, wantLogMsg)
 	})
 	t.Run("returns false if ip is not the same as the current machine", func(t *testing.T) {
-		e = ap.getEnv()
 		e = &env{
-			sysIP: ip,
+			sysIPs: []net.IP{ip},
 		}
-		ap.setEnv(e)
 
 		f = file{
 			smbName: testName,
@@ -214,10 +273,10 @@ func TestVerifyEnvMatch(t *testing.T) {
 		}
 		e.logger, hook = setupLogs()
 
-		assert.False(t, f.verifyEnvMatch())
+		assert.False(t, f.verifyEnvMatch(e))
 
 		gotLogMsg := hook.LastEntry().Message
-		wantLogMsg := fmt.Sprintf(fIPMatchFalseLog, f.smbName, f.id, f.fanIP, ip)
+		wantLogMsg := fmt.Sprintf(fIPMatchFalseLog, f.smbName, f.id, f.fanIP, e.sysIPs)
 
 		assertCorrectString(t, gotLogMsg, wantLogMsg)
 	})
@@ -230,15 +289,13 @@ func TestVerifyEnvMatch(t *testing.T) {
 			fanIP:      ips[0],
 		}
 		limit = now.Add(24 * time.Hour)
-		e = ap.getEnv()
 		e = &env{
-			limit: limit,
-			sysIP: ips[0],
+			limit:  limit,
+			sysIPs: []net.IP{ips[0]},
 		}
-		ap.setEnv(e)
 		e.logger, hook = setupLogs()
 
-		assert.False(t, f.verifyEnvMatch())
+		assert.False(t, f.verifyEnvMatch(e))
 
 		gotLogMsg := hook.LastEntry().Message
 		wantLogMsg := fmt.Sprintf(fCreateTimeBeforeTimeLimitLog,
@@ -251,6 +308,41 @@ func TestVerifyEnvMatch(t *testing.T) {
 	})
 }
 
+func TestVerifyMapping(t *testing.T) {
+	e := new(env)
+
+	t.Run("returns true if a rule maps the stagingPath", func(t *testing.T) {
+		f = file{
+			smbName:     testName,
+			id:          testFileID,
+			stagingPath: testPath,
+		}
+		e.logger, hook = setupLogs()
+
+		assert.True(t, f.verifyMapping(e))
+
+		gotLogMsg := hook.LastEntry().Message
+		wantLogMsg := fmt.Sprintf(fMappingTrueLog, f.smbName, f.id, f.stagingPath, mustNewPath(t, f))
+		assertCorrectString(t, gotLogMsg, wantLogMsg)
+	})
+
+	t.Run("returns false if no rule maps the stagingPath", func(t *testing.T) {
+		f = file{
+			smbName:     testName,
+			id:          testFileID,
+			stagingPath: testName,
+		}
+		e.logger, hook = setupLogs()
+
+		assert.False(t, f.verifyMapping(e))
+
+		gotLogMsg := hook.LastEntry().Message
+		wantLogMsg := fmt.Sprintf(fMappingFalseLog, f.smbName, f.id, fmt.Sprintf(errNoMappingRule, testName))
+		assertCorrectString(t, gotLogMsg, wantLogMsg)
+		assertCorrectString(t, f.reason, reasonNoMapping)
+	})
+}
+
 func TestVerifyIP(t *testing.T) {
 	// setup server ip
 	hostname, _ := os.Hostname()
@@ -258,9 +350,7 @@ func TestVerifyIP(t *testing.T) {
 	// set incorrect ip
 	testIP := net.ParseIP("192.168.101.1")
 
-	e = new(env)
-	files = []file{}
-	ap = NewAsyncProcessor(e, files)
+	e := new(env)
 
 	t.Run("returns true if ip is same as the current machine", func(t *testing.T) {
 		f = file{
@@ -269,12 +359,12 @@ func TestVerifyIP(t *testing.T) {
 			fanIP:   ips[0],
 		}
 		e.logger, hook = setupLogs()
-		e.sysIP = ips[0]
+		e.sysIPs = []net.IP{ips[0]}
 
-		assert.True(t, f.verifyIP())
+		assert.True(t, f.verifyIP(e))
 
 		gotLogMsg := hook.LastEntry().Message
-		wantLogMsg := fmt.Sprintf(fIPMatchTrueLog, f.smbName, f.id, f.fanIP, ips[0])
+		wantLogMsg := fmt.Sprintf(fIPMatchTrueLog, f.smbName, f.id, f.fanIP, []net.IP{ips[0]})
 		assertCorrectString(t, gotLogMsg, wantLogMsg)
 	})
 	t.Run("returns false if ip is not the same as the current machine", func(t *testing.T) {
@@ -284,14 +374,30 @@ func TestVerifyIP(t *testing.T) {
 			fanIP:   ips[0],
 		}
 		e.logger, hook = setupLogs()
-		e.sysIP = testIP
+		e.sysIPs = []net.IP{testIP}
 
-		assert.False(t, f.verifyIP())
+		assert.False(t, f.verifyIP(e))
 
 		gotLogMsg := hook.LastEntry().Message
-		wantLogMsg := fmt.Sprintf(fIPMatchFalseLog, f.smbName, f.id, f.fanIP, testIP)
+		wantLogMsg := fmt.Sprintf(fIPMatchFalseLog, f.smbName, f.id, f.fanIP, []net.IP{testIP})
 
 		assertCorrectString(t, gotLogMsg, wantLogMsg)
+		assertCorrectString(t, f.reason, reasonIPMismatch)
+	})
+	t.Run("returns true if ip is any of a dual homed machine's ips", func(t *testing.T) {
+		f = file{
+			smbName: testName,
+			id:      testFileID,
+			fanIP:   net.ParseIP("10.0.0.5").To4(),
+		}
+		e.logger, hook = setupLogs()
+		e.sysIPs = []net.IP{testIP, net.ParseIP("10.0.0.5")}
+
+		assert.True(t, f.verifyIP(e))
+
+		gotLogMsg := hook.LastEntry().Message
+		wantLogMsg := fmt.Sprintf(fIPMatchTrueLog, f.smbName, f.id, f.fanIP, e.sysIPs)
+		assertCorrectString(t, gotLogMsg, wantLogMsg)
 	})
 }
 
@@ -300,9 +406,7 @@ func TestVerifyTimeLimit(t *testing.T) {
 	hours := time.Duration(days * 24)
 	now := time.Now()
 
-	e = new(env)
-	files = []file{}
-	ap = NewAsyncProcessor(e, files)
+	e := new(env)
 
 	t.Run("returns true if file.createTime is after time limit", func(t *testing.T) {
 		f = file{
@@ -313,7 +417,7 @@ func TestVerifyTimeLimit(t *testing.T) {
 		e.logger, hook = setupLogs()
 		e.limit = now.Add(-((hours) * time.Hour))
 
-		assert.True(t, f.verifyTimeLimit())
+		assert.True(t, f.verifyTimeLimit(e))
 
 		gotLogMsg := hook.LastEntry().Message
 		wantLogMsg := fmt.Sprintf(
@@ -335,7 +439,7 @@ func TestVerifyTimeLimit(t *testing.T) {
 		e.limit = now.Add(24 * time.Hour)
 		e.logger, hook = setupLogs()
 
-		assert.False(t, f.verifyTimeLimit())
+		assert.False(t, f.verifyTimeLimit(e))
 
 		gotLogMsg := hook.LastEntry().Message
 		wantLogMsg := fmt.Sprintf(fCreateTimeBeforeTimeLimitLog,
@@ -350,35 +454,21 @@ func TestVerifyTimeLimit(t *testing.T) {
 
 // TestVerifyGBMetadata encompasses verifyInDataset, getMBFileName/DSByFileID
 func TestVerifyGBMetadata(t *testing.T) {
-	ex, _ := os.Executable()
-	dir, _ := path.Split(ex)
-	list := fmt.Sprintf(gbrList, dir)
-
-	if err := os.Truncate(list, 0); err != nil {
-		log.Printf("Failed to truncate: %v", err)
-	}
-
-	out, err := os.OpenFile(list, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
-		log.Fatal(err)
-	}
-	defer out.Close()
-
-	e = new(env)
-	files = []file{}
-	ap = NewAsyncProcessor(e, files)
+	e := new(env)
+	e.gbr = testGBR
 
 	t.Run("returns true if file.smbName matches filename", func(t *testing.T) {
 		_, files := createFSTest(t, 1)
-		e = new(env)
 		e.datasetID = testDatasetID
-		ap.setEnv(e)
+		e.gbr = testGBR
 
 		e.logger, hook = setupLogs()
 
-		assert.True(t, files[0].verifyGBMetadata())
+		ok, err := files[0].verifyGBMetadata(e)
+		assert.NoError(t, err)
+		assert.True(t, ok)
 
-		gotLogMsg := hook.LastEntry().Message
+		gotLogMsg := hook.Entries[len(hook.Entries)-3].Message
 		wantLogMsg := fmt.Sprintf(
 			fSmbNameMatchFileIDNameTrueLog,
 			files[0].smbName,
@@ -386,6 +476,42 @@ func TestVerifyGBMetadata(t *testing.T) {
 			files[0].smbName,
 			files[0].smbName)
 		assertCorrectString(t, gotLogMsg, wantLogMsg)
+
+		gotLogMsg = hook.Entries[len(hook.Entries)-2].Message
+		wantLogMsg = fmt.Sprintf(fLegalHoldFalseLog, files[0].smbName, files[0].id)
+		assertCorrectString(t, gotLogMsg, wantLogMsg)
+
+		gotLogMsg = hook.LastEntry().Message
+		wantLogMsg = fmt.Sprintf(
+			fFanURIMatchTrueLog,
+			files[0].smbName,
+			files[0].id,
+			fakeFanURI(files[0]),
+			files[0].stagingPath,
+			files[0].fanIP)
+		assertCorrectString(t, gotLogMsg, wantLogMsg)
+	})
+	t.Run("returns false if file is under legal hold", func(t *testing.T) {
+		gbr := newFakeGBRClient(testDatasetID)
+		gbr.addFile(file{id: testFileID, smbName: testSmbName, datasetID: testDatasetID})
+		gbr.holdFile(testFileID, testHoldOwnerID, testHoldMatterID)
+
+		f = file{
+			smbName: testSmbName,
+			id:      testFileID,
+		}
+
+		e := &env{datasetID: testDatasetID, gbr: gbr}
+		e.logger, hook = setupLogs()
+
+		ok, err := f.verifyGBMetadata(e)
+		assert.NoError(t, err)
+		assert.False(t, ok)
+		assertCorrectString(t, f.reason, reasonLegalHold)
+
+		gotLogMsg := hook.LastEntry().Message
+		wantLogMsg := fmt.Sprintf(fLegalHoldTrueLog, testSmbName, testFileID, testHoldOwnerID, testHoldMatterID)
+		assertCorrectString(t, gotLogMsg, wantLogMsg)
 	})
 	t.Run("returns false if file.datasetID does not match DatasetID", func(t *testing.T) {
 		f = file{
@@ -394,9 +520,15 @@ func TestVerifyGBMetadata(t *testing.T) {
 			datasetID: testWrongDataset,
 		}
 
+		gbr := newFakeGBRClient(testDatasetID)
+		gbr.addFile(file{id: testFileID, smbName: testName, datasetID: testWrongDataset})
+
+		e := &env{datasetID: testDatasetID, gbr: gbr}
 		e.logger, hook = setupLogs()
 
-		assert.False(t, f.verifyGBMetadata())
+		ok, err := f.verifyGBMetadata(e)
+		assert.NoError(t, err)
+		assert.False(t, ok)
 
 		gotLogMsg := hook.LastEntry().Message
 		wantLogMsg := fmt.Sprintf(fDatasetMatchFalseLog, f.smbName, f.id, f.datasetID, testDatasetID)
@@ -411,7 +543,9 @@ func TestVerifyGBMetadata(t *testing.T) {
 		}
 		e.logger, hook = setupLogs()
 
-		assert.False(t, f.verifyGBMetadata())
+		ok, err := f.verifyGBMetadata(e)
+		assert.NoError(t, err)
+		assert.False(t, ok)
 
 		gotLogMsg := hook.LastEntry().Message
 		wantLogMsg := fmt.Sprintf(
@@ -427,9 +561,12 @@ func TestVerifyGBMetadata(t *testing.T) {
 		}
 
 		e.datasetID = testDatasetID
+		e.gbr = testGBR
 		e.logger, hook = setupLogs()
 
-		assert.False(t, f.verifyGBMetadata())
+		ok, err := f.verifyGBMetadata(e)
+		assert.NoError(t, err)
+		assert.False(t, ok)
 
 		gotLogMsg := hook.LastEntry().Message
 		wantLogMsg := fmt.Sprintf(
@@ -439,9 +576,8 @@ func TestVerifyGBMetadata(t *testing.T) {
 }
 
 func TestGetMBFilenameByFileID(t *testing.T) {
-	e = new(env)
-	files = []file{}
-	ap = NewAsyncProcessor(e, files)
+	e := new(env)
+	e.gbr = testGBR
 
 	t.Run("should return true if it exists", func(t *testing.T) {
 		f = file{
@@ -449,7 +585,7 @@ func TestGetMBFilenameByFileID(t *testing.T) {
 			id:      testFileID,
 		}
 		e.logger, hook = setupLogs()
-		ok := f.verifyMBFileNameByFileID(f.getGBMetadata())
+		ok := f.verifyMBFileNameByFileID(mustGBMetadata(t, &f, e), e)
 		assert.True(t, ok)
 
 		gotLogMsg := hook.LastEntry().Message
@@ -464,7 +600,7 @@ func TestGetMBFilenameByFileID(t *testing.T) {
 			id:      testFileID,
 		}
 		e.logger, hook = setupLogs()
-		ok := f.verifyMBFileNameByFileID(f.getGBMetadata())
+		ok := f.verifyMBFileNameByFileID(mustGBMetadata(t, &f, e), e)
 		assert.False(t, ok)
 
 		gotLogMsg := hook.LastEntry().Message
@@ -479,7 +615,7 @@ func TestGetMBFilenameByFileID(t *testing.T) {
 			id:      testBadFileID,
 		}
 		e.logger, hook = setupLogs()
-		ok := f.verifyMBFileNameByFileID(f.getGBMetadata())
+		ok := f.verifyMBFileNameByFileID(mustGBMetadata(t, &f, e), e)
 		assert.False(t, ok)
 
 		gotLogMsg := hook.LastEntry().Message
@@ -490,9 +626,8 @@ func TestGetMBFilenameByFileID(t *testing.T) {
 }
 
 func TestGetMBDatasetByFileID(t *testing.T) {
-	e = new(env)
-	files = []file{}
-	ap = NewAsyncProcessor(e, files)
+	e := new(env)
+	e.gbr = testGBR
 
 	t.Run("should return the dataset by id if it exists", func(t *testing.T) {
 		f = file{
@@ -502,8 +637,9 @@ func TestGetMBDatasetByFileID(t *testing.T) {
 		}
 
 		e.datasetID = testDatasetID
+		e.gbr = testGBR
 		e.logger, hook = setupLogs()
-		ok := f.verifyMBDatasetByFileID(f.getGBMetadata())
+		ok := f.verifyMBDatasetByFileID(mustGBMetadata(t, &f, e), e)
 		assert.True(t, ok)
 
 		gotLogMsg := hook.LastEntry().Message
@@ -518,7 +654,7 @@ func TestGetMBDatasetByFileID(t *testing.T) {
 			id:      testBadFileID,
 		}
 		e.logger, hook = setupLogs()
-		ok := f.verifyMBDatasetByFileID(f.getGBMetadata())
+		ok := f.verifyMBDatasetByFileID(mustGBMetadata(t, &f, e), e)
 		assert.False(t, ok)
 
 		gotLogMsg := hook.LastEntry().Message
@@ -527,42 +663,157 @@ func TestGetMBDatasetByFileID(t *testing.T) {
 	})
 }
 
-func TestParseFileNameByID(t *testing.T) {
-	e = new(env)
-	files = []file{}
-	ap = NewAsyncProcessor(e, files)
+func TestVerifyLegalHold(t *testing.T) {
+	e := new(env)
 
-	t.Run("should parse output and return filename", func(t *testing.T) {
-		f = file{
-			smbName:   testSmbName,
-			id:        testFileID,
-			datasetID: testDatasetID,
-		}
+	t.Run("returns true if file is not held", func(t *testing.T) {
+		f = file{smbName: testSmbName, id: testFileID}
 		e.logger, hook = setupLogs()
-		got := f.parseMBFileNameByFileID(testGbrFileIDDetailOutLog)
-		want := testSmbName
-		assertCorrectString(t, got, want)
+
+		assert.True(t, f.verifyLegalHold(&gbrFile{}, e))
+		assert.Empty(t, f.reason)
 
 		gotLogMsg := hook.LastEntry().Message
-		wantLogMsg := fmt.Sprintf(
-			fGbrFileNameByFileIDLog, testSmbName, testFileID, testFileID, testSmbName)
+		wantLogMsg := fmt.Sprintf(fLegalHoldFalseLog, testSmbName, testFileID)
 		assertCorrectString(t, gotLogMsg, wantLogMsg)
 	})
+
+	t.Run("returns false & keeps the hold if file is held", func(t *testing.T) {
+		f = file{smbName: testSmbName, id: testFileID}
+		e.logger, hook = setupLogs()
+
+		hold := legalHold{enabled: true, ownerID: testHoldOwnerID, matterID: testHoldMatterID}
+
+		assert.False(t, f.verifyLegalHold(&gbrFile{legalHold: hold}, e))
+		assertCorrectString(t, f.reason, reasonLegalHold)
+		assert.Equal(t, hold, f.legalHold)
+
+		gotLogMsg := hook.LastEntry().Message
+		wantLogMsg := fmt.Sprintf(fLegalHoldTrueLog, testSmbName, testFileID, testHoldOwnerID, testHoldMatterID)
+		assertCorrectString(t, gotLogMsg, wantLogMsg)
+	})
+}
+
+func TestVerifyFanURI(t *testing.T) {
+	const (
+		testFanIP  = "10.41.28.112"
+		testFanURI = "ftp://user@" + testFanIP + ":2121/fan_c1:/download/" + testSmbName
+		testFanPth = "data2/staging/download/" + testSmbName
+	)
+
+	e := new(env)
+
+	t.Run("returns true if fan URI maps to file.stagingPath on file.fanIP", func(t *testing.T) {
+		for _, pth := range []string{testFanPth, "/" + testFanPth} {
+			f = file{smbName: testSmbName, id: testFileID, stagingPath: pth, fanIP: net.ParseIP(testFanIP)}
+			e.logger, hook = setupLogs()
+
+			assert.True(t, f.verifyFanURI(&gbrFile{fanURI: testFanURI}, e))
+
+			gotLogMsg := hook.LastEntry().Message
+			wantLogMsg := fmt.Sprintf(fFanURIMatchTrueLog, testSmbName, testFileID, testFanURI, pth, testFanIP)
+			assertCorrectString(t, gotLogMsg, wantLogMsg)
+		}
+	})
+
+	t.Run("returns true if fan URI without a fan volume is under a staging root", func(t *testing.T) {
+		uri := "ftp://user@" + testFanIP + ":2121/download/" + testFileID
+
+		for _, pth := range []string{
+			"data1/staging/download/" + testFileID,
+			"/data2/staging/download/" + testFileID,
+			"data3/staging/download/" + testFileID,
+			"mb/FAN/download/" + testFileID,
+		} {
+			f = file{smbName: testSmbName, id: testFileID, stagingPath: pth, fanIP: net.ParseIP(testFanIP)}
+			e.logger, hook = setupLogs()
+
+			assert.True(t, f.verifyFanURI(&gbrFile{fanURI: uri}, e), pth)
+		}
+	})
+
+	falseTests := []struct {
+		name        string
+		uri         string
+		stagingPath string
+		wantReason  string
+		wantLog     string
+	}{
+		{
+			name:        "fan URI has an unknown fan volume",
+			uri:         "ftp://user@" + testFanIP + ":2121/fan_c3:/download/" + testSmbName,
+			stagingPath: testFanPth,
+			wantReason:  reasonFanURIUnknown,
+			wantLog: fmt.Sprintf(fFanURIUnknownLog, testSmbName, testFileID,
+				"ftp://user@"+testFanIP+":2121/fan_c3:/download/"+testSmbName),
+		},
+		{
+			name:        "fan URI maps to another path",
+			uri:         testFanURI,
+			stagingPath: "data1/staging/download/" + testSmbName,
+			wantReason:  reasonFanURIPathMismatch,
+			wantLog: fmt.Sprintf(fFanURIPathFalseLog, testSmbName, testFileID, testFanPth,
+				"data1/staging/download/"+testSmbName),
+		},
+		{
+			name:        "fan URI without a fan volume maps to another path",
+			uri:         "ftp://user@" + testFanIP + ":2121/download/" + testFileID,
+			stagingPath: "data1/staging/download/" + testSmbName,
+			wantReason:  reasonFanURIPathMismatch,
+			wantLog: fmt.Sprintf(fFanURIPathFalseLog, testSmbName, testFileID,
+				"mb/FAN/download/"+testFileID+" or data1/staging/download/"+testFileID+
+					" or data2/staging/download/"+testFileID+" or data3/staging/download/"+testFileID,
+				"data1/staging/download/"+testSmbName),
+		},
+		{
+			name:        "fan URI without a fan volume is not under a staging root",
+			uri:         "ftp://user@" + testFanIP + ":2121/download/" + testFileID,
+			stagingPath: "download/" + testFileID,
+			wantReason:  reasonFanURIPathMismatch,
+			wantLog: fmt.Sprintf(fFanURIPathFalseLog, testSmbName, testFileID,
+				"mb/FAN/download/"+testFileID+" or data1/staging/download/"+testFileID+
+					" or data2/staging/download/"+testFileID+" or data3/staging/download/"+testFileID,
+				"download/"+testFileID),
+		},
+		{
+			name:        "fan URI is on another node",
+			uri:         strings.Replace(testFanURI, testFanIP, "10.41.28.113", 1),
+			stagingPath: testFanPth,
+			wantReason:  reasonFanURIHostMismatch,
+			wantLog:     fmt.Sprintf(fFanURIHostFalseLog, testSmbName, testFileID, "10.41.28.113", testFanIP),
+		},
+	}
+
+	for _, tt := range falseTests {
+		t.Run("returns false if "+tt.name, func(t *testing.T) {
+			f = file{smbName: testSmbName, id: testFileID, stagingPath: tt.stagingPath, fanIP: net.ParseIP(testFanIP)}
+			e.logger, hook = setupLogs()
+
+			assert.False(t, f.verifyFanURI(&gbrFile{fanURI: tt.uri}, e))
+			assertCorrectString(t, f.reason, tt.wantReason)
+
+			gotLogMsg := hook.LastEntry().Message
+			assertCorrectString(t, gotLogMsg, tt.wantLog)
+		})
+	}
 }
 
 func TestSetFileDatasetByID(t *testing.T) {
-	e = new(env)
-	files = []file{}
-	ap = NewAsyncProcessor(e, files)
+	e := new(env)
 
-	t.Run("should set f.datasetID if it exists", func(t *testing.T) {
+	t.Run("should set f.datasetID to the parent id", func(t *testing.T) {
 		f = file{
 			smbName: testSmbName,
 			id:      testFileID,
 		}
 		e.logger, hook = setupLogs()
 
-		f.setMBDatasetByFileID(testGbrFileIDDetailOutLog)
+		rec, err := parseGbrFile(testGbrFileIDDetailOut)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		f.setMBDatasetByFileID(rec, e)
 		got := f.datasetID
 		want := testDatasetID
 		assertCorrectString(t, got, want)
@@ -572,61 +823,76 @@ func TestSetFileDatasetByID(t *testing.T) {
 			fGbrDatasetByFileIDLog, testSmbName, testFileID, testFileID, testDatasetID)
 		assertCorrectString(t, gotLogMsg, wantLogMsg)
 	})
+}
 
-	t.Run("should return '' if the file does not exist", func(t *testing.T) {
-		f = file{
-			smbName: testSmbName,
-			id:      testBadFileID,
-		}
+func TestGetGBMetadata(t *testing.T) {
+	t.Run("should return nil if gbr has no such file", func(t *testing.T) {
+		e := &env{gbr: testGBR}
 		e.logger, hook = setupLogs()
 
-		f.setMBDatasetByFileID("")
-		got := f.datasetID
-		want := ""
-		assertCorrectString(t, got, want)
+		f = file{smbName: testSmbName, id: testBadFileID}
+
+		rec, err := f.getGBMetadata(e)
+		assert.NoError(t, err)
+		assert.Nil(t, rec)
+	})
+
+	t.Run("should return ErrGbrOutput if gbr output is malformed", func(t *testing.T) {
+		gbr := newFakeGBRClient(testDatasetID)
+		gbr.setFile(testFileID, testGbrFileIDErrOut)
+
+		e := &env{gbr: gbr}
+		e.logger, hook = setupLogs()
+
+		f = file{smbName: testSmbName, id: testFileID}
+
+		_, err := f.getGBMetadata(e)
+		assert.ErrorIs(t, err, ErrGbrOutput)
 
 		gotLogMsg := hook.LastEntry().Message
-		wantLogMsg := fmt.Sprintf(
-			fGbrNoFileNameByFileIDLog, testSmbName, testBadFileID, testBadFileID)
+		wantLogMsg := fmt.Sprintf(fGbrOutputLog, testSmbName, testFileID, err)
 		assertCorrectString(t, gotLogMsg, wantLogMsg)
 	})
+
+	t.Run("should return ErrGbrOutput if gbr returns another file", func(t *testing.T) {
+		gbr := newFakeGBRClient(testDatasetID)
+		gbr.setFile(testBadFileID, testGbrFileIDDetailOut)
+
+		e := &env{gbr: gbr}
+		e.logger, hook = setupLogs()
+
+		f = file{smbName: testSmbName, id: testBadFileID}
+
+		_, err := f.getGBMetadata(e)
+		assert.ErrorIs(t, err, ErrGbrOutput)
+		assert.EqualError(t, err, fmt.Errorf(errGbrFileWrongID, ErrGbrOutput, testFileID).Error())
+	})
 }
 
-func TestGetByIDErrLog(t *testing.T) {
-	e = new(env)
-	files = []file{}
-	ap = NewAsyncProcessor(e, files)
+func TestGetByIDErr(t *testing.T) {
+	e := new(env)
 
-	t.Run("should log err and gbrNoFileNameByID on err", func(t *testing.T) {
+	t.Run("should log gbrNoFileNameByID & return ErrGbrUnavailable on err", func(t *testing.T) {
 		f = file{
 			smbName: testSmbName,
 			id:      testFileID,
 		}
-		fakeLoggerError := func(_ ...interface{}) {
-			panic(testGbrFileIDErrOut)
-		}
-
-		patch := monkey.Patch(e.logger.Error, fakeLoggerError)
-		defer patch.Unpatch()
 
 		e.logger, hook = setupLogs()
 
-		f.getByIDErrLog(errors.New(testGbrFileIDErrOut))
+		err := f.getByIDErr(errors.New(testGbrFileIDErrOut), e)
+		assert.ErrorIs(t, err, ErrGbrUnavailable)
+		assert.ErrorContains(t, err, testGbrFileIDErrOutLog)
 
-		gotLogMsgs := hook.Entries
-		wantLogMsg := testGbrFileIDErrOutLog
-		assertCorrectString(t, gotLogMsgs[0].Message, wantLogMsg)
-
-		wantLogMsg = fmt.Sprintf(
+		gotLogMsg := hook.LastEntry().Message
+		wantLogMsg := fmt.Sprintf(
 			fGbrNoFileNameByFileIDLog, testSmbName, testFileID, testFileID)
-		assertCorrectString(t, gotLogMsgs[1].Message, wantLogMsg)
+		assertCorrectString(t, gotLogMsg, wantLogMsg)
 	})
 }
 
 func TestVerifyInProcessedDataset(t *testing.T) {
-	e = new(env)
-	files = []file{}
-	ap = NewAsyncProcessor(e, files)
+	e := new(env)
 
 	t.Run("returns true if file.datasetID matches asyncProcessedDatasetID", func(t *testing.T) {
 		f = file{
@@ -636,7 +902,7 @@ func TestVerifyInProcessedDataset(t *testing.T) {
 		}
 		e.logger, hook = setupLogs()
 
-		assert.True(t, f.verifyInDataset(testDatasetID))
+		assert.True(t, f.verifyInDataset(testDatasetID, e))
 
 		gotLogMsg := hook.LastEntry().Message
 		wantLogMsg := fmt.Sprintf(fDatasetMatchTrueLog, f.smbName, f.id, f.datasetID, testDatasetID)
@@ -651,18 +917,17 @@ func TestVerifyInProcessedDataset(t *testing.T) {
 
 		e.logger, hook = setupLogs()
 
-		assert.False(t, f.verifyInDataset(testWrongDataset))
+		assert.False(t, f.verifyInDataset(testWrongDataset, e))
 
 		gotLogMsg := hook.LastEntry().Message
 		wantLogMsg := fmt.Sprintf(fDatasetMatchFalseLog, f.smbName, f.id, f.datasetID, testWrongDataset)
 		assertCorrectString(t, gotLogMsg, wantLogMsg)
+		assertCorrectString(t, f.reason, reasonDatasetMismatch)
 	})
 }
 
 func TestVerifyStat(t *testing.T) {
-	e = new(env)
-	files = []file{}
-	ap = NewAsyncProcessor(e, files)
+	e := new(env)
 
 	t.Run("returns true if file matches", func(t *testing.T) {
 		fsys = fstest.MapFS{
@@ -679,8 +944,9 @@ func TestVerifyStat(t *testing.T) {
 		}
 		e.logger, hook = setupLogs()
 		e.fsys = fsys
+		e.afs = afero.FromIOFS{FS: fsys}
 
-		assert.True(t, f.verifyStat())
+		assert.True(t, f.verifyStat(e))
 
 		gotLogMsg := hook.LastEntry().Message
 		wantLogMsg := fmt.Sprintf(fStatMatchLog, f.smbName, f.id, f.stagingPath)
@@ -688,6 +954,37 @@ func TestVerifyStat(t *testing.T) {
 		assertCorrectString(t, gotLogMsg, wantLogMsg)
 	})
 
+	t.Run("returns true if an absolute stagingPath matches", func(t *testing.T) {
+		pth := filepath.Join(t.TempDir(), testName)
+
+		err := os.WriteFile(pth, []byte(testContent), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		info, err := os.Stat(pth)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		f = file{
+			smbName:     testName,
+			id:          testFileID,
+			stagingPath: pth,
+			createTime:  info.ModTime(),
+			size:        info.Size(),
+		}
+		e.logger, hook = setupLogs()
+		e.fsys = os.DirFS("/")
+		e.afs = afero.NewOsFs()
+
+		assert.True(t, f.verifyStat(e), f.reason)
+
+		gotLogMsg := hook.LastEntry().Message
+		wantLogMsg := fmt.Sprintf(fStatMatchLog, f.smbName, f.id, pth)
+		assertCorrectString(t, gotLogMsg, wantLogMsg)
+	})
+
 	t.Run("returns false if file does not exist", func(t *testing.T) {
 		f = file{
 			smbName:     testName,
@@ -701,37 +998,41 @@ func TestVerifyStat(t *testing.T) {
 
 		e.logger, hook = setupLogs()
 		e.fsys = fsys
+		e.afs = afero.FromIOFS{FS: fsys}
 
-		assert.False(t, f.verifyStat())
+		assert.False(t, f.verifyStat(e))
 
 		gotLogMsg := hook.LastEntry().Message
 		wantLogMsg := fmt.Sprintf(fExistsFalseLog, f.smbName, f.id, f.stagingPath)
 
 		assertCorrectString(t, gotLogMsg, wantLogMsg)
+		assertCorrectString(t, f.reason, reasonNotExist)
 	})
 
-	t.Run("returns false if file.size does not match comparator", func(t *testing.T) {
+	t.Run("returns false if the sourcefile's file.size does not match the disk", func(t *testing.T) {
 		fsys = fstest.MapFS{
-			testPath:         &fstest.MapFile{Data: []byte(testContent)},
-			testMismatchPath: &fstest.MapFile{Data: []byte(testLongerContent)},
+			testPath: &fstest.MapFile{Data: []byte(testLongerContent)},
 		}
-		info, _ := fsys.Stat(testMismatchPath)
+		// setFiles stats the same path, so fileInfo always matches the disk
+		info, _ := fsys.Stat(testPath)
 		f = file{
 			smbName:     testName,
 			id:          testFileID,
 			stagingPath: testPath,
-			size:        4,
+			size:        int64(len(testContent)),
 			fileInfo:    info,
 		}
 		e.logger, hook = setupLogs()
 		e.fsys = fsys
+		e.afs = afero.FromIOFS{FS: fsys}
 
-		assert.False(t, f.verifyStat())
+		assert.False(t, f.verifyStat(e))
 
 		gotLogMsg := hook.LastEntry().Message
-		wantLogMsg := fmt.Sprintf(fSizeMatchFalseLog, f.smbName, f.id, f.size, f.fileInfo.Size())
+		wantLogMsg := fmt.Sprintf(fSizeMatchFalseLog, f.smbName, f.id, f.size, len(testLongerContent))
 
 		assertCorrectString(t, gotLogMsg, wantLogMsg)
+		assertCorrectString(t, f.reason, reasonSizeMismatch)
 	})
 
 	t.Run("returns false if file.CreateTime does not match comparator", func(t *testing.T) {
@@ -757,8 +1058,9 @@ func TestVerifyStat(t *testing.T) {
 
 		e.logger, hook = setupLogs()
 		e.fsys = fsys
+		e.afs = afero.FromIOFS{FS: fsys}
 
-		assert.False(t, f.verifyStat())
+		assert.False(t, f.verifyStat(e))
 
 		gotLogMsg := hook.LastEntry().Message
 		wantLogMsg := fmt.Sprintf(fCreateTimeMatchFalseLog,
@@ -772,9 +1074,7 @@ func TestVerifyStat(t *testing.T) {
 }
 
 func TestVerifyFileSize(t *testing.T) {
-	e = new(env)
-	files = []file{}
-	ap = NewAsyncProcessor(e, files)
+	e := new(env)
 
 	t.Run("returns true if file.size matches comparator", func(t *testing.T) {
 		fsys = fstest.MapFS{
@@ -791,44 +1091,43 @@ func TestVerifyFileSize(t *testing.T) {
 		}
 		e.logger, hook = setupLogs()
 		e.fsys = fsys
+		e.afs = afero.FromIOFS{FS: fsys}
 
-		assert.True(t, f.verifyFileSize(size))
+		assert.True(t, f.verifyFileSize(size, e))
 
 		gotLogMsg := hook.LastEntry().Message
-		wantLogMsg := fmt.Sprintf(fSizeMatchTrueLog, f.smbName, f.id, f.size, f.fileInfo.Size())
+		wantLogMsg := fmt.Sprintf(fSizeMatchTrueLog, f.smbName, f.id, f.size, size)
 
 		assertCorrectString(t, gotLogMsg, wantLogMsg)
 	})
 	t.Run("returns false if file.size does not match comparator", func(t *testing.T) {
 		fsys = fstest.MapFS{
-			testPath:         &fstest.MapFile{Data: []byte(testContent)},
-			testMismatchPath: &fstest.MapFile{Data: []byte(testLongerContent)},
+			testPath: &fstest.MapFile{Data: []byte(testLongerContent)},
 		}
-		fileInfo, _ := fsys.Stat(testMismatchPath)
-		size := int64(4)
+		info, _ := fsys.Stat(testPath)
 		f = file{
 			smbName:     testName,
 			id:          testFileID,
 			stagingPath: testPath,
-			size:        size,
-			fileInfo:    fileInfo,
+			size:        int64(4),
+			fileInfo:    info,
 		}
 		e.logger, hook = setupLogs()
 		e.fsys = fsys
+		e.afs = afero.FromIOFS{FS: fsys}
 
-		assert.False(t, f.verifyStat())
+		assert.False(t, f.verifyFileSize(info.Size(), e))
 
 		gotLogMsg := hook.LastEntry().Message
-		wantLogMsg := fmt.Sprintf(fSizeMatchFalseLog, f.smbName, f.id, f.size, f.fileInfo.Size())
+		wantLogMsg := fmt.Sprintf(fSizeMatchFalseLog, f.smbName, f.id, f.size, info.Size())
 
 		assertCorrectString(t, gotLogMsg, wantLogMsg)
+		assertCorrectString(t, f.reason, reasonSizeMismatch)
 	})
 }
 
 func TestVerifyFileCreateTime(t *testing.T) {
-	e = new(env)
-	files = []file{}
-	ap = NewAsyncProcessor(e, files)
+	e := new(env)
 
 	t.Run("returns true if file.createTime matches comparator", func(t *testing.T) {
 		fsys = fstest.MapFS{}
@@ -851,8 +1150,9 @@ func TestVerifyFileCreateTime(t *testing.T) {
 		}
 		e.logger, hook = setupLogs()
 		e.fsys = fsys
+		e.afs = afero.FromIOFS{FS: fsys}
 
-		assert.True(t, f.verifyCreateTime(now))
+		assert.True(t, f.verifyCreateTime(now, e))
 
 		gotLogMsg := hook.LastEntry().Message
 		wantLogMsg := fmt.Sprintf(fCreateTimeMatchTrueLog,
@@ -885,8 +1185,9 @@ func TestVerifyFileCreateTime(t *testing.T) {
 		}
 		e.logger, hook = setupLogs()
 		e.fsys = fsys
+		e.afs = afero.FromIOFS{FS: fsys}
 
-		assert.False(t, f.verifyCreateTime(afterNow))
+		assert.False(t, f.verifyCreateTime(afterNow, e))
 
 		gotLogMsg := hook.LastEntry().Message
 		wantLogMsg := fmt.Sprintf(fCreateTimeMatchFalseLog,
@@ -900,9 +1201,7 @@ func TestVerifyFileCreateTime(t *testing.T) {
 }
 
 func TestVerifyFileIDName(t *testing.T) {
-	e = new(env)
-	files = []file{}
-	ap = NewAsyncProcessor(e, files)
+	e := new(env)
 
 	t.Run("returns true if file.smbname matches file.id filename", func(t *testing.T) {
 		f = file{
@@ -911,8 +1210,9 @@ func TestVerifyFileIDName(t *testing.T) {
 		}
 		e.logger, hook = setupLogs()
 		e.fsys = fsys
+		e.afs = afero.FromIOFS{FS: fsys}
 
-		assert.True(t, f.verifyFileIDName(testName))
+		assert.True(t, f.verifyFileIDName(testName, e))
 
 		gotLogMsg := hook.LastEntry().Message
 		wantLogMsg := fmt.Sprintf(fSmbNameMatchFileIDNameTrueLog, f.smbName, f.id, f.smbName, testName)
@@ -926,8 +1226,9 @@ func TestVerifyFileIDName(t *testing.T) {
 
 		e.logger, hook = setupLogs()
 		e.fsys = fsys
+		e.afs = afero.FromIOFS{FS: fsys}
 
-		assert.False(t, f.verifyFileIDName(testName))
+		assert.False(t, f.verifyFileIDName(testName, e))
 
 		gotLogMsg := hook.LastEntry().Message
 		wantLogMsg := fmt.Sprintf(fSmbNameMatchFileIDNameFalseLog, f.smbName, f.id, f.smbName, testName)
@@ -936,26 +1237,6 @@ func TestVerifyFileIDName(t *testing.T) {
 }
 
 func createFSTest(t *testing.T, numFiles int) (fstest.MapFS, []file) {
-	// Create gbrList file
-	var list string
-
-	// Create err
-	var err error
-
-	dir := getWorkDir()
-
-	list = fmt.Sprintf(gbrList, dir)
-	if err := os.Truncate(list, 0); err != nil {
-		log.Printf("Failed to truncate: %v", err)
-	}
-
-	out, err := os.OpenFile(list, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	defer out.Close()
-
 	fsys = fstest.MapFS{}
 
 	var files []file
@@ -966,8 +1247,8 @@ func createFSTest(t *testing.T, numFiles int) (fstest.MapFS, []file) {
 	dirs = append(dirs, "mb/FAN/download/")
 
 	for i := 1; i < 4; i++ {
-		dirs = append(dirs, "datav"+strconv.Itoa(i)+"/staging/")
-		dirs = append(dirs, "datav"+strconv.Itoa(i)+"/staging/download/")
+		dirs = append(dirs, "data"+strconv.Itoa(i)+"/staging/")
+		dirs = append(dirs, "data"+strconv.Itoa(i)+"/staging/download/")
 	}
 
 	for i := 0; i < numFiles; i++ {
@@ -989,7 +1270,8 @@ func createFSTest(t *testing.T, numFiles int) (fstest.MapFS, []file) {
 		// set content
 		data := genRandom(f.size, letterBytes)
 		// set hash
-		f.hash = sha256.Sum256(data)
+		sum := sha256.Sum256(data)
+		f.hash = sum[:]
 
 		// set id
 		f.id = string(genRandom(32, fileIDBytes))
@@ -1013,10 +1295,7 @@ func createFSTest(t *testing.T, numFiles int) (fstest.MapFS, []file) {
 
 		files = append(files, f)
 
-		_, err = out.WriteString(fmt.Sprintf("%v,%v\n", f.id, f.smbName))
-		if err != nil {
-			t.Fatal(err)
-		}
+		testGBR.addFile(f)
 	}
 
 	return fsys, files
@@ -1044,3 +1323,14 @@ func genGUID() (guid string) {
 
 	return
 }
+
+func mustGBMetadata(t *testing.T, f *file, e *env) *gbrFile {
+	t.Helper()
+
+	rec, err := f.getGBMetadata(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return rec
+}
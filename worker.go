@@ -1,56 +1,297 @@
 package main
 
-import "fmt"
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
 
 var (
+	adVerifyFailedLog         = "%v (file.id:%v) f.verify failed with f.reason:%v; skipping file"
 	adHasherErrLog            = "%v (file.id:%v) f.hasher error:%v; continuing"
-	adSetOldHashLog           = "%v (file.id:%v) setting f.oldHash:%v"
+	adSetOldHashLog           = "%v (file.id:%v) setting f.oldHash:%x"
 	adSetOldStagingPathLog    = "%v (file.id:%v) setting f.oldStagingPath:%v"
+	adMoveSkippedLog          = "%v (file.id:%v) f.move did not move file with f.reason:%v; skipping file"
 	adSetSuccessLog           = "%v (file.id:%v) setting f.success:%v"
-	adCompareHashesNoMatchLog = "%v (file.id:%v) f.oldHash:%v does not match f.hash:%v; fatal"
-	adCompareHashesMatchLog   = "%v (file.id:%v) f.oldHash:%v matches f.hash:%v"
+	adCompareHashesNoMatchLog = "%v (file.id:%v) f.oldHash:%x does not match f.hash:%x"
+	adCompareHashesMatchLog   = "%v (file.id:%v) f.oldHash:%x matches f.hash:%x"
+
+	adRemovedLeftoverLog  = "%v (file.id:%v) removed leftover:%v"
+	adSkipPostHashLog     = "%v (file.id:%v) renamed in place; skipping post-move hash"
+	adParanoidPostHashLog = "%v (file.id:%v) renamed in place; paranoid set so running post-move hash"
 
 	adReadyForProcessingLog = "%v (file.id:%v) f.stagingPath:%v is ready for processing"
+	adStartWorkersLog       = "processFiles: starting %v workers for %v files"
+	adStartMountWorkersLog  = "processFiles: mount:%v has %v files; starting %v workers"
+
+	adFileErrLog = "%v (file.id:%v) error:%v; handling as %v"
+	adAbortedLog = "%v (file.id:%v) run aborted; not processing file"
 )
 
+// processFiles verifies, hashes, moves & re-hashes ap.files
 func (ap *asyncProcessor) processFiles() {
-	e = ap.env
+	e := ap.env
 
-	for i := range ap.files {
-		err := ap.files[i].hasher()
-		if err != nil {
-			e.logger.Warn(fmt.Sprintf(adHasherErrLog, ap.files[i].smbName, ap.files[i].id, err))
-			continue
+	ap.forEachFile(func(f *file) error { return f.process(e) })
+	ap.collect(statusMoved)
+}
+
+// forEachFile runs do on each of ap.files, handling any error by its class
+// (see try), with a fresh e.limits for do to check files against. Files are grouped by the mount root of their stagingPath & each
+// mount gets at most e.mountWorkers workers, while e.workers bounds the total
+// across all mounts. Each worker only writes to the file it was handed, so the
+// results stay in the same order as ap.files. ap.elapsed is set to the time
+// taken
+func (ap *asyncProcessor) forEachFile(do func(f *file) error) {
+	e := ap.env
+
+	defer stopwatch(&ap.elapsed)()
+
+	workers := e.workers
+	if workers < 1 {
+		workers = 1
+	}
+
+	perMount := e.mountWorkers
+	if perMount < 1 {
+		perMount = 1
+	}
+
+	e.limits = newLimiter(e.maxFiles, e.maxBytes)
+
+	e.logger.Info(fmt.Sprintf(adStartWorkersLog, workers, len(ap.files)))
+
+	mounts, byMount := groupByMount(ap.files)
+	slots := make(chan struct{}, workers)
+
+	var wg sync.WaitGroup
+
+	for _, mount := range mounts {
+		jobs := make(chan int, len(byMount[mount]))
+
+		for _, i := range byMount[mount] {
+			jobs <- i
+		}
+
+		close(jobs)
+
+		n := min(perMount, len(byMount[mount]))
+		e.logger.Info(fmt.Sprintf(adStartMountWorkersLog, mount, len(byMount[mount]), n))
+
+		for w := 0; w < n; w++ {
+			wg.Add(1)
+
+			go func() {
+				defer wg.Done()
+
+				for i := range jobs {
+					slots <- struct{}{}
+					ap.try(&ap.files[i], do)
+					<-slots
+				}
+			}()
 		}
+	}
+
+	wg.Wait()
+}
+
+// try runs do on f once. Transient gbr errors are retried, with backoff, by
+// the gbr client (see cachingGBRClient), so any error here fails f. An error
+// that is not limited to one file aborts the run, so that no further files
+// are started
+func (ap *asyncProcessor) try(f *file, do func(f *file) error) {
+	e := ap.env
+
+	if ap.aborted() {
+		f.reason = reasonAborted
+		e.logger.Warn(fmt.Sprintf(adAbortedLog, f.smbName, f.id))
+
+		return
+	}
+
+	err := do(f)
+	if err == nil {
+		return
+	}
+
+	class := classify(err)
+
+	ap.see(class)
+	f.err = err
+
+	// Keep a more specific reason set by the step that failed
+	if f.reason == "" {
+		f.reason = errReason(err)
+	}
+	e.logger.Error(fmt.Sprintf(adFileErrLog, f.smbName, f.id, err, class))
+}
+
+// groupByMount returns the mount roots of files in the order they are first
+// seen, along with the indexes of the files on each mount
+func groupByMount(files []file) (mounts []string, byMount map[string][]int) {
+	byMount = make(map[string][]int)
+
+	for i := range files {
+		mount := mountRoot(files[i].stagingPath)
+		if _, ok := byMount[mount]; !ok {
+			mounts = append(mounts, mount)
+		}
+
+		byMount[mount] = append(byMount[mount], i)
+	}
+
+	return
+}
+
+// mountRoot returns the first component of a staging path, e.g. data1 for
+// /data1/staging/... or mb for mb/FAN/..., which is the disk it lives on
+func mountRoot(stagingPath string) string {
+	pth := strings.TrimPrefix(stagingPath, string(os.PathSeparator))
+	root, _, _ := strings.Cut(pth, string(os.PathSeparator))
+
+	return root
+}
+
+// process verifies, hashes, moves & re-hashes f. A file that fails a check is
+// skipped with f.reason set, while an error is left to the caller to handle
+func (f *file) process(e *env) error {
+	switch f.resumed {
+	case statePostVerified:
+		f.success = true
+		return nil
+	case stateMoved:
+		return f.finish(e)
+	}
+
+	stop := stopwatch(&f.timings.verify)
+	ok, err := f.verify(e)
+
+	stop()
+
+	if err != nil {
+		return err
+	}
+
+	if !ok {
+		e.logger.Warn(fmt.Sprintf(adVerifyFailedLog, f.smbName, f.id, f.reason))
+		return nil
+	}
+
+	if !f.withinLimits(e) {
+		return nil
+	}
+
+	f.journal(stateVerified, f.stagingPath, "", e)
+
+	stop = stopwatch(&f.timings.preHash)
+	err = f.hasher(e)
+
+	stop()
+
+	if err != nil {
+		e.logger.Warn(fmt.Sprintf(adHasherErrLog, f.smbName, f.id, err))
+		f.reason = reasonHashErr
+
+		return nil
+	}
+
+	if !f.verifyPlan(e) {
+		return nil
+	}
+
+	f.oldHash = f.hash
+	e.logger.Info(fmt.Sprintf(adSetOldHashLog, f.smbName, f.id, f.hash))
+	f.journal(statePreHashed, f.stagingPath, "", e)
+	f.oldStagingPath = f.stagingPath
+	e.logger.Info(fmt.Sprintf(adSetOldStagingPathLog, f.smbName, f.id, f.stagingPath))
+
+	stop = stopwatch(&f.timings.move)
+	moved, err := f.move(e)
+
+	stop()
+
+	if err != nil {
+		return err
+	}
+
+	if !moved {
+		e.logger.Warn(fmt.Sprintf(adMoveSkippedLog, f.smbName, f.id, f.reason))
+		return nil
+	}
+
+	return f.finish(e)
+}
+
+// finish checks f's hash at its new path matches f.oldHash. A mismatch should
+// never happen, so it returns an error wrapping ErrHashMismatch to abort. If
+// the moved file cannot be hashed the error wraps ErrPostHash
+func (f *file) finish(e *env) error {
+	if !f.skipPostHash(e) {
+		stop := stopwatch(&f.timings.postHash)
+		err := f.hasher(e)
+
+		stop()
 
-		ap.files[i].oldHash = ap.files[i].hash
-		e.logger.Info(fmt.Sprintf(adSetOldHashLog, ap.files[i].smbName, ap.files[i].id, ap.files[i].hash))
-		ap.files[i].oldStagingPath = ap.files[i].stagingPath
-		e.logger.Info(fmt.Sprintf(adSetOldStagingPathLog, ap.files[i].smbName, ap.files[i].id, ap.files[i].stagingPath))
-		ap.files[i].move()
-		// log (in Move)
-		err = ap.files[i].hasher()
 		if err != nil {
-			e.logger.Warn(fmt.Sprintf(adHasherErrLog, ap.files[i].smbName, ap.files[i].id, err))
-			continue
+			e.logger.Warn(fmt.Sprintf(adHasherErrLog, f.smbName, f.id, err))
+			return fmt.Errorf(errWrap, ErrPostHash, err)
 		}
+	}
 
-		if ap.files[i].compareHashes() {
-			ap.files[i].success = true
-			e.logger.Info(fmt.Sprintf(
-				adCompareHashesMatchLog, ap.files[i].smbName, ap.files[i].id, ap.files[i].oldHash, ap.files[i].hash))
-		} else {
-			ap.files[i].success = false
-			// Should never happen (assert?)
-			e.logger.Fatal(fmt.Sprintf(
-				adCompareHashesNoMatchLog, ap.files[i].smbName, ap.files[i].id, ap.files[i].oldHash, ap.files[i].hash))
+	if !f.compareHashes() {
+		f.success = false
+
+		return fmt.Errorf(errWrapMsg, ErrHashMismatch, fmt.Sprintf(
+			adCompareHashesNoMatchLog, f.smbName, f.id, f.oldHash, f.hash))
+	}
+
+	f.success = true
+	e.logger.Info(fmt.Sprintf(
+		adCompareHashesMatchLog, f.smbName, f.id, f.oldHash, f.hash))
+
+	if f.leftover != "" {
+		err := e.afs.Remove(f.leftover)
+		if err != nil {
+			return fmt.Errorf(errWrap, ErrMove, err)
 		}
 
-		e.logger.Info(fmt.Sprintf(adSetSuccessLog, ap.files[i].smbName, ap.files[i].id, ap.files[i].success))
-		e.logger.Info(fmt.Sprintf(adReadyForProcessingLog, ap.files[i].smbName, ap.files[i].id, ap.files[i].stagingPath))
+		e.logger.Info(fmt.Sprintf(adRemovedLeftoverLog, f.smbName, f.id, f.leftover))
 	}
+
+	f.journal(statePostVerified, f.oldStagingPath, f.stagingPath, e)
+
+	e.logger.Info(fmt.Sprintf(adSetSuccessLog, f.smbName, f.id, f.success))
+	e.logger.Info(fmt.Sprintf(adReadyForProcessingLog, f.smbName, f.id, f.stagingPath))
+
+	return nil
+}
+
+// skipPostHash reports whether the post-move hash can be skipped because the
+// file was renamed in place & is provably the same file. If so f.hash is set
+// to f.oldHash
+func (f *file) skipPostHash(e *env) bool {
+	if f.moveKind != moveRename {
+		return false
+	}
+
+	if e.paranoid {
+		e.logger.Info(fmt.Sprintf(adParanoidPostHashLog, f.smbName, f.id))
+		return false
+	}
+
+	if !f.verifyIdentity(e) {
+		return false
+	}
+
+	f.hash = f.oldHash
+	e.logger.Info(fmt.Sprintf(adSkipPostHashLog, f.smbName, f.id))
+
+	return true
 }
 
 func (f *file) compareHashes() bool {
-	return f.oldHash == f.hash
+	return len(f.hash) > 0 && bytes.Equal(f.oldHash, f.hash)
 }
@@ -2,8 +2,15 @@ package main
 
 import (
 	"crypto/sha256"
+	"crypto/sha512"
 	"fmt"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/spf13/afero"
 	"github.com/stretchr/testify/assert"
@@ -13,11 +20,17 @@ func TestWorker(t *testing.T) {
 	// N.B. Need to add failure tests
 	t.Run("given a file, it processes it", func(t *testing.T) {
 		afs, files := createAferoTest(t, 10, false)
-		e = new(env)
+		hostname, _ := os.Hostname()
+		ips, _ := net.LookupIP(hostname)
+		e := new(env)
 
 		e.logger, hook = setupLogs()
 		e.afs = afs
-		ap = NewAsyncProcessor(e, files)
+		e.fsys = afero.NewIOFS(afs)
+		e.sysIPs = []net.IP{ips[0]}
+		e.datasetID = testDatasetID
+		e.gbr = testGBR
+		ap := NewAsyncProcessor(e, files)
 
 		var oldPaths []string
 
@@ -27,7 +40,7 @@ func TestWorker(t *testing.T) {
 
 		for i := range files {
 			oldPaths = append(oldPaths, files[i].stagingPath)
-			newPaths = append(newPaths, newPath(files[i]))
+			newPaths = append(newPaths, mustNewPath(t, files[i]))
 
 			content, err := afero.ReadFile(afs, files[i].stagingPath)
 			if err != nil {
@@ -52,58 +65,509 @@ func TestWorker(t *testing.T) {
 		// Confirm first logs correct
 		logs := hook.Entries
 
-		// logs[0] checked in f.hasher
+		// logs[:v] checked in f.verify
+		v := 0
 
-		gotLogMsg := logs[1].Message
+		for i := range logs {
+			if logs[i].Message == fmt.Sprintf(fVerifiedLog, files[0].smbName, files[0].id) {
+				v = i
+				break
+			}
+		}
+
+		assert.NotZero(t, v)
+
+		// logs[v+1] checked in f.hasher
+
+		gotLogMsg := logs[v+2].Message
 		wantLogMsg := fmt.Sprintf(adSetOldHashLog, files[0].smbName, files[0].id, files[0].hash)
 		assertCorrectString(t, gotLogMsg, wantLogMsg)
 
-		gotLogMsg = logs[2].Message
+		gotLogMsg = logs[v+3].Message
 		wantLogMsg = fmt.Sprintf(adSetOldStagingPathLog, files[0].smbName, files[0].id, files[0].oldStagingPath)
 		assertCorrectString(t, gotLogMsg, wantLogMsg)
 
-		// logs[3:5] checked in f.move
-		// logs[6] checked in f.hasher
+		// logs[v+4:v+6] checked in f.move
+		// logs[v+7] checked in f.hasher
 
-		gotLogMsg = logs[7].Message
+		gotLogMsg = logs[v+8].Message
 		wantLogMsg = fmt.Sprintf(adCompareHashesMatchLog, files[0].smbName, files[0].id, files[0].oldHash, files[0].hash)
 		assertCorrectString(t, gotLogMsg, wantLogMsg)
 
-		gotLogMsg = logs[8].Message
+		gotLogMsg = logs[v+9].Message
 		wantLogMsg = fmt.Sprintf(adSetSuccessLog, files[0].smbName, files[0].id, true)
 		assertCorrectString(t, gotLogMsg, wantLogMsg)
 
-		gotLogMsg = logs[9].Message
+		gotLogMsg = logs[v+10].Message
 		wantLogMsg = fmt.Sprintf(adReadyForProcessingLog, files[0].smbName, files[0].id, files[0].stagingPath)
 		assertCorrectString(t, gotLogMsg, wantLogMsg)
 	})
+
+	t.Run("given many files & workers, it processes them all in order", func(t *testing.T) {
+		afs, files := createAferoTest(t, 20, false)
+		hostname, _ := os.Hostname()
+		ips, _ := net.LookupIP(hostname)
+		e := new(env)
+
+		e.logger, hook = setupLogs()
+		e.afs = afs
+		e.fsys = afero.NewIOFS(afs)
+		e.sysIPs = []net.IP{ips[0]}
+		e.datasetID = testDatasetID
+		e.gbr = testGBR
+		e.workers = 4
+		ap := NewAsyncProcessor(e, files)
+
+		var oldPaths []string
+
+		for i := range files {
+			oldPaths = append(oldPaths, files[i].stagingPath)
+		}
+
+		ap.processFiles()
+
+		gotLogMsg := hook.Entries[0].Message
+		wantLogMsg := fmt.Sprintf(adStartWorkersLog, 4, len(files))
+		assertCorrectString(t, gotLogMsg, wantLogMsg)
+
+		for i := range files {
+			assert.Equal(t, oldPaths[i], files[i].oldStagingPath)
+			assert.Equal(t, mustNewPath(t, file{stagingPath: oldPaths[i]}), files[i].stagingPath)
+			assert.True(t, files[i].success)
+		}
+	})
+
+	t.Run("given a file that fails verify, it skips it & records the reason", func(t *testing.T) {
+		afs, files := createAferoTest(t, 1, false)
+		e := new(env)
+
+		e.logger, hook = setupLogs()
+		e.afs = afs
+		e.fsys = afero.NewIOFS(afs)
+		e.sysIPs = []net.IP{net.ParseIP("192.168.101.1")}
+		e.datasetID = testDatasetID
+		e.gbr = testGBR
+		ap := NewAsyncProcessor(e, files)
+
+		oldPath := files[0].stagingPath
+
+		ap.processFiles()
+
+		_, err := afs.Stat(oldPath)
+		assert.NoError(t, err)
+
+		_, err = afs.Stat(mustNewPath(t, files[0]))
+		assert.Error(t, err)
+
+		assert.Equal(t, oldPath, files[0].stagingPath)
+		assert.Empty(t, files[0].oldStagingPath)
+		assert.False(t, files[0].success)
+		assertCorrectString(t, files[0].reason, reasonIPMismatch)
+
+		gotLogMsg := hook.LastEntry().Message
+		wantLogMsg := fmt.Sprintf(adVerifyFailedLog, files[0].smbName, files[0].id, reasonIPMismatch)
+		assertCorrectString(t, gotLogMsg, wantLogMsg)
+	})
+
+	t.Run("given a file whose newPath exists, it skips it & records the collision", func(t *testing.T) {
+		afs, files := createAferoTest(t, 1, false)
+		hostname, _ := os.Hostname()
+		ips, _ := net.LookupIP(hostname)
+		e := new(env)
+
+		e.logger, hook = setupLogs()
+		e.afs = afs
+		e.fsys = afero.NewIOFS(afs)
+		e.sysIPs = []net.IP{ips[0]}
+		e.datasetID = testDatasetID
+		e.gbr = testGBR
+		e.collision = collisionSkip
+		ap := NewAsyncProcessor(e, files)
+
+		oldPath := files[0].stagingPath
+		dst := mustNewPath(t, files[0])
+
+		err := afero.WriteFile(afs, dst, []byte(testCollisionContent), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ap.processFiles()
+
+		got, err := afero.ReadFile(afs, dst)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assertCorrectString(t, string(got), testCollisionContent)
+		assert.Equal(t, oldPath, files[0].stagingPath)
+		assert.False(t, files[0].success)
+		assert.Equal(t, collisionSkipped, files[0].collision)
+
+		gotLogMsg := hook.LastEntry().Message
+		wantLogMsg := fmt.Sprintf(adMoveSkippedLog, files[0].smbName, files[0].id, reasonCollision)
+		assertCorrectString(t, gotLogMsg, wantLogMsg)
+		assertCorrectString(t, ap.getResults()[0].Collision, collisionSkipped.String())
+	})
+
+	t.Run("given a file whose newPath exists & -collision fail, it fails it", func(t *testing.T) {
+		afs, files := createAferoTest(t, 1, false)
+		hostname, _ := os.Hostname()
+		ips, _ := net.LookupIP(hostname)
+		e := new(env)
+
+		e.logger, hook = setupLogs()
+		e.afs = afs
+		e.fsys = afero.NewIOFS(afs)
+		e.sysIPs = []net.IP{ips[0]}
+		e.datasetID = testDatasetID
+		e.gbr = testGBR
+		e.collision = collisionFail
+		ap := NewAsyncProcessor(e, files)
+
+		err := afero.WriteFile(afs, mustNewPath(t, files[0]), []byte(testCollisionContent), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ap.processFiles()
+
+		r := ap.getResults()[0]
+		assert.ErrorIs(t, files[0].err, ErrCollision)
+		assertCorrectString(t, r.Status, statusFailed)
+		assertCorrectString(t, r.Reason, reasonCollision)
+		assertCorrectString(t, r.Collision, collisionFailed.String())
+		assert.Equal(t, exitSkipped, ap.exitCode())
+	})
+}
+
+func TestProcessFilesMountLimit(t *testing.T) {
+	t.Run("it never works more than e.mountWorkers files on a mount at once", func(t *testing.T) {
+		memFs, files := createAferoTest(t, 20, false)
+		hostname, _ := os.Hostname()
+		ips, _ := net.LookupIP(hostname)
+		cfs := &countingFs{Fs: memFs, open: map[string]int{}, max: map[string]int{}}
+		e := new(env)
+
+		e.logger, hook = setupLogs()
+		e.afs = cfs
+		e.fsys = afero.NewIOFS(memFs)
+		e.sysIPs = []net.IP{ips[0]}
+		e.datasetID = testDatasetID
+		e.gbr = testGBR
+		e.workers = 8
+		e.mountWorkers = 1
+		ap := NewAsyncProcessor(e, files)
+
+		ap.processFiles()
+
+		for i := range files {
+			assert.True(t, files[i].success)
+		}
+
+		for mount, n := range cfs.max {
+			assert.Equal(t, 1, n, mount)
+		}
+	})
+}
+
+func TestForEachFileErrors(t *testing.T) {
+	setup := func(numFiles int) *asyncProcessor {
+		e := new(env)
+		e.logger, hook = setupLogs()
+
+		files := make([]file, numFiles)
+		for i := range files {
+			files[i] = file{smbName: testName, id: strconv.Itoa(i), stagingPath: testPath}
+		}
+
+		return &asyncProcessor{env: e, files: files}
+	}
+
+	t.Run("should not retry a transient error the gbr client has retried", func(t *testing.T) {
+		ap := setup(1)
+		attempts := 0
+
+		ap.forEachFile(func(f *file) error {
+			attempts++
+			return fmt.Errorf(errWrapMsg, ErrGbrUnavailable, testContent)
+		})
+
+		assert.Equal(t, 1, attempts)
+		assert.ErrorIs(t, ap.files[0].err, ErrGbrUnavailable)
+		assertCorrectString(t, ap.files[0].reason, reasonGbrUnavailable)
+		assert.Equal(t, exitRetried, ap.exitCode())
+	})
+
+	t.Run("should query gbr no more than -gbr-retries + 1 times for a file", func(t *testing.T) {
+		ap := setup(1)
+
+		gbr := newFakeGBRClient(testDatasetID)
+		gbr.fails = 10
+		ap.env.gbr = newCachingGBRClient(gbr, 0, 1, 0, 2, 0, ap.env.logger)
+
+		ap.forEachFile(func(f *file) error {
+			_, err := f.getGBMetadata(ap.env)
+			return err
+		})
+
+		assert.Equal(t, 3, gbr.getCalls())
+		assertCorrectString(t, ap.files[0].reason, reasonGbrUnavailable)
+	})
+
+	t.Run("should skip a file that fails & carry on", func(t *testing.T) {
+		ap := setup(3)
+
+		ap.forEachFile(func(f *file) error {
+			if f.id == "1" {
+				return fmt.Errorf(errWrapMsg, ErrMove, testContent)
+			}
+
+			f.success = true
+
+			return nil
+		})
+
+		assert.True(t, ap.files[0].success)
+		assertCorrectString(t, ap.files[1].reason, reasonMoveErr)
+		assert.True(t, ap.files[2].success)
+		assert.Equal(t, exitSkipped, ap.exitCode())
+	})
+
+	t.Run("should not start any more files after an abort", func(t *testing.T) {
+		ap := setup(3)
+
+		ap.forEachFile(func(f *file) error {
+			if f.id == "0" {
+				return fmt.Errorf(errWrapMsg, ErrHashMismatch, testContent)
+			}
+
+			f.success = true
+
+			return nil
+		})
+
+		assertCorrectString(t, ap.files[0].reason, reasonHashMismatch)
+
+		for _, f := range ap.files[1:] {
+			assert.False(t, f.success)
+			assertCorrectString(t, f.reason, reasonAborted)
+		}
+
+		assert.Equal(t, exitAborted, ap.exitCode())
+	})
+
+	t.Run("should exit ok without errors", func(t *testing.T) {
+		ap := setup(2)
+
+		ap.forEachFile(func(f *file) error { return nil })
+
+		assert.Equal(t, exitOK, ap.exitCode())
+	})
+}
+
+func TestSkipPostHash(t *testing.T) {
+	setup := func(t *testing.T) (*env, file) {
+		e := new(env)
+		e.afs = afero.NewBasePathFs(afero.NewOsFs(), t.TempDir())
+		e.logger, hook = setupLogs()
+
+		f := file{smbName: testName, id: testFileID, stagingPath: testPath}
+
+		err := e.afs.MkdirAll(path.Dir(f.stagingPath), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = afero.WriteFile(e.afs, f.stagingPath, []byte(testContent), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		f.fileInfo, err = e.afs.Stat(f.stagingPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = f.hasher(e)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		f.oldHash = f.hash
+		f.hash = nil
+		f.move(e)
+
+		return e, f
+	}
+
+	t.Run("it skips the post-move hash after an in place rename", func(t *testing.T) {
+		e, f := setup(t)
+
+		assert.True(t, f.skipPostHash(e))
+		assert.Equal(t, f.oldHash, f.hash)
+
+		gotLogMsg := hook.LastEntry().Message
+		wantLogMsg := fmt.Sprintf(adSkipPostHashLog, f.smbName, f.id)
+		assertCorrectString(t, gotLogMsg, wantLogMsg)
+	})
+
+	t.Run("it runs the post-move hash if paranoid", func(t *testing.T) {
+		e, f := setup(t)
+		e.paranoid = true
+
+		assert.False(t, f.skipPostHash(e))
+		assert.Nil(t, f.hash)
+
+		gotLogMsg := hook.LastEntry().Message
+		wantLogMsg := fmt.Sprintf(adParanoidPostHashLog, f.smbName, f.id)
+		assertCorrectString(t, gotLogMsg, wantLogMsg)
+	})
+
+	t.Run("it runs the post-move hash if the identity check fails", func(t *testing.T) {
+		e, f := setup(t)
+
+		later := f.fileInfo.ModTime().Add(time.Hour)
+
+		err := e.afs.Chtimes(f.stagingPath, later, later)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assert.False(t, f.skipPostHash(e))
+		assert.Nil(t, f.hash)
+
+		gotLogMsg := hook.LastEntry().Message
+		wantLogMsg := fmt.Sprintf(fIdentityMatchFalseLog, f.smbName, f.id, f.stagingPath)
+		assertCorrectString(t, gotLogMsg, wantLogMsg)
+	})
+
+	t.Run("it runs the post-move hash if the move was not a rename", func(t *testing.T) {
+		e, f := setup(t)
+		f.moveKind = moveCopy
+
+		assert.False(t, f.skipPostHash(e))
+		assert.Nil(t, f.hash)
+	})
+}
+
+func TestFinish(t *testing.T) {
+	t.Run("it fails a moved file that cannot be hashed at its new path", func(t *testing.T) {
+		e := new(env)
+		e.afs = afero.NewMemMapFs()
+		e.logger, hook = setupLogs()
+
+		ap := NewAsyncProcessor(e, []file{{
+			smbName:        testName,
+			id:             testFileID,
+			stagingPath:    testPath,
+			oldStagingPath: testName,
+			oldHash:        []byte(testContent),
+			moveKind:       moveCopy,
+		}}).(*asyncProcessor)
+
+		ap.forEachFile(func(f *file) error { return f.finish(e) })
+		ap.collect(statusMoved)
+
+		f := ap.files[0]
+		assert.ErrorIs(t, f.err, ErrPostHash)
+		assert.False(t, f.success)
+		assertCorrectString(t, f.reason, reasonPostHashErr)
+		assertCorrectString(t, ap.getResults()[0].Status, statusFailed)
+		assert.Equal(t, exitSkipped, ap.exitCode())
+	})
+}
+
+func TestGroupByMount(t *testing.T) {
+	t.Run("it groups files by mount root in first seen order", func(t *testing.T) {
+		files := []file{
+			{stagingPath: "/data2/staging/a"},
+			{stagingPath: "mb/FAN/b"},
+			{stagingPath: "data2/staging/download/c"},
+			{stagingPath: "/data1/staging/d"},
+			{stagingPath: "/mb/FAN/download/e"},
+		}
+
+		mounts, byMount := groupByMount(files)
+
+		assert.Equal(t, []string{"data2", "mb", "data1"}, mounts)
+		assert.Equal(t, []int{0, 2}, byMount["data2"])
+		assert.Equal(t, []int{1, 4}, byMount["mb"])
+		assert.Equal(t, []int{3}, byMount["data1"])
+	})
 }
 
 func TestCompareHashes(t *testing.T) {
 	t.Run("matching hashes should return true", func(t *testing.T) {
 		var f file
 
-		var hash [32]byte
-
-		b := []byte("test")
-		hash = sha256.Sum256(b)
-		f.hash = hash
-		f.oldHash = hash
+		hash := sha256.Sum256([]byte("test"))
+		f.hash = hash[:]
+		f.oldHash = hash[:]
 		assert.True(t, f.compareHashes())
 	})
 	t.Run("non-matching hashes should return false", func(t *testing.T) {
 		var f file
 
-		var hash [32]byte
+		hash := sha256.Sum256([]byte("test"))
+		f.hash = hash[:]
+		oldHash := sha256.Sum256([]byte("difftest"))
+		f.oldHash = oldHash[:]
+		assert.False(t, f.compareHashes())
+	})
+	t.Run("hashes of different algorithms should return false", func(t *testing.T) {
+		var f file
 
-		var b []byte
+		hash := sha256.Sum256([]byte("test"))
+		f.hash = hash[:]
+		oldHash := sha512.Sum512([]byte("test"))
+		f.oldHash = oldHash[:]
+		assert.False(t, f.compareHashes())
+	})
+	t.Run("missing hashes should return false", func(t *testing.T) {
+		var f file
 
-		b = []byte("test")
-		hash = sha256.Sum256(b)
-		f.hash = hash
-		b = []byte("difftest")
-		hash = sha256.Sum256(b)
-		f.oldHash = hash
 		assert.False(t, f.compareHashes())
 	})
 }
+
+// countingFs tracks the most files held open at once on each mount
+type countingFs struct {
+	afero.Fs
+	mu   sync.Mutex
+	open map[string]int
+	max  map[string]int
+}
+
+func (c *countingFs) Open(name string) (afero.File, error) {
+	f, err := c.Fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	mount := mountRoot(name)
+
+	c.mu.Lock()
+	c.open[mount]++
+	c.max[mount] = max(c.max[mount], c.open[mount])
+	c.mu.Unlock()
+
+	// hold the file open long enough for other workers to overlap
+	time.Sleep(time.Millisecond)
+
+	return &countingFile{File: f, done: func() {
+		c.mu.Lock()
+		c.open[mount]--
+		c.mu.Unlock()
+	}}, nil
+}
+
+type countingFile struct {
+	afero.File
+	done func()
+}
+
+func (c *countingFile) Close() error {
+	c.done()
+	return c.File.Close()
+}